@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requiredApprovals is the number of distinct approvers a registration needs
+// before a User is created. The default of 1 keeps single-admin approval.
+var requiredApprovals = envInt("REGISTRATION_APPROVALS", 1)
+
+// Approval records one approver's sign-off on a registration.
+type Approval struct {
+	UserID   string    `json:"user_id"`
+	Username string    `json:"username"`
+	At       time.Time `json:"at"`
+}
+
+func multiApproval() bool {
+	return requiredApprovals > 1
+}
+
+// approvalCaller resolves who is approving. With the multi-approver policy
+// on, only authenticated holders of the approve permission may approve;
+// otherwise the approver is recorded when known.
+func approvalCaller(c *fiber.Ctx) (*User, error) {
+	if multiApproval() {
+		return requirePermission(c, permApproveRegistrations)
+	}
+	return currentUser(c)
+}
+
+// addApproval adds approver's sign-off to reg and reports whether the
+// registration now has enough approvals to be turned into a user.
+func addApproval(reg *Registration, approver *User, now time.Time) (bool, error) {
+	if approver != nil {
+		for _, a := range reg.Approvals {
+			if a.UserID == approver.ID {
+				return false, fiber.NewError(fiber.StatusConflict, "already approved by "+firstNonEmpty(approver.Username, approver.Email))
+			}
+		}
+		reg.Approvals = append(reg.Approvals, Approval{UserID: approver.ID, Username: approver.Username, At: now})
+	}
+	if !multiApproval() {
+		return true, nil
+	}
+	return len(reg.Approvals) >= requiredApprovals, nil
+}
+
+// handleRegistrationVeto lets any approver reject a registration outright,
+// regardless of how many approvals it has already collected.
+func handleRegistrationVeto(c *fiber.Ctx) error {
+	regID := c.Params("id")
+	approver, err := requirePermission(c, permApproveRegistrations)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Reason string `json:"reason"`
+		Notify bool   `json:"notify"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+		}
+	}
+	reason := "vetoed"
+	if strings.TrimSpace(req.Reason) != "" {
+		reason += ": " + req.Reason
+	}
+	vetoed, err := takeRegistration(regID, func(reg Registration) error {
+		return recordRejection(reg, reason, usernameOf(approver))
+	})
+	if err != nil {
+		return storeError(err, "registration not found")
+	}
+	recordAudit(c, "registration.veto", regID, req.Reason)
+	if req.Notify {
+		notifyRejected([]Registration{vetoed}, req.Reason)
+	}
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+func usernameOf(user *User) string {
+	if user == nil {
+		return ""
+	}
+	return firstNonEmpty(user.Username, user.Email)
+}
+
+func envInt(key string, def int) int {
+	if n, err := strconv.Atoi(envOr(key, "")); err == nil {
+		return n
+	}
+	return def
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestMultiApproverWorkflow(t *testing.T) {
+	dataDir = t.TempDir()
+	requiredApprovals = 2
+	defer func() { requiredApprovals = 1 }()
+
+	approvers := []User{
+		{ID: "u1", Email: "one@x.org", Username: "one", Role: "user", Status: "active", Permissions: []string{permApproveRegistrations}},
+		{ID: "u2", Email: "two@x.org", Username: "two", Role: "admin", Status: "active"},
+		{ID: "u3", Email: "three@x.org", Username: "three", Role: "user", Status: "active"},
+	}
+	if err := writeJSON(filepath.Join(dataDir, "users.json"), approvers); err != nil {
+		t.Fatal(err)
+	}
+	pending := []Registration{
+		{ID: "r1", Email: "new@x.org", Username: "new", CreatedAt: time.Now().UTC()},
+		{ID: "r2", Email: "bad@x.org", Username: "bad", CreatedAt: time.Now().UTC()},
+	}
+	if err := writeJSON(filepath.Join(dataDir, "pending.json"), pending); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/:id/approve", handleRegistrationApprove)
+	app.Post("/:id/veto", handleRegistrationVeto)
+	call := func(path string, as *User) int {
+		req := httptest.NewRequest("POST", path, nil)
+		if as != nil {
+			token, _ := generateJWT(as)
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if code := call("/r1/approve", nil); code != fiber.StatusUnauthorized {
+		t.Fatalf("anonymous approval allowed: %d", code)
+	}
+	// Only a live session counts; a hand-made token naming an admin does not.
+	forged := base64.StdEncoding.EncodeToString([]byte("u2:two@x.org:admin::made-up"))
+	if code, _ := send(t, app, "POST", "/r1/approve", forged, ""); code != fiber.StatusUnauthorized {
+		t.Fatalf("forged approver accepted: %d", code)
+	}
+	if code := call("/r1/approve", &approvers[2]); code != fiber.StatusForbidden {
+		t.Fatalf("approval without permission allowed: %d", code)
+	}
+	if code := call("/r1/approve", &approvers[0]); code != 200 {
+		t.Fatalf("first approval failed: %d", code)
+	}
+	if code := call("/r1/approve", &approvers[0]); code != fiber.StatusConflict {
+		t.Fatalf("duplicate approval accepted: %d", code)
+	}
+
+	var users []User
+	_ = readJSON(filepath.Join(dataDir, "users.json"), &users)
+	if len(users) != 3 {
+		t.Fatalf("user created after a single approval")
+	}
+
+	if code := call("/r1/approve", &approvers[1]); code != 200 {
+		t.Fatalf("second approval failed: %d", code)
+	}
+	users = nil
+	_ = readJSON(filepath.Join(dataDir, "users.json"), &users)
+	if len(users) != 4 || len(users[3].ApprovedBy) != 2 || users[3].ApprovedBy[0].Username != "one" {
+		t.Fatalf("approved user missing approvals: %+v", users)
+	}
+
+	if code := call("/r2/veto", &approvers[0]); code != 200 {
+		t.Fatalf("veto failed: %d", code)
+	}
+	rejected, _ := loadRejected()
+	if len(rejected) != 1 || rejected[0].RejectedBy != "one" {
+		t.Fatalf("veto not recorded: %+v", rejected)
+	}
+}
+
+func TestApproveRuleHoldsUnderMultiApproval(t *testing.T) {
+	dataDir = t.TempDir()
+	requiredApprovals = 2
+	defer func() { requiredApprovals = 1 }()
+	if err := writeJSON(rulesFile(), []RegistrationRule{{ID: "uni", EmailDomains: []string{"uni.edu"}, Decision: ruleApprove}}); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/register", handleRegistrationSubmit)
+	if code, out := send(t, app, "POST", "/register", "", `{"email":"a@uni.edu","username":"a"}`); code != 200 || out["status"] != "pending" {
+		t.Fatalf("approve rule bypassed the approvers: %d %v", code, out)
+	}
+	if users, _ := store.Users.List(); len(users) != 0 {
+		t.Fatalf("user created without approvals: %+v", users)
+	}
+	if pending, _ := store.Registrations.List(); len(pending) != 1 || pending[0].RuleID != "uni" {
+		t.Fatalf("held registration: %+v", pending)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AuditEntry records one administrative action.
+type AuditEntry struct {
+	ID     int64     `json:"id"`
+	At     time.Time `json:"at"`
+	Actor  string    `json:"actor,omitempty"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// recordAudit appends an entry for the caller of c. Failing to write the
+// log never fails the action itself.
+func recordAudit(c *fiber.Ctx, action, target, detail string) {
+	actor := ""
+	if c != nil {
+		if u, err := currentUser(c); err == nil {
+			actor = usernameOf(u)
+		}
+	}
+	entry := AuditEntry{At: time.Now().UTC(), Actor: actor, Action: action, Target: target, Detail: detail}
+	if err := store.Audit.Append(entry); err != nil {
+		log.Printf("audit %s %s: %v", action, target, err)
+	}
+}
+
+// actorIn reports whether actor is one of names, ignoring case.
+func actorIn(actor string, names []string) bool {
+	for _, n := range names {
+		if n != "" && strings.EqualFold(actor, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// newestFirst returns up to limit entries of list in reverse order.
+func newestFirst(list []AuditEntry, limit int) []AuditEntry {
+	if limit <= 0 || limit > len(list) {
+		limit = len(list)
+	}
+	out := make([]AuditEntry, 0, limit)
+	for i := len(list) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, list[i])
+	}
+	return out
+}
+
+func handleAuditList(c *fiber.Ctx) error {
+	limit := 100
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid limit")
+		}
+		limit = n
+	}
+	entries, err := store.Audit.List(limit)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load audit log")
+	}
+	return c.JSON(entries)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// currentUser resolves the bearer token issued by handleLogin to the stored
+// user. It returns nil without error when no token is presented.
+func currentUser(c *fiber.Ctx) (*User, error) {
+	header := c.Get(fiber.HeaderAuthorization)
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if token == "" {
+		return nil, nil
+	}
+	userID, sessionID, ok := tokenClaims(token)
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+	}
+	session, err := lookupSession(sessionID, time.Now())
+	if err != nil || session == nil || session.UserID != userID {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "session expired")
+	}
+	user, err := store.Users.Get(userID)
+	if err != nil || user.Status != "active" {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "invalid token")
+	}
+	return &user, nil
+}
+
+// requirePermission returns the caller if it is authenticated and holds perm.
+func requirePermission(c *fiber.Ctx, perm string) (*User, error) {
+	user, err := currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "authentication required")
+	}
+	if !hasPermission(user, perm) {
+		return nil, fiber.NewError(fiber.StatusForbidden, "missing permission "+perm)
+	}
+	return user, nil
+}
+
+// hasPermission reports whether user holds perm, through its role or
+// granted directly; see effectivePermissions.
+func hasPermission(user *User, perm string) bool {
+	if user == nil {
+		return false
+	}
+	if user.Role == "admin" || slices.Contains(user.Permissions, perm) {
+		return true
+	}
+	roles, err := loadRoles()
+	if err != nil {
+		log.Printf("roles: %v", err)
+		return false
+	}
+	return slices.Contains(rolePermissions(user.Role, roles), perm)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// autheliaAdminGroup is the Authelia group that mirrors the admin role.
+const autheliaAdminGroup = "admins"
+
+// editAutheliaUsers rewrites the Authelia users file, if there is one,
+// under its lock. edit sees every entry under users: with its name, email
+// and mapping node, and says whether to drop the entry and whether it
+// changed it. The rest of the file, comments included, is kept, and the
+// file is only written when something changed, which is reported.
+func editAutheliaUsers(edit func(name, email string, entry *yaml.Node) (drop, changed bool)) (bool, error) {
+	if _, err := os.Stat(autheliaUsers); os.IsNotExist(err) {
+		return false, nil
+	}
+	unlock, err := lockFile(autheliaUsers)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	raw, err := os.ReadFile(autheliaUsers)
+	if err != nil {
+		return false, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return false, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return false, nil
+	}
+	changed := false
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "users" || root.Content[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+		users := root.Content[i+1]
+		kept := users.Content[:0]
+		for j := 0; j+1 < len(users.Content); j += 2 {
+			name, entry := users.Content[j], users.Content[j+1]
+			email := ""
+			if v := yamlField(entry, "email"); v != nil {
+				email = v.Value
+			}
+			drop, edited := edit(name.Value, email, entry)
+			changed = changed || drop || edited
+			if !drop {
+				kept = append(kept, name, entry)
+			}
+		}
+		users.Content = kept
+	}
+	if !changed {
+		return false, nil
+	}
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return false, err
+	}
+	return true, replaceFile(autheliaUsers, &out)
+}
+
+// autheliaEntryOf reports whether the Authelia entry name/email belongs to
+// the user with username or email.
+func autheliaEntryOf(name, email string, u User) bool {
+	for _, id := range []string{u.Username, u.Email} {
+		if id != "" && (strings.EqualFold(id, name) || strings.EqualFold(id, email)) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncAutheliaUser brings u's Authelia entry, if it has one, in line with
+// its status, role and groups.
+func syncAutheliaUser(u User) (bool, error) {
+	groups, err := loadGroups()
+	if err != nil {
+		return false, err
+	}
+	return syncAutheliaUsers([]User{u}, groups)
+}
+
+// syncAutheliaUsers brings the Authelia entries of users in line with
+// their status, role and groups: only active users are enabled, only
+// admins are in autheliaAdminGroup, and each entry is in exactly the
+// groups the user belongs to, directly or by nesting. Groups Authelia has
+// that the API does not manage are left alone; retired names groups that
+// were renamed or deleted, which entries leave as well.
+func syncAutheliaUsers(users []User, groups []Group, retired ...string) (bool, error) {
+	managed := append([]string(nil), retired...)
+	for _, g := range groups {
+		managed = append(managed, g.Name)
+	}
+	return editAutheliaUsers(func(name, email string, entry *yaml.Node) (bool, bool) {
+		i := slices.IndexFunc(users, func(u User) bool { return autheliaEntryOf(name, email, u) })
+		if entry.Kind != yaml.MappingNode || i < 0 {
+			return false, false
+		}
+		u := users[i]
+		changed := false
+		disabled := u.Status != "active"
+		if v := yamlField(entry, "disabled"); (v != nil && v.Value == "true") != disabled {
+			setYAMLField(entry, "disabled", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: boolKey(disabled)})
+			changed = true
+		}
+		if setYAMLListMember(entry, "groups", autheliaAdminGroup, u.Role == "admin") {
+			changed = true
+		}
+		member := accessOf(&u, groups).Groups
+		for _, g := range managed {
+			if setYAMLListMember(entry, "groups", g, slices.Contains(member, g)) {
+				changed = true
+			}
+		}
+		return false, changed
+	})
+}
+
+// yamlField returns the value of key in the mapping node m, or nil.
+func yamlField(m *yaml.Node, key string) *yaml.Node {
+	for k := 0; m.Kind == yaml.MappingNode && k+1 < len(m.Content); k += 2 {
+		if m.Content[k].Value == key {
+			return m.Content[k+1]
+		}
+	}
+	return nil
+}
+
+func setYAMLField(m *yaml.Node, key string, value *yaml.Node) {
+	for k := 0; k+1 < len(m.Content); k += 2 {
+		if m.Content[k].Value == key {
+			m.Content[k+1] = value
+			return
+		}
+	}
+	m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, value)
+}
+
+// setYAMLListMember adds item to, or removes it from, the sequence under
+// key in m, creating the sequence when needed. It reports whether m
+// changed.
+func setYAMLListMember(m *yaml.Node, key, item string, member bool) bool {
+	list := yamlField(m, key)
+	if list == nil {
+		if !member {
+			return false
+		}
+		list = &yaml.Node{Kind: yaml.SequenceNode}
+		setYAMLField(m, key, list)
+	}
+	if list.Kind != yaml.SequenceNode {
+		return false
+	}
+	for i, n := range list.Content {
+		if n.Value == item {
+			if member {
+				return false
+			}
+			list.Content = append(list.Content[:i], list.Content[i+1:]...)
+			return true
+		}
+	}
+	if !member {
+		return false
+	}
+	list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: item})
+	return true
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	backupMaxAge   = envDuration("BACKUP_MAX_AGE", 0) // 0 keeps snapshots regardless of age
+	backupAuthelia = envOr("BACKUP_AUTHELIA", "false") == "true"
+)
+
+const backupManifestName = "manifest.json"
+
+var errBackupCorrupt = errors.New("backup failed verification")
+
+// backupManifest is the first entry of every snapshot archive.
+type backupManifest struct {
+	Name          string       `json:"name"`
+	CreatedAt     time.Time    `json:"created_at"`
+	Reason        string       `json:"reason"`         // scheduled, manual, pre-migration, pre-restore
+	SchemaVersion int          `json:"schema_version"` // of the data files, see schema.json
+	Files         []backupFile `json:"files"`
+}
+
+type backupFile struct {
+	Path   string `json:"path"` // data/<file>, sqlite/coreapi.db or authelia/<file>
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type backupInfo struct {
+	backupManifest
+	Size int64 `json:"size"` // of the compressed archive
+}
+
+type backupProblem struct {
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+}
+
+func backupsDir() string {
+	return filepath.Join(dataDir, "backups")
+}
+
+var backupNamePattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._-]*$`)
+
+// backupPath resolves a snapshot name from a URL to its archive.
+func backupPath(name string) (string, error) {
+	if !backupNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return "", errNotFound
+	}
+	p := filepath.Join(backupsDir(), name+".tar.gz")
+	if _, err := os.Stat(p); err != nil {
+		return "", errNotFound
+	}
+	return p, nil
+}
+
+// backupDataFiles is the scheduled backup job: a snapshot followed by
+// retention.
+func backupDataFiles(ctx context.Context) error {
+	if _, err := createBackup(ctx, "scheduled"); err != nil {
+		return err
+	}
+	return pruneBackups(time.Now())
+}
+
+// createBackup takes a consistent snapshot with writes paused.
+func createBackup(ctx context.Context, reason string) (backupManifest, error) {
+	writes.pause()
+	defer writes.resume()
+	return writeBackup(ctx, reason, "")
+}
+
+// backupSource is one file going into a snapshot.
+type backupSource struct {
+	path, name string
+}
+
+// writeBackup archives the JSON files in DATA_DIR, the SQLite database when
+// that backend is in use and, with BACKUP_AUTHELIA=true, the Authelia users
+// file into backups/<timestamp><suffix>.tar.gz. It does not pause writes;
+// the caller keeps writers out.
+func writeBackup(ctx context.Context, reason, suffix string) (backupManifest, error) {
+	dir := backupsDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return backupManifest{}, err
+	}
+	now := time.Now().UTC()
+	name := now.Format("20060102T150405Z") + suffix
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(dir, name+".tar.gz")); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s%s-%d", now.Format("20060102T150405Z"), suffix, i)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
+	if err != nil {
+		return backupManifest{}, err
+	}
+	var sources []backupSource
+	for _, f := range files {
+		sources = append(sources, backupSource{f, "data/" + filepath.Base(f)})
+	}
+	if store.snapshotTo != nil {
+		tmp := filepath.Join(dir, ".snapshot-"+name+".db")
+		if err := store.snapshotTo(tmp); err != nil {
+			return backupManifest{}, fmt.Errorf("sqlite snapshot: %w", err)
+		}
+		defer os.Remove(tmp)
+		sources = append(sources, backupSource{tmp, "sqlite/coreapi.db"})
+	}
+	if backupAuthelia {
+		if _, err := os.Stat(autheliaUsers); err == nil {
+			sources = append(sources, backupSource{autheliaUsers, "authelia/" + filepath.Base(autheliaUsers)})
+		}
+	}
+
+	schema, _ := loadDataManifest()
+	manifest := backupManifest{Name: name, CreatedAt: now, Reason: reason, SchemaVersion: schema.Version}
+	for _, src := range sources {
+		if err := ctx.Err(); err != nil {
+			return backupManifest{}, err
+		}
+		size, sum, err := hashFile(src.path)
+		if err != nil {
+			return backupManifest{}, err
+		}
+		manifest.Files = append(manifest.Files, backupFile{Path: src.name, Size: size, SHA256: sum})
+	}
+
+	tmp := filepath.Join(dir, ".tmp-"+name+".tar.gz")
+	if err := writeBackupArchive(tmp, manifest, sources); err != nil {
+		os.Remove(tmp)
+		return backupManifest{}, err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name+".tar.gz")); err != nil {
+		os.Remove(tmp)
+		return backupManifest{}, err
+	}
+	return manifest, syncDir(dir)
+}
+
+func writeBackupArchive(dst string, manifest backupManifest, sources []backupSource) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: backupManifestName, Mode: 0o600, Size: int64(len(raw)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(raw); err != nil {
+		return err
+	}
+	for i, src := range sources {
+		if err := addBackupEntry(tw, src, manifest.Files[i].Size, manifest.CreatedAt); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func addBackupEntry(tw *tar.Writer, src backupSource, size int64, at time.Time) error {
+	in, err := os.Open(src.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: src.name, Mode: 0o600, Size: size, ModTime: at}); err != nil {
+		return err
+	}
+	// A file that changed since it was hashed fails here rather than
+	// producing an archive that will not verify.
+	_, err = io.CopyN(tw, in, size)
+	return err
+}
+
+func hashFile(p string) (int64, string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return n, hex.EncodeToString(h.Sum(nil)), err
+}
+
+// readBackup opens an archive and hands fn its manifest and then each file
+// entry in turn.
+func readBackup(archive string, fn func(m backupManifest, hdr *tar.Header, r io.Reader) error) (backupManifest, error) {
+	var m backupManifest
+	f, err := os.Open(archive)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return m, err
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		return m, err
+	}
+	if hdr.Name != backupManifestName {
+		return m, fmt.Errorf("%s: manifest missing", filepath.Base(archive))
+	}
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return m, fmt.Errorf("%s: manifest: %w", filepath.Base(archive), err)
+	}
+	if fn == nil {
+		return m, nil
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return m, err
+		}
+		if err := fn(m, hdr, tr); err != nil {
+			return m, err
+		}
+	}
+}
+
+func listBackups() ([]backupInfo, error) {
+	archives, err := filepath.Glob(filepath.Join(backupsDir(), "*.tar.gz"))
+	if err != nil {
+		return nil, err
+	}
+	out := []backupInfo{}
+	for _, a := range archives {
+		if strings.HasPrefix(filepath.Base(a), ".") {
+			continue
+		}
+		m, err := readBackup(a, nil)
+		if err != nil {
+			log.Printf("backup %s: %v", filepath.Base(a), err)
+			m.Name = strings.TrimSuffix(filepath.Base(a), ".tar.gz")
+		}
+		info := backupInfo{backupManifest: m}
+		if st, err := os.Stat(a); err == nil {
+			info.Size = st.Size()
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name > out[j].Name })
+	return out, nil
+}
+
+// pruneBackups keeps the newest backupKeep snapshots and drops any older
+// than backupMaxAge. The newest snapshot is always kept.
+func pruneBackups(now time.Time) error {
+	list, err := listBackups()
+	if err != nil {
+		return err
+	}
+	for i, b := range list {
+		if i == 0 {
+			continue
+		}
+		tooMany := backupKeep > 0 && i >= backupKeep
+		tooOld := backupMaxAge > 0 && !b.CreatedAt.IsZero() && now.Sub(b.CreatedAt) > backupMaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err := os.Remove(filepath.Join(backupsDir(), b.Name+".tar.gz")); err != nil {
+			return fmt.Errorf("prune backup %s: %w", b.Name, err)
+		}
+	}
+	return nil
+}
+
+// verifyBackup checks every file in the archive against the manifest.
+func verifyBackup(archive string) (backupManifest, []backupProblem, error) {
+	problems := []backupProblem{}
+	seen := map[string]bool{}
+	m, err := readBackup(archive, func(m backupManifest, hdr *tar.Header, r io.Reader) error {
+		h := sha256.New()
+		n, err := io.Copy(h, r)
+		if err != nil {
+			return err
+		}
+		seen[hdr.Name] = true
+		for _, f := range m.Files {
+			if f.Path != hdr.Name {
+				continue
+			}
+			if f.Size != n || f.SHA256 != hex.EncodeToString(h.Sum(nil)) {
+				problems = append(problems, backupProblem{hdr.Name, "checksum mismatch"})
+			}
+			return nil
+		}
+		problems = append(problems, backupProblem{hdr.Name, "not in manifest"})
+		return nil
+	})
+	if err != nil {
+		return m, nil, err
+	}
+	for _, f := range m.Files {
+		if !seen[f.Path] {
+			problems = append(problems, backupProblem{f.Path, "missing from archive"})
+		}
+	}
+	return m, problems, nil
+}
+
+// restoreBackup replaces the live data with the snapshot in archive. Writes
+// are paused for the whole restore, and a pre-restore snapshot is taken
+// first so the restore itself can be undone. keys.json is never replaced:
+// data keys are only ever added, so the live file can open any snapshot.
+func restoreBackup(ctx context.Context, archive string) (backupManifest, string, error) {
+	m, problems, err := verifyBackup(archive)
+	if err != nil {
+		return m, "", err
+	}
+	if len(problems) > 0 {
+		return m, "", fmt.Errorf("%w: %s %s", errBackupCorrupt, problems[0].Path, problems[0].Problem)
+	}
+	if latest := dataMigrations[len(dataMigrations)-1].Version; m.SchemaVersion > latest {
+		return m, "", fmt.Errorf("snapshot schema version %d is newer than this build supports (%d)", m.SchemaVersion, latest)
+	}
+	hasDB := false
+	for _, f := range m.Files {
+		hasDB = hasDB || f.Path == "sqlite/coreapi.db"
+	}
+	if hasDB != (store.restoreFrom != nil) {
+		return m, "", fmt.Errorf("snapshot and storage backend %q do not match", storageBackend())
+	}
+
+	writes.pause()
+	pre, err := writeBackup(ctx, "pre-restore "+m.Name, "-pre-restore")
+	if err == nil {
+		err = extractBackup(archive, m)
+	}
+	writes.resume()
+	if err != nil {
+		return m, pre.Name, err
+	}
+	// An older snapshot comes back at its own schema version.
+	if _, err := migrateDataFiles(ctx, dataMigrations); err != nil {
+		return m, pre.Name, err
+	}
+	return m, pre.Name, nil
+}
+
+func extractBackup(archive string, m backupManifest) error {
+	restored := map[string]bool{"keys.json": true}
+	_, err := readBackup(archive, func(_ backupManifest, hdr *tar.Header, r io.Reader) error {
+		dir, file := path.Split(hdr.Name)
+		switch {
+		case dir == "data/" && file == "keys.json":
+			return nil
+		case dir == "data/" && strings.HasSuffix(file, ".json"):
+			restored[file] = true
+			return writeDataFile(filepath.Join(dataDir, file), func(w io.Writer) error {
+				_, err := io.Copy(w, r)
+				return err
+			})
+		case hdr.Name == "sqlite/coreapi.db":
+			tmp := filepath.Join(backupsDir(), ".restore-"+m.Name+".db")
+			defer os.Remove(tmp)
+			if err := replaceFile(tmp, r); err != nil {
+				return err
+			}
+			return store.restoreFrom(tmp)
+		case dir == "authelia/":
+			return replaceFile(autheliaUsers, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Files created after the snapshot was taken go too.
+	current, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, f := range current {
+		if !restored[filepath.Base(f)] {
+			if err := removeDataFile(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceFile durably swaps p for the contents of r. It bypasses the
+// write gate, which the restore holds paused.
+func replaceFile(p string, r io.Reader) error {
+	_, err := commitFile(p, 0o600, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	return err
+}
+
+func handleBackupsList(c *fiber.Ctx) error {
+	list, err := listBackups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(list)
+}
+
+func handleBackupCreate(c *fiber.Ctx) error {
+	m, err := createBackup(c.Context(), "manual")
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	if err := pruneBackups(time.Now()); err != nil {
+		log.Printf("prune backups: %v", err)
+	}
+	recordAudit(c, "backup.create", m.Name, "")
+	return c.JSON(m)
+}
+
+func handleBackupDownload(c *fiber.Ctx) error {
+	p, err := backupPath(c.Params("name"))
+	if err != nil {
+		return storeError(err, "backup not found")
+	}
+	recordAudit(c, "backup.download", c.Params("name"), "")
+	return c.Download(p, filepath.Base(p))
+}
+
+func handleBackupVerify(c *fiber.Ctx) error {
+	p, err := backupPath(c.Params("name"))
+	if err != nil {
+		return storeError(err, "backup not found")
+	}
+	m, problems, err := verifyBackup(p)
+	if err != nil {
+		return c.JSON(fiber.Map{"ok": false, "name": c.Params("name"), "problems": []backupProblem{{"", err.Error()}}})
+	}
+	return c.JSON(fiber.Map{"ok": len(problems) == 0, "name": m.Name, "files": len(m.Files), "problems": problems})
+}
+
+func handleBackupRestore(c *fiber.Ctx) error {
+	p, err := backupPath(c.Params("name"))
+	if err != nil {
+		return storeError(err, "backup not found")
+	}
+	m, pre, err := restoreBackup(c.Context(), p)
+	if errors.Is(err, errBackupCorrupt) {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	recordAudit(c, "backup.restore", m.Name, "pre-restore snapshot "+pre)
+	return c.JSON(fiber.Map{"ok": true, "restored": m.Name, "pre_restore": pre})
+}
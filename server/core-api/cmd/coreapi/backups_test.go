@@ -0,0 +1,224 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// backupEntry returns the contents of one file inside snapshot name.
+func backupEntry(t *testing.T, name, entry string) string {
+	t.Helper()
+	var out []byte
+	_, err := readBackup(filepath.Join(backupsDir(), name+".tar.gz"), func(_ backupManifest, hdr *tar.Header, r io.Reader) error {
+		if hdr.Name == entry {
+			out, _ = io.ReadAll(r)
+		}
+		return nil
+	})
+	if err != nil || out == nil {
+		t.Fatalf("%s in %s: %v", entry, name, err)
+	}
+	return string(out)
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "u1", Email: "a@example.org"})
+	_ = writeJSON(keysFile(), keyFile{Active: "k1"})
+	m, err := createBackup(context.Background(), "manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Files) != 2 || m.Files[0].SHA256 == "" {
+		t.Fatalf("manifest: %+v", m)
+	}
+	if _, problems, err := verifyBackup(filepath.Join(backupsDir(), m.Name+".tar.gz")); err != nil || len(problems) != 0 {
+		t.Fatalf("verify: %+v %v", problems, err)
+	}
+
+	_ = store.Users.Delete("u1")
+	_ = store.Users.Create(User{ID: "u2"})
+	_ = writeJSON(filepath.Join(dataDir, "rules.json"), []string{"later"})
+	_ = writeJSON(keysFile(), keyFile{Active: "k2"})
+
+	restored, pre, err := restoreBackup(context.Background(), filepath.Join(backupsDir(), m.Name+".tar.gz"))
+	if err != nil || restored.Name != m.Name {
+		t.Fatalf("restore: %v", err)
+	}
+	if users, _ := store.Users.List(); len(users) != 1 || users[0].ID != "u1" {
+		t.Fatalf("users after restore: %+v", users)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "rules.json")); !os.IsNotExist(err) {
+		t.Fatal("file created after the snapshot survived the restore")
+	}
+	var kf keyFile
+	if _ = readJSON(keysFile(), &kf); kf.Active != "k2" {
+		t.Fatal("restore replaced keys.json")
+	}
+	if got := backupEntry(t, pre, "data/users.json"); !bytes.Contains([]byte(got), []byte(`"u2"`)) {
+		t.Fatalf("pre-restore snapshot: %s", got)
+	}
+	if m, _ := loadDataManifest(); m.Version != dataMigrations[len(dataMigrations)-1].Version {
+		t.Fatalf("restored data not migrated: %+v", m)
+	}
+}
+
+func TestBackupVerifyDetectsTampering(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "u1"})
+	m, err := createBackup(context.Background(), "manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rebuild the archive with the same manifest but different users.json.
+	archive := filepath.Join(backupsDir(), m.Name+".tar.gz")
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	entries := map[string][]byte{}
+	_, _ = readBackup(archive, func(_ backupManifest, hdr *tar.Header, r io.Reader) error {
+		entries[hdr.Name], _ = io.ReadAll(r)
+		return nil
+	})
+	f, _ := os.Open(archive)
+	zr, _ := gzip.NewReader(f)
+	tr := tar.NewReader(zr)
+	hdr, _ := tr.Next()
+	manifest, _ := io.ReadAll(tr)
+	f.Close()
+	_ = tw.WriteHeader(&tar.Header{Name: hdr.Name, Mode: 0o600, Size: int64(len(manifest))})
+	_, _ = tw.Write(manifest)
+	tampered := bytes.Replace(entries["data/users.json"], []byte("u1"), []byte("u9"), 1)
+	_ = tw.WriteHeader(&tar.Header{Name: "data/users.json", Mode: 0o600, Size: int64(len(tampered))})
+	_, _ = tw.Write(tampered)
+	_ = tw.Close()
+	_ = gz.Close()
+	_ = os.WriteFile(archive, buf.Bytes(), 0o600)
+
+	_, problems, err := verifyBackup(archive)
+	if err != nil || len(problems) != 1 || problems[0].Problem != "checksum mismatch" {
+		t.Fatalf("problems: %+v %v", problems, err)
+	}
+	app := fiber.New()
+	app.Post("/backups/:name/restore", handleBackupRestore)
+	resp, _ := app.Test(httptest.NewRequest("POST", "/backups/"+m.Name+"/restore", nil))
+	if resp.StatusCode != fiber.StatusUnprocessableEntity {
+		t.Fatalf("restore of tampered snapshot: %d", resp.StatusCode)
+	}
+	if users, _ := store.Users.List(); len(users) != 1 || users[0].ID != "u1" {
+		t.Fatalf("tampered snapshot was applied: %+v", users)
+	}
+}
+
+func TestBackupRetention(t *testing.T) {
+	dataDir = t.TempDir()
+	prevKeep, prevAge := backupKeep, backupMaxAge
+	defer func() { backupKeep, backupMaxAge = prevKeep, prevAge }()
+	backupKeep, backupMaxAge = 2, 0
+	for i := 0; i < 4; i++ {
+		if err := backupDataFiles(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, _ := listBackups()
+	if len(list) != 2 {
+		t.Fatalf("kept %d snapshots", len(list))
+	}
+	backupKeep, backupMaxAge = 0, time.Hour
+	if err := pruneBackups(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := listBackups(); len(list) != 1 {
+		t.Fatalf("newest snapshot not kept alone: %d", len(list))
+	}
+}
+
+func TestBackupAndRestoreSQLite(t *testing.T) {
+	dataDir = t.TempDir()
+	s, err := newSQLiteStore(filepath.Join(dataDir, "coreapi.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := store
+	store = s
+	defer func() { store = prev; s.Close() }()
+
+	_ = store.Users.Create(User{ID: "u1", Email: "a@example.org"})
+	m, err := createBackup(context.Background(), "manual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Users.Delete("u1")
+	_ = store.Audit.Append(AuditEntry{At: time.Now(), Action: "after"})
+	if _, _, err := restoreBackup(context.Background(), filepath.Join(backupsDir(), m.Name+".tar.gz")); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := store.Users.FindByEmail("a@example.org"); err != nil || u.ID != "u1" {
+		t.Fatalf("after restore: %+v %v", u, err)
+	}
+	if entries, _ := store.Audit.List(0); len(entries) != 1 {
+		t.Fatalf("audit log rolled back: %+v", entries)
+	}
+}
+
+func TestWritesPausedDuringSnapshot(t *testing.T) {
+	dataDir = t.TempDir()
+	writes.pause()
+	done := make(chan error, 1)
+	go func() { done <- store.Users.Create(User{ID: "u1"}) }()
+	select {
+	case <-done:
+		t.Fatal("write went through while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	writes.resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupHandlers(t *testing.T) {
+	dataDir = t.TempDir()
+	app := fiber.New()
+	app.Get("/backups", handleBackupsList)
+	app.Post("/backups", handleBackupCreate)
+	app.Get("/backups/:name", handleBackupDownload)
+	app.Post("/backups/:name/verify", handleBackupVerify)
+
+	resp, _ := app.Test(httptest.NewRequest("POST", "/backups", nil))
+	if resp.StatusCode != 200 {
+		t.Fatalf("create: %d", resp.StatusCode)
+	}
+	list, _ := listBackups()
+	if len(list) != 1 || list[0].Reason != "manual" {
+		t.Fatalf("list: %+v", list)
+	}
+	resp, _ = app.Test(httptest.NewRequest("GET", "/backups/"+list[0].Name, nil))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || len(body) == 0 || int64(len(body)) != list[0].Size {
+		t.Fatalf("download: %d, %d bytes", resp.StatusCode, len(body))
+	}
+	resp, _ = app.Test(httptest.NewRequest("POST", "/backups/"+list[0].Name+"/verify", nil))
+	if resp.StatusCode != 200 {
+		t.Fatalf("verify: %d", resp.StatusCode)
+	}
+	for _, name := range []string{"nope", "..%2Fusers", ".tmp-x"} {
+		if resp, _ := app.Test(httptest.NewRequest("GET", "/backups/"+name, nil)); resp.StatusCode != fiber.StatusNotFound {
+			t.Fatalf("%s: %d", name, resp.StatusCode)
+		}
+	}
+	if _, err := backupPath("../" + list[0].Name); !errors.Is(err, errNotFound) {
+		t.Fatalf("path traversal: %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// While no active admin exists the API is in setup mode. At startup an
+// admin is seeded from ADMIN_EMAIL and ADMIN_PASSWORD (or
+// ADMIN_PASSWORD_FILE) when they are set; otherwise a one-time setup token
+// is printed to the log, and POST /api/setup trades it for the first admin
+// account. Only the token's hash is kept, in setup_token.json, which is
+// removed when the token is used or an admin exists.
+
+type setupToken struct {
+	Hash      string    `json:"hash"` // hex SHA-256 of the token
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func setupTokenFile() string {
+	return filepath.Join(dataDir, "setup_token.json")
+}
+
+func hashSetupToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func hasActiveAdmin(users []User) bool {
+	return countActiveAdmins(users) > 0
+}
+
+// refuseIfAdmin is the createUser check for setup: of two concurrent
+// setups, only the first creates an admin.
+func refuseIfAdmin(users []User) error {
+	if hasActiveAdmin(users) {
+		return fiber.NewError(fiber.StatusGone, "setup already completed")
+	}
+	return nil
+}
+
+// adminPasswordFromEnv reads ADMIN_PASSWORD_FILE, which keeps the password
+// out of the environment, or else ADMIN_PASSWORD.
+func adminPasswordFromEnv() (string, error) {
+	if f := os.Getenv("ADMIN_PASSWORD_FILE"); f != "" {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(raw)), nil
+	}
+	return os.Getenv("ADMIN_PASSWORD"), nil
+}
+
+// bootstrapAdmin runs at startup. It does nothing once an active admin
+// exists, except drop a setup token left from before.
+func bootstrapAdmin() error {
+	users, err := store.Users.List()
+	if err != nil {
+		return err
+	}
+	if hasActiveAdmin(users) {
+		return removeDataFile(setupTokenFile())
+	}
+	if email := strings.TrimSpace(os.Getenv("ADMIN_EMAIL")); email != "" {
+		password, err := adminPasswordFromEnv()
+		if err != nil {
+			return fmt.Errorf("ADMIN_PASSWORD_FILE: %w", err)
+		}
+		if password == "" {
+			return errors.New("ADMIN_EMAIL is set but ADMIN_PASSWORD and ADMIN_PASSWORD_FILE are not")
+		}
+		user, _, err := createUser(newUser{Email: email, Username: envOr("ADMIN_USERNAME", "admin"), Password: password, Role: "admin"}, refuseIfAdmin)
+		if err != nil {
+			return fmt.Errorf("seeding admin %s: %w", email, err)
+		}
+		recordAudit(nil, "user.bootstrap", user.ID, "ADMIN_EMAIL")
+		log.Printf("No admin account existed; created admin %s from ADMIN_EMAIL", email)
+		return removeDataFile(setupTokenFile())
+	}
+
+	// The token is not recoverable from its hash, so every start in setup
+	// mode issues a new one and the previous one stops working.
+	token, err := randomToken(24)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(setupTokenFile(), setupToken{Hash: hashSetupToken(token), CreatedAt: time.Now().UTC()}); err != nil {
+		return err
+	}
+	log.Printf("No admin account exists. Create one with POST /api/setup using the one-time setup token: %s", token)
+	return nil
+}
+
+// handleSetupStatus tells the web app whether to offer the setup form.
+func handleSetupStatus(c *fiber.Ctx) error {
+	users, err := store.Users.List()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+	}
+	return c.JSON(fiber.Map{"required": !hasActiveAdmin(users)})
+}
+
+// handleSetup creates the first admin in exchange for the setup token. The
+// token file is locked throughout, so the token is used at most once.
+func handleSetup(c *fiber.Ctx) error {
+	var req struct {
+		Token    string `json:"token"`
+		Email    string `json:"email"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	if req.Password == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "password required")
+	}
+	unlock, err := lockFile(setupTokenFile())
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	defer unlock()
+	var st setupToken
+	if err := readJSON(setupTokenFile(), &st); err != nil {
+		if os.IsNotExist(err) {
+			return fiber.NewError(fiber.StatusGone, "setup already completed")
+		}
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSetupToken(req.Token)), []byte(st.Hash)) != 1 {
+		return fiber.NewError(fiber.StatusForbidden, "invalid setup token")
+	}
+	user, _, err := createUser(newUser{Email: req.Email, Username: req.Username, Password: req.Password, Role: "admin"}, refuseIfAdmin)
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	if err := removeDataFile(setupTokenFile()); err != nil {
+		log.Printf("setup: removing %s: %v", setupTokenFile(), err)
+	}
+	recordAudit(c, "user.bootstrap", user.ID, "setup token")
+	log.Printf("Setup completed; created admin %s", user.Email)
+	hidePassword(&user)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"ok": true, "user": user})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// cacheJSONStore puts an in-memory, indexed copy of users.json and
+// pending.json in front of the JSON backend, so logins and lookups no
+// longer decode and scan the whole file. Writes still go through the file
+// (and its lock) and then update the cache; changes made by other
+// processes or by hand are picked up through fsnotify. Without a watcher
+// every read compares the file's checksum instead.
+func cacheJSONStore(s *Store) {
+	users := &cachedCollection[User]{inner: s.Users, file: "users.json", key: userID, lookups: map[string]func(*User) string{
+		"email":    func(u *User) string { return u.Email },
+		"username": func(u *User) string { return u.Username },
+	}}
+	registrations := &cachedCollection[Registration]{inner: s.Registrations, file: "pending.json", key: registrationID}
+	s.Users = cachedUsers{users}
+	s.Registrations = registrations
+
+	w, err := watchDataFiles(users, registrations)
+	if err != nil {
+		log.Printf("Cache: not watching %s (%v); checking checksums on every read", dataDir, err)
+		return
+	}
+	closeBackend := s.close
+	s.close = func() error {
+		err := w.Close()
+		if closeBackend != nil {
+			err = errors.Join(err, closeBackend())
+		}
+		return err
+	}
+}
+
+// cachedCollection holds each record as its JSON encoding, so every read
+// decodes a fresh copy (like memoryCollection) and never aliases the
+// cache, plus indexes from key and from each lookup (lowercased) to the
+// record's position.
+type cachedCollection[T any] struct {
+	inner   Repository[T]
+	file    string // base name in DATA_DIR
+	key     func(*T) string
+	lookups map[string]func(*T) string
+
+	writeMu sync.Mutex // orders cache updates the same way as the writes
+	mu      sync.Mutex
+	state   *cacheState // replaced, never modified, so readers need no lock
+	watched bool        // fsnotify reports changes to the file
+	dirty   bool
+}
+
+type cacheState struct {
+	stamp   string // checksum of the file the records match; "" when unknown
+	records []json.RawMessage
+	byKey   map[string]int
+	lookup  map[string]map[string]int
+}
+
+func (c *cachedCollection[T]) path() string {
+	return filepath.Join(dataDir, c.file)
+}
+
+func (c *cachedCollection[T]) watch() {
+	c.mu.Lock()
+	c.watched = true
+	c.mu.Unlock()
+}
+
+// invalidate is called by the watcher when the file or its checksum
+// changes.
+func (c *cachedCollection[T]) invalidate() {
+	c.mu.Lock()
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+// current returns the cached records, reloading them if the file changed
+// underneath. A write by this process updates the stamp, so the event it
+// causes does not trigger a reload.
+func (c *cachedCollection[T]) current() (*cacheState, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state != nil && c.watched && !c.dirty {
+		return c.state, nil
+	}
+	if c.state != nil && c.state.stamp != "" {
+		if sum, err := readChecksum(c.path() + checksumSuffix); err == nil && sum == c.state.stamp {
+			c.dirty = false
+			return c.state, nil
+		}
+	}
+	// The checksum is read first: if a write lands in between, the stamp is
+	// stale and the next read reloads, rather than the other way round.
+	stamp, err := readChecksum(c.path() + checksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	if err := readJSON(c.path(), &raw); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	state, err := c.build(stamp, raw)
+	if err != nil {
+		return nil, err
+	}
+	c.state, c.dirty = state, false
+	return state, nil
+}
+
+func (c *cachedCollection[T]) build(stamp string, raw []json.RawMessage) (*cacheState, error) {
+	state := &cacheState{stamp: stamp, records: raw, byKey: make(map[string]int, len(raw)), lookup: map[string]map[string]int{}}
+	for name := range c.lookups {
+		state.lookup[name] = make(map[string]int, len(raw))
+	}
+	for i, rec := range raw {
+		var item T
+		if err := json.Unmarshal(rec, &item); err != nil {
+			return nil, err
+		}
+		// The first match wins, as with a linear scan.
+		if _, ok := state.byKey[c.key(&item)]; !ok {
+			state.byKey[c.key(&item)] = i
+		}
+		for name, value := range c.lookups {
+			v := strings.ToLower(value(&item))
+			if _, ok := state.lookup[name][v]; v != "" && !ok {
+				state.lookup[name][v] = i
+			}
+		}
+	}
+	return state, nil
+}
+
+func (c *cachedCollection[T]) decode(state *cacheState, i int) (T, error) {
+	var item T
+	err := json.Unmarshal(state.records[i], &item)
+	return item, err
+}
+
+func (c *cachedCollection[T]) List() ([]T, error) {
+	state, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]T, len(state.records))
+	for i := range state.records {
+		if list[i], err = c.decode(state, i); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (c *cachedCollection[T]) Get(id string) (T, error) {
+	var zero T
+	state, err := c.current()
+	if err != nil {
+		return zero, err
+	}
+	i, ok := state.byKey[id]
+	if !ok {
+		return zero, errNotFound
+	}
+	return c.decode(state, i)
+}
+
+// find looks value up, case-insensitively, in the named index.
+func (c *cachedCollection[T]) find(name, value string) (T, error) {
+	var zero T
+	state, err := c.current()
+	if err != nil {
+		return zero, err
+	}
+	i, ok := state.lookup[name][strings.ToLower(value)]
+	if !ok || value == "" {
+		return zero, errNotFound
+	}
+	return c.decode(state, i)
+}
+
+func (c *cachedCollection[T]) Create(item T) error {
+	return c.Mutate(func(list []T) ([]T, error) {
+		id := c.key(&item)
+		for i := range list {
+			if c.key(&list[i]) == id {
+				return nil, errConflict
+			}
+		}
+		return append(list, item), nil
+	})
+}
+
+func (c *cachedCollection[T]) Update(id string, fn func(*T) error) (T, error) {
+	var updated T
+	err := c.Mutate(func(list []T) ([]T, error) {
+		for i := range list {
+			if c.key(&list[i]) == id {
+				if err := fn(&list[i]); err != nil {
+					return nil, err
+				}
+				updated = list[i]
+				return list, nil
+			}
+		}
+		return nil, errNotFound
+	})
+	return updated, err
+}
+
+func (c *cachedCollection[T]) Delete(id string) error {
+	return c.Mutate(func(list []T) ([]T, error) {
+		for i := range list {
+			if c.key(&list[i]) == id {
+				return append(list[:i], list[i+1:]...), nil
+			}
+		}
+		return nil, errNotFound
+	})
+}
+
+// Mutate runs fn against the file, under its lock, and then swaps the
+// cache for the list that was written.
+func (c *cachedCollection[T]) Mutate(fn func([]T) ([]T, error)) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var written []T
+	wrote := false
+	err := c.inner.Mutate(func(list []T) ([]T, error) {
+		list, err := fn(list)
+		if err == nil {
+			if list == nil {
+				list = []T{}
+			}
+			written, wrote = list, true
+		}
+		return list, err
+	})
+	if err != nil || !wrote {
+		return err
+	}
+	// The same encoding writeJSON uses, so the stamp matches the checksum
+	// file and the watcher's event for this write is recognised.
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(written); err != nil {
+		c.invalidateState()
+		return nil
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	raw := make([]json.RawMessage, len(written))
+	for i := range written {
+		rec, err := json.Marshal(&written[i])
+		if err != nil {
+			c.invalidateState()
+			return nil
+		}
+		raw[i] = rec
+	}
+	state, err := c.build(hex.EncodeToString(sum[:]), raw)
+	c.mu.Lock()
+	if err == nil {
+		c.state = state
+	} else {
+		c.state = nil
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// invalidateState drops the cache so the next read loads the file.
+func (c *cachedCollection[T]) invalidateState() {
+	c.mu.Lock()
+	c.state = nil
+	c.mu.Unlock()
+}
+
+// cachedUsers answers the user lookups from the cache's indexes.
+type cachedUsers struct {
+	*cachedCollection[User]
+}
+
+func (r cachedUsers) FindByEmail(email string) (User, error) {
+	return r.find("email", email)
+}
+
+func (r cachedUsers) FindByUsername(username string) (User, error) {
+	return r.find("username", username)
+}
+
+// dataFileCache is what watchDataFiles needs from a cached collection.
+type dataFileCache interface {
+	path() string
+	watch()
+	invalidate()
+}
+
+// watchDataFiles invalidates each cache when its file or checksum file
+// in DATA_DIR is written, renamed or removed. The directory is watched
+// rather than the files, because writes replace them by rename.
+func watchDataFiles(caches ...dataFileCache) (*fsnotify.Watcher, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(dataDir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	byFile := map[string]dataFileCache{}
+	for _, c := range caches {
+		byFile[filepath.Base(c.path())] = c
+		c.watch()
+	}
+	go func() {
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if c, ok := byFile[strings.TrimSuffix(filepath.Base(ev.Name), checksumSuffix)]; ok {
+					c.invalidate()
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// Events may have been dropped; reload everything.
+				log.Printf("Cache: watcher: %v", err)
+				for _, c := range caches {
+					c.invalidate()
+				}
+			}
+		}
+	}()
+	return w, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// cachedStore opens the JSON store with the cache in front, as openStore
+// does, and makes it the global store for the test.
+func cachedStore(tb testing.TB) *Store {
+	tb.Helper()
+	s := newJSONStore()
+	cacheJSONStore(s)
+	prev := store
+	store = s
+	tb.Cleanup(func() { store = prev; s.Close() })
+	return s
+}
+
+func TestCacheIndexes(t *testing.T) {
+	dataDir = t.TempDir()
+	s := cachedStore(t)
+	_ = s.Users.Create(User{ID: "u1", Email: "Ada@Example.org", Username: "Ada"})
+	_ = s.Users.Create(User{ID: "u2", Email: "bob@example.org", Username: "bob"})
+
+	if u, err := s.Users.FindByUsername("ADA"); err != nil || u.ID != "u1" {
+		t.Fatalf("by username: %+v %v", u, err)
+	}
+	if _, err := s.Users.Update("u1", func(u *User) error { u.Email = "ada@new.example"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Users.FindByEmail("ada@example.org"); err == nil {
+		t.Fatal("old email still indexed")
+	}
+	if u, err := s.Users.FindByEmail("ADA@new.example"); err != nil || u.ID != "u1" {
+		t.Fatalf("new email: %+v %v", u, err)
+	}
+	_ = s.Users.Delete("u2")
+	if _, err := s.Users.Get("u2"); err == nil {
+		t.Fatal("deleted user still cached")
+	}
+}
+
+func TestCacheSeesExternalWrites(t *testing.T) {
+	dataDir = t.TempDir()
+	s := cachedStore(t)
+	_ = s.Users.Create(User{ID: "u1", Email: "a@example.org"})
+	own := s.Users.(cachedUsers).state
+
+	// The event caused by our own write must not force a reload.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := s.Users.Get("u1"); err != nil || s.Users.(cachedUsers).state != own {
+		t.Fatalf("own write reloaded the cache: %v", err)
+	}
+
+	// Another process (or an editor) changes the file.
+	other := newJSONStore()
+	_ = other.Users.Create(User{ID: "u2", Email: "b@example.org"})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if u, err := s.Users.FindByEmail("b@example.org"); err == nil && u.ID == "u2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("external write not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheWithoutWatcherChecksChecksum(t *testing.T) {
+	dataDir = t.TempDir()
+	users := &cachedCollection[User]{inner: newJSONStore().Users, file: "users.json", key: userID}
+	_ = users.Create(User{ID: "u1"})
+	_ = newJSONStore().Users.Create(User{ID: "u2"})
+	if list, err := users.List(); err != nil || len(list) != 2 {
+		t.Fatalf("list after external write: %+v %v", list, err)
+	}
+}
+
+// BenchmarkLogin measures handleLogin with 10k users, for the user at the
+// end of users.json, reading the file on every request and from the cache.
+func BenchmarkLogin(b *testing.B) {
+	for _, name := range []string{"file", "cached"} {
+		b.Run(name, func(b *testing.B) {
+			dataDir = b.TempDir()
+			users := make([]User, 10000)
+			for i := range users {
+				users[i] = User{ID: fmt.Sprintf("u%d", i), Email: fmt.Sprintf("user%d@example.org", i), Username: fmt.Sprintf("user%d", i), Status: "active"}
+			}
+			if err := writeJSON(filepath.Join(dataDir, "users.json"), users); err != nil {
+				b.Fatal(err)
+			}
+			if name == "cached" {
+				cachedStore(b)
+			} else {
+				prev := store
+				store = newJSONStore()
+				b.Cleanup(func() { store = prev })
+			}
+			app := fiber.New()
+			app.Post("/login", handleLogin)
+			body := `{"email":"user9999@example.org","password":"x"}`
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				resp, err := app.Test(req)
+				if err != nil || resp.StatusCode != fiber.StatusUnauthorized {
+					b.Fatalf("login: %d %v", resp.StatusCode, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the subset of config.yml that core-api reads. Environment
+// variables take precedence over anything set here.
+type fileConfig struct {
+	Data struct {
+		BackupInterval string `yaml:"backup_interval"`
+		Backend        string `yaml:"backend"`     // json or sqlite
+		SQLitePath     string `yaml:"sqlite_path"` // defaults to DATA_DIR/coreapi.db
+	} `yaml:"data"`
+}
+
+var appConfig = loadFileConfig(envOr("CONFIG_FILE", "config.yml"))
+
+func loadFileConfig(path string) fileConfig {
+	var cfg fileConfig
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("config %s: %v", path, err)
+		}
+		return cfg
+	}
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		log.Printf("config %s: %v", path, err)
+	}
+	return cfg
+}
+
+// configDuration parses a duration from config.yml, falling back to def
+// when the value is empty or malformed.
+func configDuration(value string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// defaultTrustedProxies are the addresses Traefik reaches core-api from on
+// the Docker network.
+const defaultTrustedProxies = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+
+// withClientIP makes c.IP() the client's address rather than the reverse
+// proxy's: the first valid address in PROXY_HEADER (X-Forwarded-For by
+// default), but only on connections from TRUSTED_PROXIES. Traefik drops
+// forwarded headers sent by clients unless told to trust them, so a
+// client cannot choose its own address.
+func withClientIP(cfg fiber.Config) fiber.Config {
+	cfg.ProxyHeader = envOr("PROXY_HEADER", fiber.HeaderXForwardedFor)
+	cfg.EnableTrustedProxyCheck = true
+	cfg.EnableIPValidation = true
+	for _, p := range strings.Split(envOr("TRUSTED_PROXIES", defaultTrustedProxies), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.TrustedProxies = append(cfg.TrustedProxies, p)
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dataManifest records which schema version the JSON files in DATA_DIR
+// follow. A missing manifest means version 0.
+type dataManifest struct {
+	Version int                `json:"version"`
+	Applied []appliedMigration `json:"applied,omitempty"`
+}
+
+type appliedMigration struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	At      time.Time `json:"at"`
+	Backup  string    `json:"backup,omitempty"` // name of the snapshot taken just before
+}
+
+// dataMigration upgrades the files from Version-1 to Version. Migrations
+// work on the raw JSON (see rewriteRecords) rather than the current Go
+// types, which may already have moved on. Never edit a released
+// migration; append a new one.
+type dataMigration struct {
+	Version int
+	Name    string
+	Run     func() error
+}
+
+var dataMigrations = []dataMigration{
+	{1, "collection files hold JSON arrays", migrateCollectionArrays},
+}
+
+func dataManifestFile() string {
+	return filepath.Join(dataDir, "schema.json")
+}
+
+func loadDataManifest() (dataManifest, error) {
+	var m dataManifest
+	if err := readJSON(dataManifestFile(), &m); err != nil && !os.IsNotExist(err) {
+		return m, err
+	}
+	return m, nil
+}
+
+// pendingDataMigrations returns the migrations newer than m, in order. Files
+// written by a newer build are refused rather than guessed at.
+func pendingDataMigrations(m dataManifest, all []dataMigration) ([]dataMigration, error) {
+	latest := 0
+	if len(all) > 0 {
+		latest = all[len(all)-1].Version
+	}
+	if m.Version > latest {
+		return nil, fmt.Errorf("data files are at schema version %d, newer than this build supports (%d)", m.Version, latest)
+	}
+	var pending []dataMigration
+	for _, mig := range all {
+		if mig.Version > m.Version {
+			pending = append(pending, mig)
+		}
+	}
+	return pending, nil
+}
+
+// migrateDataFiles applies every pending migration in order. Each one is
+// preceded by a snapshot backups/<timestamp>-pre-v<N>.tar.gz and followed by a
+// manifest update, so a failure leaves the files at the last good version
+// with a backup next to them. The manifest lock is held throughout, so
+// only one process migrates at a time.
+func migrateDataFiles(ctx context.Context, all []dataMigration) ([]appliedMigration, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(dataManifestFile())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	m, err := loadDataManifest()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingDataMigrations(m, all)
+	if err != nil {
+		return nil, err
+	}
+	var done []appliedMigration
+	for _, mig := range pending {
+		backup, err := writeBackup(ctx, fmt.Sprintf("pre-migration v%d", mig.Version), fmt.Sprintf("-pre-v%d", mig.Version))
+		if err != nil {
+			return done, fmt.Errorf("backup before migration %d: %w", mig.Version, err)
+		}
+		if err := mig.Run(); err != nil {
+			return done, fmt.Errorf("migration %d (%s): %w; backup %s", mig.Version, mig.Name, err, backup.Name)
+		}
+		applied := appliedMigration{Version: mig.Version, Name: mig.Name, At: time.Now().UTC(), Backup: backup.Name}
+		m.Version = mig.Version
+		m.Applied = append(m.Applied, applied)
+		if err := writeJSON(dataManifestFile(), m); err != nil {
+			return done, err
+		}
+		log.Printf("Applied data migration %d: %s", mig.Version, mig.Name)
+		done = append(done, applied)
+	}
+	return done, nil
+}
+
+// checkMigrations prints the schema state of DATA_DIR and, with the SQLite
+// backend, of the database, without changing anything. It returns the
+// process exit code: 0 when up to date, 1 when migrations are pending and
+// 2 on error.
+func checkMigrations(w io.Writer) int {
+	m, err := loadDataManifest()
+	if err == nil {
+		var pending []dataMigration
+		if pending, err = pendingDataMigrations(m, dataMigrations); err == nil {
+			code := 0
+			fmt.Fprintf(w, "data files: version %d, latest %d\n", m.Version, dataMigrations[len(dataMigrations)-1].Version)
+			for _, mig := range pending {
+				fmt.Fprintf(w, "  pending %d: %s\n", mig.Version, mig.Name)
+				code = 1
+			}
+			if storageBackend() == "sqlite" {
+				var n int
+				if n, err = reportSQLiteMigrations(w, sqlitePath()); err == nil && n > 0 {
+					code = 1
+				}
+			}
+			if err == nil {
+				return code
+			}
+		}
+	}
+	fmt.Fprintf(w, "error: %v\n", err)
+	return 2
+}
+
+// reportSQLiteMigrations lists the migrations openSQLite would apply to the
+// database at path and returns how many there are.
+func reportSQLiteMigrations(w io.Writer, path string) (int, error) {
+	current := 0
+	if _, err := os.Stat(path); err == nil {
+		db, err := sql.Open("sqlite", "file:"+path+"?mode=ro")
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+		var tables int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&tables); err != nil {
+			return 0, err
+		}
+		if tables > 0 {
+			if current, err = sqliteSchemaVersion(db); err != nil {
+				return 0, err
+			}
+		}
+	}
+	latest := sqliteMigrations[len(sqliteMigrations)-1].version
+	fmt.Fprintf(w, "sqlite %s: version %d, latest %d\n", path, current, latest)
+	if current > latest {
+		return 0, fmt.Errorf("sqlite schema version %d is newer than this build supports (%d)", current, latest)
+	}
+	n := 0
+	for _, mig := range sqliteMigrations {
+		if mig.version > current {
+			fmt.Fprintf(w, "  pending %d: %s\n", mig.version, mig.name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// rewriteRecords applies fn to every object in the JSON array file and
+// writes the file back if fn changed anything. A missing file is skipped.
+func rewriteRecords(file string, fn func(rec map[string]any) (bool, error)) error {
+	path := filepath.Join(dataDir, file)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	var list []map[string]any
+	return updateJSON(path, &list, func() error {
+		changed := false
+		for _, rec := range list {
+			c, err := fn(rec)
+			if err != nil {
+				return err
+			}
+			changed = changed || c
+		}
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+// migrateCollectionArrays replaces collection files holding null, which
+// early builds could write for an empty list, with [].
+func migrateCollectionArrays() error {
+	for _, file := range []string{"users.json", "pending.json", "invites.json", "teamspeak_users.json", "sessions.json", "rejected.json"} {
+		path := filepath.Join(dataDir, file)
+		raw, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if trimmed := bytes.TrimSpace(raw); len(trimmed) == 0 || string(trimmed) == "null" {
+			if err := writeJSON(path, []any{}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateDataFiles(t *testing.T) {
+	dataDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dataDir, "users.json"), []byte("null"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_ = writeJSON(filepath.Join(dataDir, "pending.json"), []map[string]any{{"id": "r1", "mail": "a@example.org"}})
+
+	var out strings.Builder
+	if code := checkMigrations(&out); code != 1 || !strings.Contains(out.String(), "pending 1") {
+		t.Fatalf("check before migrating: %d %q", code, out.String())
+	}
+
+	all := append(dataMigrations, dataMigration{2, "rename mail to email", func() error {
+		return rewriteRecords("pending.json", func(rec map[string]any) (bool, error) {
+			mail, ok := rec["mail"]
+			if !ok {
+				return false, nil
+			}
+			rec["email"] = mail
+			delete(rec, "mail")
+			return true, nil
+		})
+	}})
+	done, err := migrateDataFiles(context.Background(), all)
+	if err != nil || len(done) != 2 {
+		t.Fatalf("applied %+v: %v", done, err)
+	}
+	if users, err := store.Users.List(); err != nil || len(users) != 0 {
+		t.Fatalf("users.json not an array: %v", err)
+	}
+	if regs, _ := store.Registrations.List(); len(regs) != 1 || regs[0].Email != "a@example.org" {
+		t.Fatalf("records not rewritten: %+v", regs)
+	}
+	// The snapshot before v1 still has the original file.
+	if raw := backupEntry(t, done[0].Backup, "data/users.json"); raw != "null" {
+		t.Fatalf("backup %s: %q", done[0].Backup, raw)
+	}
+	if !strings.HasSuffix(done[1].Backup, "-pre-v2") {
+		t.Fatalf("backup name %q", done[1].Backup)
+	}
+
+	if again, err := migrateDataFiles(context.Background(), all); err != nil || len(again) != 0 {
+		t.Fatalf("second run applied %+v: %v", again, err)
+	}
+
+	boom := errors.New("boom")
+	failing := append(all, dataMigration{3, "broken", func() error { return boom }})
+	if _, err := migrateDataFiles(context.Background(), failing); !errors.Is(err, boom) {
+		t.Fatalf("failure not reported: %v", err)
+	}
+	if m, _ := loadDataManifest(); m.Version != 2 || len(m.Applied) != 2 {
+		t.Fatalf("manifest after failure: %+v", m)
+	}
+
+	// This build only knows v1, but the files are at v2.
+	if _, err := migrateDataFiles(context.Background(), dataMigrations); err == nil {
+		t.Fatal("older build accepted newer data files")
+	}
+	out.Reset()
+	if code := checkMigrations(&out); code != 2 {
+		t.Fatalf("check on newer files: %d %q", code, out.String())
+	}
+}
+
+func TestCheckMigrationsReportsSQLite(t *testing.T) {
+	dataDir = t.TempDir()
+	t.Setenv("STORAGE_BACKEND", "sqlite")
+	if _, err := migrateDataFiles(context.Background(), dataMigrations); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if code := checkMigrations(&out); code != 1 || !strings.Contains(out.String(), "sqlite") {
+		t.Fatalf("check without database: %d %q", code, out.String())
+	}
+	if _, err := os.Stat(sqlitePath()); !os.IsNotExist(err) {
+		t.Fatal("check created the database")
+	}
+	s, err := openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	out.Reset()
+	if code := checkMigrations(&out); code != 0 {
+		t.Fatalf("check after open: %d %q", code, out.String())
+	}
+}
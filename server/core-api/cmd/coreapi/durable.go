@@ -0,0 +1,322 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Every data file written by writeJSON gets two companions:
+//
+//	users.json.sha256  sha256sum-style checksum of users.json
+//	users.json.prev    the previous good contents (with its own .sha256)
+//
+// readJSON checks the checksum, so a torn or zeroed file is reported as
+// errCorruptFile instead of being read as empty, and writeJSON refuses to
+// replace a corrupt file. recoverDataFiles repairs them at startup.
+
+// errCorruptFile marks a data file that fails its checksum or does not
+// parse. It is never overwritten by a normal write.
+var errCorruptFile = errors.New("corrupt data file")
+
+const (
+	checksumSuffix = ".sha256"
+	prevSuffix     = ".prev"
+)
+
+// corruptError says why path was rejected.
+func corruptError(path, why string) error {
+	return fmt.Errorf("%s: %w: %s", path, errCorruptFile, why)
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// commitFile atomically replaces p with what fill writes: the data goes to
+// p.tmp, is fsynced, renamed over p, and the directory is fsynced. After a
+// crash p holds either the old or the new contents, never a mix. It returns
+// the SHA-256 of the new contents.
+func commitFile(p string, perm os.FileMode, fill func(w io.Writer) error) (string, error) {
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	tmp := p + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	err = fill(io.MultiWriter(f, h))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), syncDir(dir)
+}
+
+// writeDataFile replaces the data file p with what fill writes and records
+// its checksum. The current contents, if they check out, are kept as
+// p.prev first. It does not pass the write gate or refuse corrupt files;
+// writeJSON does both, and restores call this directly.
+func writeDataFile(p string, fill func(w io.Writer) error) error {
+	if _, err := checkDataFile(p); err == nil {
+		if err := keepPrevious(p); err != nil {
+			return err
+		}
+	}
+	sum, err := commitFile(p, 0o644, fill)
+	if err != nil {
+		return err
+	}
+	// A crash between the two commits leaves a new file with the old
+	// checksum, which startup treats as corrupt and rolls back to .prev.
+	_, err = commitFile(p+checksumSuffix, 0o644, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "%s  %s\n", sum, filepath.Base(p))
+		return err
+	})
+	return err
+}
+
+// keepPrevious hard-links p and its checksum to p.prev, replacing the
+// previous generation.
+func keepPrevious(p string) error {
+	prev := p + prevSuffix
+	for _, pair := range [][2]string{{p, prev}, {p + checksumSuffix, prev + checksumSuffix}} {
+		if err := os.Remove(pair[1]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(pair[0], pair[1]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPreviousCopies makes the previous copy of every data file match the
+// current one, so records just erased cannot come back from a .prev file.
+func dropPreviousCopies() error {
+	prevs, err := filepath.Glob(filepath.Join(dataDir, "*.json"+prevSuffix))
+	if err != nil {
+		return err
+	}
+	for _, prev := range prevs {
+		p := strings.TrimSuffix(prev, prevSuffix)
+		unlock, err := lockFile(p)
+		if err != nil {
+			return err
+		}
+		if _, err = checkDataFile(p); err == nil {
+			err = keepPrevious(p)
+		}
+		unlock()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeDataFile deletes p together with its checksum and previous copy.
+func removeDataFile(p string) error {
+	for _, f := range []string{p, p + checksumSuffix, p + prevSuffix, p + prevSuffix + checksumSuffix} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// A data file and its checksum are committed by two renames, so a reader
+// that does not hold the file's lock can see the new data with the old
+// checksum. A mismatch is only reported once it outlasts any write.
+const (
+	checksumRetries    = 10
+	checksumRetryDelay = 20 * time.Millisecond
+)
+
+// errChecksumMismatch is the errCorruptFile that a concurrent write can
+// cause, and that checkDataFile retries.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checkDataFile reads p and verifies it against its checksum file. Files
+// written before checksums existed have none; they only have to be valid,
+// non-empty JSON.
+func checkDataFile(p string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		raw, err := verifyDataFile(p)
+		if !errors.Is(err, errChecksumMismatch) || attempt == checksumRetries {
+			return raw, err
+		}
+		time.Sleep(checksumRetryDelay)
+	}
+}
+
+func verifyDataFile(p string) ([]byte, error) {
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	want, err := readChecksum(p + checksumSuffix)
+	switch {
+	case err == nil:
+		sum := sha256.Sum256(raw)
+		if got := hex.EncodeToString(sum[:]); got != want {
+			return nil, fmt.Errorf("%s: %w: %w (%d bytes)", p, errCorruptFile, errChecksumMismatch, len(raw))
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, corruptError(p, "empty file")
+	}
+	if !json.Valid(raw) {
+		return nil, corruptError(p, "not valid JSON")
+	}
+	return raw, nil
+}
+
+func readChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		// A torn checksum file cannot vouch for anything; fall back to
+		// parsing the data itself.
+		return "", os.ErrNotExist
+	}
+	return fields[0], nil
+}
+
+// recoveredFile describes one repair made by recoverDataFiles.
+type recoveredFile struct {
+	File    string // base name in DATA_DIR
+	Problem string
+	Source  string // "previous copy" or the backup name
+	Kept    string // where the corrupt file was moved
+}
+
+// recoverDataFiles runs before anything reads DATA_DIR. It removes .tmp
+// files left by an interrupted write, which were never committed, and
+// replaces every corrupt data file with its previous copy or, failing
+// that, the newest backup holding a good one. The corrupt file is kept
+// next to it as <file>.corrupt-<timestamp>. Files that cannot be recovered
+// are returned as an error; starting on top of them would lose data.
+func recoverDataFiles() ([]recoveredFile, error) {
+	leftovers, err := filepath.Glob(filepath.Join(dataDir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range leftovers {
+		log.Printf("Removing unfinished write %s", f)
+		if err := os.Remove(f); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var done []recoveredFile
+	var failed []string
+	for _, p := range files {
+		_, err := checkDataFile(p)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errCorruptFile) {
+			return done, err
+		}
+		raw, source := lastGoodCopy(p)
+		if raw == nil {
+			log.Printf("CORRUPT DATA FILE %v; no good copy found", err)
+			failed = append(failed, filepath.Base(p))
+			continue
+		}
+		kept := fmt.Sprintf("%s.corrupt-%s", p, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(p, kept); err != nil {
+			return done, err
+		}
+		if err := os.Remove(p + checksumSuffix); err != nil && !os.IsNotExist(err) {
+			return done, err
+		}
+		if err := writeDataFile(p, func(w io.Writer) error { _, err := w.Write(raw); return err }); err != nil {
+			return done, err
+		}
+		log.Printf("CORRUPT DATA FILE %v; restored from %s, corrupt copy kept as %s", err, source, filepath.Base(kept))
+		done = append(done, recoveredFile{File: filepath.Base(p), Problem: err.Error(), Source: source, Kept: filepath.Base(kept)})
+	}
+	if len(failed) > 0 {
+		return done, fmt.Errorf("%w with no good copy: %s; restore a backup or move the files away", errCorruptFile, strings.Join(failed, ", "))
+	}
+	return done, nil
+}
+
+// lastGoodCopy returns the newest good contents of the data file p other
+// than p itself, and where they came from.
+func lastGoodCopy(p string) ([]byte, string) {
+	if raw, err := checkDataFile(p + prevSuffix); err == nil {
+		return raw, "previous copy"
+	}
+	list, err := listBackups() // newest first
+	if err != nil {
+		return nil, ""
+	}
+	entry := "data/" + filepath.Base(p)
+	for _, b := range list {
+		var raw []byte
+		m, err := readBackup(filepath.Join(backupsDir(), b.Name+".tar.gz"), func(_ backupManifest, hdr *tar.Header, r io.Reader) error {
+			if hdr.Name != entry {
+				return nil
+			}
+			var rerr error
+			raw, rerr = io.ReadAll(r)
+			return rerr
+		})
+		if err != nil || raw == nil {
+			continue
+		}
+		sum := sha256.Sum256(raw)
+		for _, f := range m.Files {
+			if f.Path == entry && f.SHA256 == hex.EncodeToString(sum[:]) && len(bytes.TrimSpace(raw)) > 0 && json.Valid(raw) {
+				return raw, "backup " + b.Name
+			}
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteJSONKeepsChecksumAndPreviousCopy(t *testing.T) {
+	dataDir = t.TempDir()
+	p := filepath.Join(dataDir, "users.json")
+	_ = store.Users.Create(User{ID: "u1"})
+	_ = store.Users.Create(User{ID: "u2"})
+
+	sum, err := os.ReadFile(p + checksumSuffix)
+	if err != nil || !strings.HasSuffix(string(sum), "  users.json\n") {
+		t.Fatalf("checksum file: %q %v", sum, err)
+	}
+	prev, err := checkDataFile(p + prevSuffix)
+	if err != nil || !strings.Contains(string(prev), "u1") || strings.Contains(string(prev), "u2") {
+		t.Fatalf("previous copy: %s %v", prev, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dataDir, "*.tmp")); len(leftovers) != 0 {
+		t.Fatalf("temporary files left: %v", leftovers)
+	}
+}
+
+func TestCorruptFileIsNotOverwritten(t *testing.T) {
+	dataDir = t.TempDir()
+	p := filepath.Join(dataDir, "users.json")
+	_ = store.Users.Create(User{ID: "u1"})
+	// What a power cut between rename and data reaching the disk leaves.
+	if err := os.WriteFile(p, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Users.List(); !errors.Is(err, errCorruptFile) {
+		t.Fatalf("list of corrupt file: %v", err)
+	}
+	if err := store.Users.Create(User{ID: "u2"}); !errors.Is(err, errCorruptFile) {
+		t.Fatalf("create over corrupt file: %v", err)
+	}
+	if err := writeJSON(p, []User{}); !errors.Is(err, errCorruptFile) {
+		t.Fatalf("writeJSON over corrupt file: %v", err)
+	}
+	if raw, _ := os.ReadFile(p); len(raw) != 0 {
+		t.Fatalf("corrupt file was replaced: %q", raw)
+	}
+
+	// Files from before checksums only have to parse.
+	legacy := filepath.Join(dataDir, "rules.json")
+	_ = os.WriteFile(legacy, []byte(`[]`), 0o644)
+	if _, err := checkDataFile(legacy); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(legacy, []byte(`[{"id":`), 0o644)
+	if _, err := checkDataFile(legacy); !errors.Is(err, errCorruptFile) {
+		t.Fatalf("truncated legacy file: %v", err)
+	}
+}
+
+func TestRecoverDataFiles(t *testing.T) {
+	dataDir = t.TempDir()
+	users := filepath.Join(dataDir, "users.json")
+	invites := filepath.Join(dataDir, "invites.json")
+	_ = store.Users.Create(User{ID: "u1"})
+	_ = store.Users.Create(User{ID: "u2"})
+	_ = store.Invites.Create(Invite{Token: "t1"})
+	if _, err := createBackup(context.Background(), "manual"); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(users, []byte(`[{"id":"u1"},{"id":"u2"},{"id":"u3"`), 0o644)
+	_ = removeDataFile(invites)
+	_ = os.WriteFile(invites, nil, 0o644)
+	_ = os.WriteFile(filepath.Join(dataDir, "pending.json.tmp"), []byte("[{"), 0o644)
+
+	done, err := recoverDataFiles()
+	if err != nil || len(done) != 2 {
+		t.Fatalf("recovered %+v: %v", done, err)
+	}
+	if done[0].File != "invites.json" || !strings.HasPrefix(done[0].Source, "backup ") || done[1].Source != "previous copy" {
+		t.Fatalf("sources: %+v", done)
+	}
+	// The torn file stood in for the write that added u2, so .prev is
+	// the state before it.
+	if list, err := store.Users.List(); err != nil || len(list) != 1 || list[0].ID != "u1" {
+		t.Fatalf("users after recovery: %+v %v", list, err)
+	}
+	if _, err := store.Invites.Get("t1"); err != nil {
+		t.Fatalf("invite after recovery: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, done[1].Kept)); err != nil {
+		t.Fatalf("corrupt copy not kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "pending.json.tmp")); !os.IsNotExist(err) {
+		t.Fatal("leftover .tmp file not removed")
+	}
+
+	// Nothing to fall back to: refuse to start.
+	_ = os.WriteFile(filepath.Join(dataDir, "rules.json"), []byte("{"), 0o644)
+	if _, err := recoverDataFiles(); !errors.Is(err, errCorruptFile) || !strings.Contains(err.Error(), "rules.json") {
+		t.Fatalf("unrecoverable file: %v", err)
+	}
+}
+
+func TestReadDuringWriteIsNotCorrupt(t *testing.T) {
+	dataDir = t.TempDir()
+	p := filepath.Join(dataDir, "sessions.json")
+	if err := writeJSON(p, []int{0}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	corrupt := make(chan int)
+	go func() {
+		n := 0
+		for ctx.Err() == nil {
+			var v []int
+			if err := readJSON(p, &v); errors.Is(err, errCorruptFile) {
+				n++
+			}
+		}
+		corrupt <- n
+	}()
+	for i := 1; i <= 300; i++ {
+		var v []int
+		if err := updateJSON(p, &v, func() error { v = append(v, i); return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	if n := <-corrupt; n != 0 {
+		t.Fatalf("%d reads during writes were reported corrupt", n)
+	}
+}
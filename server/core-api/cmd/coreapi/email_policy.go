@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// EmailPolicy restricts which addresses may register or be invited. An
+// empty AllowDomains list allows every domain not otherwise blocked.
+type EmailPolicy struct {
+	AllowDomains     []string `json:"allow_domains,omitempty"`
+	DenyDomains      []string `json:"deny_domains,omitempty"`
+	BlockDisposable  bool     `json:"block_disposable,omitempty"`
+	RequireMXRecords bool     `json:"require_mx,omitempty"`
+}
+
+// BlockedSignup records an address turned away by the email policy.
+type BlockedSignup struct {
+	Email    string    `json:"email"`
+	SourceIP string    `json:"source_ip,omitempty"`
+	Context  string    `json:"context"` // registration, invite
+	Reason   string    `json:"reason"`
+	At       time.Time `json:"at"`
+}
+
+// mxResolver is the subset of net.Resolver used for the MX check so tests
+// and offline deployments can substitute a local stand-in.
+type mxResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+var (
+	disposableDomainsFile = envOr("DISPOSABLE_DOMAINS_FILE", "")
+	mxLookup              = newMXResolver(envOr("MX_RESOLVER", ""))
+	domainLabelRe         = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+)
+
+// newMXResolver returns the system resolver, or one that sends every query
+// to addr (host:port) when set, e.g. a local unbound or dnsmasq instance.
+func newMXResolver(addr string) mxResolver {
+	if addr == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+func emailPolicyFile() string {
+	return filepath.Join(dataDir, "email_policy.json")
+}
+
+func blockedSignupsFile() string {
+	return filepath.Join(dataDir, "blocked_signups.json")
+}
+
+func disposableFile() string {
+	if disposableDomainsFile != "" {
+		return disposableDomainsFile
+	}
+	return filepath.Join(dataDir, "disposable_domains.txt")
+}
+
+func loadEmailPolicy() (EmailPolicy, error) {
+	var p EmailPolicy
+	if err := readJSON(emailPolicyFile(), &p); err != nil && !os.IsNotExist(err) {
+		return p, err
+	}
+	return p, nil
+}
+
+// loadDisposableDomains reads one domain per line; blank lines and lines
+// starting with # are ignored.
+func loadDisposableDomains() (map[string]bool, error) {
+	f, err := os.Open(disposableFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	domains := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.ToLower(strings.TrimSpace(sc.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[strings.TrimPrefix(line, "@")] = true
+	}
+	return domains, sc.Err()
+}
+
+// domainMatches reports whether domain equals pattern or is a subdomain of it.
+func domainMatches(domain, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(pattern), "@"))
+	return pattern != "" && (domain == pattern || strings.HasSuffix(domain, "."+pattern))
+}
+
+func validDomainSyntax(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !domainLabelRe.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkEmailPolicy returns a human-readable reason when email is not
+// allowed, or "" when it passes.
+func checkEmailPolicy(email string) (string, error) {
+	domain := emailDomain(email)
+	if !validDomainSyntax(domain) {
+		return "invalid email domain", nil
+	}
+	policy, err := loadEmailPolicy()
+	if err != nil {
+		return "", err
+	}
+	for _, d := range policy.DenyDomains {
+		if domainMatches(domain, d) {
+			return "email domain " + domain + " is denied", nil
+		}
+	}
+	if len(policy.AllowDomains) > 0 {
+		allowed := false
+		for _, d := range policy.AllowDomains {
+			if domainMatches(domain, d) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "email domain " + domain + " is not on the allowlist", nil
+		}
+	}
+	if policy.BlockDisposable {
+		disposable, err := loadDisposableDomains()
+		if err != nil {
+			return "", err
+		}
+		for d := range disposable {
+			if domainMatches(domain, d) {
+				return "disposable email addresses are not accepted", nil
+			}
+		}
+	}
+	if policy.RequireMXRecords {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		mxs, err := mxLookup.LookupMX(ctx, domain)
+		if err != nil || len(mxs) == 0 {
+			return "email domain " + domain + " has no mail servers", nil
+		}
+		usable := false
+		for _, mx := range mxs {
+			// A single "." host is the RFC 7505 null MX: the domain accepts no mail.
+			if host := strings.TrimSuffix(strings.ToLower(mx.Host), "."); validDomainSyntax(host) {
+				usable = true
+				break
+			}
+		}
+		if !usable {
+			return "email domain " + domain + " does not accept mail", nil
+		}
+	}
+	return "", nil
+}
+
+// enforceEmailPolicy checks email and logs the attempt when it is blocked.
+func enforceEmailPolicy(email, sourceIP, origin string) error {
+	reason, err := checkEmailPolicy(email)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load email policy")
+	}
+	if reason == "" {
+		return nil
+	}
+	if err := recordBlockedSignup(BlockedSignup{Email: email, SourceIP: sourceIP, Context: origin, Reason: reason, At: time.Now().UTC()}); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return fiber.NewError(fiber.StatusForbidden, reason)
+}
+
+func loadBlockedSignups() ([]BlockedSignup, error) {
+	var list []BlockedSignup
+	if err := readJSON(blockedSignupsFile(), &list); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// recordBlockedSignup appends b to the log, keeping entries for the same
+// retention window as rejected registrations.
+func recordBlockedSignup(b BlockedSignup) error {
+	var list []BlockedSignup
+	return updateJSON(blockedSignupsFile(), &list, func() error {
+		kept := list[:0]
+		for _, e := range list {
+			if b.At.Sub(e.At) < rejectedRetention {
+				kept = append(kept, e)
+			}
+		}
+		list = append(kept, b)
+		return nil
+	})
+}
+
+func handleEmailPolicyGet(c *fiber.Ctx) error {
+	policy, err := loadEmailPolicy()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load email policy")
+	}
+	return c.JSON(policy)
+}
+
+func handleEmailPolicyPut(c *fiber.Ctx) error {
+	var policy EmailPolicy
+	if err := c.BodyParser(&policy); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	for _, list := range [][]string{policy.AllowDomains, policy.DenyDomains} {
+		for i, d := range list {
+			d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+			if !validDomainSyntax(d) {
+				return fiber.NewError(fiber.StatusBadRequest, "invalid domain "+list[i])
+			}
+			list[i] = d
+		}
+	}
+	var stored EmailPolicy
+	err := updateJSON(emailPolicyFile(), &stored, func() error {
+		stored = policy
+		return nil
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"ok": true, "policy": policy})
+}
+
+func handleBlockedSignupsList(c *fiber.Ctx) error {
+	list, err := loadBlockedSignups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load blocked sign-ups")
+	}
+	if list == nil {
+		list = []BlockedSignup{}
+	}
+	return c.JSON(list)
+}
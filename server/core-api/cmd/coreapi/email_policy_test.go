@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeMXResolver map[string][]*net.MX
+
+func (f fakeMXResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if mx, ok := f[name]; ok {
+		return mx, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestEmailPolicy(t *testing.T) {
+	dataDir = t.TempDir()
+	prev := mxLookup
+	mxLookup = fakeMXResolver{
+		"uni.edu":      {{Host: "mx.uni.edu.", Pref: 10}},
+		"mail.uni.edu": {{Host: "mx.uni.edu.", Pref: 10}},
+		"nomail.edu":   {{Host: ".", Pref: 0}},
+	}
+	defer func() { mxLookup = prev }()
+
+	if err := os.WriteFile(filepath.Join(dataDir, "disposable_domains.txt"), []byte("# throwaway\nmailinator.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy := EmailPolicy{
+		DenyDomains:      []string{"bad.uni.edu"},
+		BlockDisposable:  true,
+		RequireMXRecords: true,
+	}
+	if err := writeJSON(emailPolicyFile(), policy); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"ann@uni.edu":          true,
+		"ann@mail.uni.edu":     true,
+		"eve@bad.uni.edu":      false,
+		"eve@mailinator.com":   false,
+		"eve@nomail.edu":       false,
+		"eve@unknown.example":  false,
+		"eve@-broken-.example": false,
+	}
+	for email, want := range cases {
+		reason, err := checkEmailPolicy(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (reason == "") != want {
+			t.Fatalf("%s: allowed=%v, reason %q", email, reason == "", reason)
+		}
+	}
+
+	policy.AllowDomains = []string{"uni.edu"}
+	policy.RequireMXRecords = false
+	_ = writeJSON(emailPolicyFile(), policy)
+	if reason, _ := checkEmailPolicy("bob@gmail.com"); reason == "" {
+		t.Fatalf("domain outside allowlist accepted")
+	}
+
+	if err := enforceEmailPolicy("bob@gmail.com", "10.0.0.1", "invite"); err == nil {
+		t.Fatalf("expected enforcement error")
+	}
+	blocked, err := loadBlockedSignups()
+	if err != nil || len(blocked) != 1 || blocked[0].Context != "invite" || blocked[0].Reason == "" {
+		t.Fatalf("blocked attempt not recorded: %+v %v", blocked, err)
+	}
+}
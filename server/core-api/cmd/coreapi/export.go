@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/argon2"
+)
+
+// An instance export is one gzipped JSON document carrying everything
+// needed to move safe-spac to another host: users (with their VPN peers),
+// registrations, invites and the TeamSpeak mapping, plus metadata about the
+// source such as the WireGuard server public key. Secret fields are sealed
+// with a key derived from an operator passphrase, never with the data keys
+// of either instance, so MASTER_KEY does not have to travel with it.
+
+const (
+	exportFormat  = "safe-spac-export"
+	exportVersion = 1
+	exportKeyID   = "export"
+
+	minExportPassphrase = 12
+)
+
+var wgServerPublicKeyFile = envOr("WG_SERVER_PUBLIC_KEY_FILE", "/etc/wireguard/server.pub")
+
+var (
+	errExportPassphrase = errors.New("wrong passphrase")
+	errExportInvalid    = errors.New("invalid export archive")
+)
+
+type instanceExport struct {
+	Format         string          `json:"format"`
+	Version        int             `json:"version"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Source         exportSource    `json:"source"`
+	Crypto         exportCrypto    `json:"crypto"`
+	Users          []User          `json:"users"`
+	Registrations  []Registration  `json:"registrations"`
+	Invites        []Invite        `json:"invites"`
+	TeamSpeakUsers []TeamSpeakUser `json:"teamspeak_users"`
+}
+
+type exportSource struct {
+	Hostname      string         `json:"hostname"`
+	Backend       string         `json:"backend"`
+	SchemaVersion int            `json:"schema_version"`
+	WireGuardKey  string         `json:"wireguard_public_key,omitempty"`
+	Counts        map[string]int `json:"counts"`
+}
+
+// exportCrypto describes how the passphrase becomes the sealing key.
+// Check is a known value sealed with it, so a wrong passphrase is caught
+// before anything is imported.
+type exportCrypto struct {
+	KDF       string `json:"kdf"`
+	Salt      string `json:"salt"`
+	Time      uint32 `json:"time"`
+	MemoryKiB uint32 `json:"memory_kib"`
+	Threads   uint8  `json:"threads"`
+	Check     string `json:"check"`
+}
+
+const exportCheckValue = "safe-spac export"
+
+// userExportSecrets adds the password hash to the secrets sealed at rest;
+// an archive should not hand out material for offline guessing.
+func userExportSecrets(u *User) []secretField {
+	return append(userSecrets(u), secretField{"user.password", &u.Password})
+}
+
+func registrationSecrets(r *Registration) []secretField {
+	return []secretField{{"registration.password", &r.Password}}
+}
+
+// wireGuardServerKey reads the public key of the local WireGuard server,
+// or returns "" when this host cannot see it.
+func wireGuardServerKey() string {
+	raw, err := os.ReadFile(wgServerPublicKeyFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// exportKeyring derives the sealing key from passphrase. It is a keyring
+// with a single key, so seal and open work exactly as for data at rest.
+func exportKeyring(passphrase string, c exportCrypto) (*keyring, error) {
+	if c.KDF != "argon2id" {
+		return nil, fmt.Errorf("%w: unsupported kdf %q", errExportInvalid, c.KDF)
+	}
+	// Bounds keep a crafted archive from asking for gigabytes of memory.
+	if c.Time == 0 || c.Time > 10 || c.MemoryKiB == 0 || c.MemoryKiB > 256*1024 || c.Threads == 0 || c.Threads > 16 {
+		return nil, fmt.Errorf("%w: kdf parameters out of range", errExportInvalid)
+	}
+	salt, err := base64.StdEncoding.DecodeString(c.Salt)
+	if err != nil || len(salt) < 16 {
+		return nil, fmt.Errorf("%w: bad salt", errExportInvalid)
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, c.Time, c.MemoryKiB, c.Threads, 32)
+	return &keyring{active: exportKeyID, deks: map[string][]byte{exportKeyID: key}}, nil
+}
+
+// sealExportFields seals each non-empty field of the record id.
+func sealExportFields(kr *keyring, id string, fields []secretField) error {
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+		sealed, err := kr.seal(*f.value, f.label+"/"+id)
+		if err != nil {
+			return err
+		}
+		*f.value = sealed
+	}
+	return nil
+}
+
+// openExportFields reverses sealExportFields. Every secret must be sealed
+// with the export key; plaintext in an archive means it was tampered with.
+func openExportFields(kr *keyring, id string, fields []secretField) error {
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+		if !strings.HasPrefix(*f.value, sealedPrefix+exportKeyID+":") {
+			return fmt.Errorf("%w: %s of %s is not sealed", errExportInvalid, f.label, id)
+		}
+		plain, err := kr.open(*f.value, f.label+"/"+id)
+		if err != nil {
+			return fmt.Errorf("%w: %s of %s: %v", errExportInvalid, f.label, id, err)
+		}
+		*f.value = plain
+	}
+	return nil
+}
+
+// buildExport collects the instance with its secrets sealed under
+// passphrase.
+func buildExport(passphrase string) (instanceExport, error) {
+	e := instanceExport{Format: exportFormat, Version: exportVersion, CreatedAt: time.Now().UTC()}
+	if len(passphrase) < minExportPassphrase {
+		return e, fmt.Errorf("passphrase must be at least %d characters", minExportPassphrase)
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return e, err
+	}
+	e.Crypto = exportCrypto{KDF: "argon2id", Salt: base64.StdEncoding.EncodeToString(salt), Time: 3, MemoryKiB: 64 * 1024, Threads: 4}
+	kr, err := exportKeyring(passphrase, e.Crypto)
+	if err != nil {
+		return e, err
+	}
+	if e.Crypto.Check, err = kr.seal(exportCheckValue, "export/check"); err != nil {
+		return e, err
+	}
+
+	if e.Users, err = store.Users.List(); err != nil {
+		return e, err
+	}
+	if e.Registrations, err = store.Registrations.List(); err != nil {
+		return e, err
+	}
+	if e.Invites, err = store.Invites.List(); err != nil {
+		return e, err
+	}
+	if e.TeamSpeakUsers, err = store.TeamSpeakUsers.List(); err != nil {
+		return e, err
+	}
+	peers := 0
+	for i := range e.Users {
+		if e.Users[i].VPNConfig != nil && e.Users[i].VPNConfig.PublicKey != "" {
+			peers++
+		}
+		if err := sealExportFields(kr, e.Users[i].ID, userExportSecrets(&e.Users[i])); err != nil {
+			return e, err
+		}
+	}
+	for i := range e.Registrations {
+		e.Registrations[i].ApprovalsRequired = 0
+		if err := sealExportFields(kr, e.Registrations[i].ID, registrationSecrets(&e.Registrations[i])); err != nil {
+			return e, err
+		}
+	}
+	for i := range e.TeamSpeakUsers {
+		if err := sealExportFields(kr, e.TeamSpeakUsers[i].ID, teamSpeakSecrets(&e.TeamSpeakUsers[i])); err != nil {
+			return e, err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	schema, _ := loadDataManifest()
+	e.Source = exportSource{
+		Hostname:      hostname,
+		Backend:       storageBackend(),
+		SchemaVersion: schema.Version,
+		WireGuardKey:  wireGuardServerKey(),
+		Counts: map[string]int{
+			"users":           len(e.Users),
+			"registrations":   len(e.Registrations),
+			"invites":         len(e.Invites),
+			"teamspeak_users": len(e.TeamSpeakUsers),
+			"vpn_peers":       peers,
+		},
+	}
+	return e, nil
+}
+
+func writeExport(w io.Writer, e instanceExport) error {
+	gz := gzip.NewWriter(w)
+	if err := json.NewEncoder(gz).Encode(e); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readExport decodes an archive and checks that this build understands
+// it. Secrets stay sealed until openExport.
+func readExport(r io.Reader) (instanceExport, error) {
+	var e instanceExport
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return e, fmt.Errorf("%w: %v", errExportInvalid, err)
+	}
+	if err := json.NewDecoder(gz).Decode(&e); err != nil {
+		return e, fmt.Errorf("%w: %v", errExportInvalid, err)
+	}
+	if e.Format != exportFormat {
+		return e, fmt.Errorf("%w: not a %s archive", errExportInvalid, exportFormat)
+	}
+	if e.Version < 1 || e.Version > exportVersion {
+		return e, fmt.Errorf("%w: format version %d, this build reads up to %d", errExportInvalid, e.Version, exportVersion)
+	}
+	if latest := dataMigrations[len(dataMigrations)-1].Version; e.Source.SchemaVersion > latest {
+		return e, fmt.Errorf("%w: exported at schema version %d, newer than this build (%d)", errExportInvalid, e.Source.SchemaVersion, latest)
+	}
+	return e, nil
+}
+
+// openExport checks passphrase against the archive and decrypts its
+// secrets in place.
+func openExport(e *instanceExport, passphrase string) error {
+	kr, err := exportKeyring(passphrase, e.Crypto)
+	if err != nil {
+		return err
+	}
+	if check, err := kr.open(e.Crypto.Check, "export/check"); err != nil || check != exportCheckValue {
+		return errExportPassphrase
+	}
+	for i := range e.Users {
+		if err := openExportFields(kr, e.Users[i].ID, userExportSecrets(&e.Users[i])); err != nil {
+			return err
+		}
+	}
+	for i := range e.Registrations {
+		if err := openExportFields(kr, e.Registrations[i].ID, registrationSecrets(&e.Registrations[i])); err != nil {
+			return err
+		}
+	}
+	for i := range e.TeamSpeakUsers {
+		if err := openExportFields(kr, e.TeamSpeakUsers[i].ID, teamSpeakSecrets(&e.TeamSpeakUsers[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importReport says what an import did, or with DryRun would do.
+type importReport struct {
+	Mode        string                       `json:"mode"`
+	DryRun      bool                         `json:"dry_run"`
+	Backup      string                       `json:"backup,omitempty"` // snapshot taken before writing
+	Collections map[string]*collectionReport `json:"collections"`
+	Warnings    []string                     `json:"warnings,omitempty"`
+}
+
+type collectionReport struct {
+	Created   int              `json:"created"`
+	Updated   int              `json:"updated"`
+	Unchanged int              `json:"unchanged"`
+	Deleted   int              `json:"deleted"`
+	Conflicts []importConflict `json:"conflicts,omitempty"`
+}
+
+type importConflict struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// Unique values other than the key, by collection. A merged record that
+// would share one with an existing record is a conflict.
+func userUniques(u *User) []string {
+	keys := uniqueKeys("email", strings.ToLower(u.Email), "username", strings.ToLower(u.Username))
+	if u.VPNConfig != nil {
+		keys = append(keys, uniqueKeys("VPN address", u.VPNConfig.IPAddress, "VPN public key", u.VPNConfig.PublicKey)...)
+	}
+	return keys
+}
+
+func registrationUniques(r *Registration) []string {
+	return uniqueKeys("email", strings.ToLower(r.Email))
+}
+
+func teamSpeakUniques(u *TeamSpeakUser) []string {
+	return uniqueKeys("username", strings.ToLower(u.Username))
+}
+
+// uniqueKeys turns label, value pairs into "label value", skipping empty
+// values, which never clash.
+func uniqueKeys(pairs ...string) []string {
+	var keys []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			keys = append(keys, pairs[i]+" "+pairs[i+1])
+		}
+	}
+	return keys
+}
+
+func noUniques[T any](*T) []string { return nil }
+
+// planMerge works out the collection after importing incoming.
+//
+// merge keeps every current record and adds the incoming ones whose key is
+// new; a record whose key exists with different data, or whose unique
+// values are taken, is reported as a conflict and skipped.
+//
+// replace makes the collection exactly incoming.
+func planMerge[T any](current, incoming []T, key func(*T) string, uniques func(*T) []string, mode string) ([]T, *collectionReport) {
+	rep := &collectionReport{}
+	byKey := map[string]int{}
+	for i := range current {
+		byKey[key(&current[i])] = i
+	}
+	same := func(a, b *T) bool {
+		x, _ := json.Marshal(a)
+		y, _ := json.Marshal(b)
+		return bytes.Equal(x, y)
+	}
+
+	if mode == "replace" {
+		seen := map[string]bool{}
+		for i := range incoming {
+			id := key(&incoming[i])
+			seen[id] = true
+			switch j, ok := byKey[id]; {
+			case !ok:
+				rep.Created++
+			case same(&current[j], &incoming[i]):
+				rep.Unchanged++
+			default:
+				rep.Updated++
+			}
+		}
+		for i := range current {
+			if !seen[key(&current[i])] {
+				rep.Deleted++
+			}
+		}
+		return append([]T{}, incoming...), rep
+	}
+
+	result := append([]T{}, current...)
+	taken := map[string]string{}
+	for i := range current {
+		for _, u := range uniques(&current[i]) {
+			taken[u] = key(&current[i])
+		}
+	}
+	for i := range incoming {
+		id := key(&incoming[i])
+		if j, ok := byKey[id]; ok {
+			if same(&current[j], &incoming[i]) {
+				rep.Unchanged++
+			} else {
+				rep.Conflicts = append(rep.Conflicts, importConflict{id, "exists with different data"})
+			}
+			continue
+		}
+		clash := ""
+		for _, u := range uniques(&incoming[i]) {
+			if owner, ok := taken[u]; ok {
+				clash = fmt.Sprintf("%s already used by %s", u, owner)
+				break
+			}
+		}
+		if clash != "" {
+			rep.Conflicts = append(rep.Conflicts, importConflict{id, clash})
+			continue
+		}
+		for _, u := range uniques(&incoming[i]) {
+			taken[u] = id
+		}
+		result = append(result, incoming[i])
+		rep.Created++
+	}
+	return result, rep
+}
+
+// mergeCollection plans the import of incoming into repo and, unless
+// dryRun, applies it as one Mutate against the locked collection.
+func mergeCollection[T any](repo Repository[T], incoming []T, key func(*T) string, uniques func(*T) []string, mode string, dryRun bool) (*collectionReport, error) {
+	if dryRun {
+		current, err := repo.List()
+		if err != nil {
+			return nil, err
+		}
+		_, rep := planMerge(current, incoming, key, uniques, mode)
+		return rep, nil
+	}
+	var rep *collectionReport
+	err := repo.Mutate(func(current []T) ([]T, error) {
+		var result []T
+		result, rep = planMerge(current, incoming, key, uniques, mode)
+		if rep.Created+rep.Updated+rep.Deleted == 0 {
+			return nil, errUnchanged
+		}
+		return result, nil
+	})
+	return rep, err
+}
+
+// checkExportDuplicates rejects archives that repeat a key within one
+// collection, which no instance can have produced.
+func checkExportDuplicates[T any](name string, list []T, key func(*T) string) error {
+	seen := map[string]bool{}
+	for i := range list {
+		id := key(&list[i])
+		if seen[id] {
+			return fmt.Errorf("%w: %s %q appears twice", errExportInvalid, name, id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// importInstance loads an opened archive into the store. mode is "merge"
+// or "replace". A real import first takes a backup, so it can be undone
+// with POST /api/admin/backups/:name/restore.
+func importInstance(ctx context.Context, e instanceExport, mode string, dryRun bool) (importReport, error) {
+	rep := importReport{Mode: mode, DryRun: dryRun, Collections: map[string]*collectionReport{}}
+	if mode != "merge" && mode != "replace" {
+		return rep, fmt.Errorf("mode must be merge or replace")
+	}
+	for _, err := range []error{
+		checkExportDuplicates("user", e.Users, userID),
+		checkExportDuplicates("registration", e.Registrations, registrationID),
+		checkExportDuplicates("invite", e.Invites, inviteToken),
+		checkExportDuplicates("TeamSpeak user", e.TeamSpeakUsers, teamSpeakUserID),
+	} {
+		if err != nil {
+			return rep, err
+		}
+	}
+	if local := wireGuardServerKey(); e.Source.WireGuardKey != "" && local != "" && local != e.Source.WireGuardKey {
+		rep.Warnings = append(rep.Warnings, "the WireGuard server key differs from the exported one; move the server key pair from the old host or reissue every peer's config")
+	} else if e.Source.WireGuardKey != "" && local == "" {
+		rep.Warnings = append(rep.Warnings, "cannot read the local WireGuard server key to compare with "+e.Source.WireGuardKey)
+	}
+
+	// Erased users stay erased.
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return rep, err
+	}
+	erased := map[string]bool{}
+	for _, t := range tombstones {
+		erased[t.UserID] = true
+	}
+	var skipped []importConflict
+	e.Users = dropErased(e.Users, userID, erased, &skipped)
+	var skippedTS []importConflict
+	e.TeamSpeakUsers = dropErased(e.TeamSpeakUsers, teamSpeakUserID, erased, &skippedTS)
+
+	if !dryRun {
+		backup, err := createBackup(ctx, "pre-import")
+		if err != nil {
+			return rep, fmt.Errorf("backup before import: %w", err)
+		}
+		rep.Backup = backup.Name
+	}
+	if rep.Collections["users"], err = mergeCollection(store.Users, e.Users, userID, userUniques, mode, dryRun); err != nil {
+		return rep, err
+	}
+	if rep.Collections["registrations"], err = mergeCollection(store.Registrations, e.Registrations, registrationID, registrationUniques, mode, dryRun); err != nil {
+		return rep, err
+	}
+	if rep.Collections["invites"], err = mergeCollection(store.Invites, e.Invites, inviteToken, noUniques[Invite], mode, dryRun); err != nil {
+		return rep, err
+	}
+	if rep.Collections["teamspeak_users"], err = mergeCollection(store.TeamSpeakUsers, e.TeamSpeakUsers, teamSpeakUserID, teamSpeakUniques, mode, dryRun); err != nil {
+		return rep, err
+	}
+	rep.Collections["users"].Conflicts = append(rep.Collections["users"].Conflicts, skipped...)
+	rep.Collections["teamspeak_users"].Conflicts = append(rep.Collections["teamspeak_users"].Conflicts, skippedTS...)
+	if mode == "replace" && !dryRun {
+		// Sessions of users the archive does not have would outlive them.
+		known := map[string]bool{}
+		for _, u := range e.Users {
+			known[u.ID] = true
+		}
+		if _, err := removeSessions(func(s Session) bool { return !known[s.UserID] }); err != nil {
+			return rep, err
+		}
+	}
+	return rep, nil
+}
+
+// dropErased removes the records of erased users from list and reports
+// each as a conflict.
+func dropErased[T any](list []T, key func(*T) string, erased map[string]bool, skipped *[]importConflict) []T {
+	kept := make([]T, 0, len(list))
+	for i := range list {
+		if id := key(&list[i]); erased[id] {
+			*skipped = append(*skipped, importConflict{id, "user was erased on this instance"})
+			continue
+		}
+		kept = append(kept, list[i])
+	}
+	return kept
+}
+
+// exportFileName is the download name for an archive made at t.
+func exportFileName(t time.Time) string {
+	return "safe-spac-export-" + t.UTC().Format("20060102T150405Z") + ".json.gz"
+}
+
+// exportToFile and importFromFile back the --export and --import flags.
+func exportToFile(path, passphrase string) error {
+	e, err := buildExport(passphrase)
+	if err != nil {
+		return err
+	}
+	_, err = commitFile(path, 0o600, func(w io.Writer) error { return writeExport(w, e) })
+	return err
+}
+
+func importFromFile(ctx context.Context, path, passphrase, mode string, dryRun bool) (importReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return importReport{}, err
+	}
+	defer f.Close()
+	e, err := readExport(f)
+	if err != nil {
+		return importReport{}, err
+	}
+	if err := openExport(&e, passphrase); err != nil {
+		return importReport{}, err
+	}
+	return importInstance(ctx, e, mode, dryRun)
+}
+
+func handleInstanceExport(c *fiber.Ctx) error {
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	if len(req.Passphrase) < minExportPassphrase {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("passphrase must be at least %d characters", minExportPassphrase))
+	}
+	e, err := buildExport(req.Passphrase)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	var buf bytes.Buffer
+	if err := writeExport(&buf, e); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	recordAudit(c, "instance.export", "", fmt.Sprintf("%d users", len(e.Users)))
+	c.Attachment(exportFileName(e.CreatedAt))
+	c.Set(fiber.HeaderContentType, "application/gzip")
+	return c.Send(buf.Bytes())
+}
+
+// handleInstanceImport takes a multipart form: the archive as "archive",
+// plus "passphrase", "mode" (merge or replace) and "dry_run".
+func handleInstanceImport(c *fiber.Ctx) error {
+	mode := firstNonEmpty(c.FormValue("mode"), "merge")
+	if mode != "merge" && mode != "replace" {
+		return fiber.NewError(fiber.StatusBadRequest, "mode must be merge or replace")
+	}
+	dryRun := c.FormValue("dry_run") == "true"
+	fh, err := c.FormFile("archive")
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "archive file required")
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+	defer f.Close()
+	e, err := readExport(f)
+	if err == nil {
+		err = openExport(&e, c.FormValue("passphrase"))
+	}
+	if errors.Is(err, errExportPassphrase) || errors.Is(err, errExportInvalid) {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	rep, err := importInstance(c.Context(), e, mode, dryRun)
+	if errors.Is(err, errExportInvalid) {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+	if err != nil {
+		return storeError(err, "not found")
+	}
+	if !dryRun {
+		log.Printf("Imported %s export from %s (%s)", mode, e.Source.Hostname, e.CreatedAt.Format(time.RFC3339))
+		recordAudit(c, "instance.import", e.Source.Hostname, mode+", backup "+rep.Backup)
+	}
+	return c.JSON(rep)
+}
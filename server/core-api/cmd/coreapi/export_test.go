@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const testPassphrase = "correct horse battery"
+
+func seedInstance(t *testing.T) {
+	t.Helper()
+	_ = store.Users.Create(User{ID: "u1", Email: "ada@example.org", Username: "ada", Password: "pw-hash", Status: "active",
+		VPNConfig: &VPNConfig{PublicKey: "pub1", PrivateKey: "priv1", IPAddress: "10.66.0.2", Enabled: true}})
+	_ = store.Registrations.Create(Registration{ID: "r1", Email: "new@example.org", Password: "hash", Status: "pending"})
+	_ = store.Invites.Create(Invite{Token: "t1", CreatedBy: "u1", ExpiresAt: time.Now().Add(time.Hour)})
+	createTeamSpeakAccount(t, "u1", "ada")
+}
+
+func exportArchive(t *testing.T) []byte {
+	t.Helper()
+	e, err := buildExport(testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeExport(&buf, e); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	dataDir = t.TempDir()
+	seedInstance(t)
+	archive := exportArchive(t)
+
+	zr, _ := gzip.NewReader(bytes.NewReader(archive))
+	plain, _ := io.ReadAll(zr)
+	for _, secret := range []string{"priv1", "ts-secret", `"hash"`, "pw-hash"} {
+		if bytes.Contains(plain, []byte(secret)) {
+			t.Fatalf("archive holds %s in plaintext", secret)
+		}
+	}
+
+	// A fresh instance on the new host.
+	dataDir = t.TempDir()
+	e, err := readExport(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Source.Counts["vpn_peers"] != 1 {
+		t.Fatalf("counts: %+v", e.Source.Counts)
+	}
+	if err := openExport(&e, "wrong passphrase!"); !errors.Is(err, errExportPassphrase) {
+		t.Fatalf("wrong passphrase: %v", err)
+	}
+	if err := openExport(&e, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := importInstance(context.Background(), e, "merge", true)
+	if err != nil || rep.Collections["users"].Created != 1 || rep.Backup != "" {
+		t.Fatalf("dry run: %+v %v", rep, err)
+	}
+	if users, _ := store.Users.List(); len(users) != 0 {
+		t.Fatal("dry run wrote users")
+	}
+
+	rep, err = importInstance(context.Background(), e, "merge", false)
+	if err != nil || rep.Backup == "" {
+		t.Fatalf("import: %+v %v", rep, err)
+	}
+	u, err := store.Users.Get("u1")
+	if err != nil || u.VPNConfig.PrivateKey != "priv1" || u.Password != "pw-hash" {
+		t.Fatalf("user after import: %+v %v", u, err)
+	}
+	if ts, _ := teamSpeakAccountOf("u1"); ts.Password != "ts-secret" {
+		t.Fatalf("TeamSpeak password: %q", ts.Password)
+	}
+	if r, _ := store.Registrations.Get("r1"); r.Password != "hash" {
+		t.Fatalf("registration password: %q", r.Password)
+	}
+	if _, err := store.Invites.Get("t1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Importing the same archive again changes nothing.
+	rep, _ = importInstance(context.Background(), e, "merge", true)
+	if c := rep.Collections["users"]; c.Created != 0 || c.Unchanged != 1 || len(c.Conflicts) != 0 {
+		t.Fatalf("second import: %+v", c)
+	}
+}
+
+func TestImportConflictsAndReplace(t *testing.T) {
+	dataDir = t.TempDir()
+	seedInstance(t)
+	archive := exportArchive(t)
+	e, _ := readExport(bytes.NewReader(archive))
+	if err := openExport(&e, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "u1", Email: "ada@example.org", Status: "suspended"})
+	_ = store.Users.Create(User{ID: "u9", Email: "other@example.org", VPNConfig: &VPNConfig{IPAddress: "10.66.0.2"}})
+	e.Users = append(e.Users, User{ID: "u2", Email: "OTHER@example.org"})
+	_ = store.Sessions.Create(Session{ID: "s9", UserID: "u9", ExpiresAt: time.Now().Add(time.Hour)})
+
+	rep, err := importInstance(context.Background(), e, "merge", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicts := rep.Collections["users"].Conflicts
+	if len(conflicts) != 2 || conflicts[0].ID != "u1" || !strings.Contains(conflicts[1].Reason, "email other@example.org already used by u9") {
+		t.Fatalf("conflicts: %+v", conflicts)
+	}
+	if u, _ := store.Users.Get("u1"); u.Status != "suspended" {
+		t.Fatal("merge overwrote an existing user")
+	}
+
+	rep, err = importInstance(context.Background(), e, "replace", false)
+	if c := rep.Collections["users"]; err != nil || c.Updated != 1 || c.Created != 1 || c.Deleted != 1 {
+		t.Fatalf("replace: %+v %v", rep.Collections["users"], err)
+	}
+	if _, err := store.Users.Get("u9"); !errors.Is(err, errNotFound) {
+		t.Fatal("replace kept a user missing from the archive")
+	}
+	if _, err := store.Sessions.Get("s9"); !errors.Is(err, errNotFound) {
+		t.Fatal("session of a removed user survived")
+	}
+
+	e.Users = append(e.Users, e.Users[0])
+	if _, err := importInstance(context.Background(), e, "merge", true); !errors.Is(err, errExportInvalid) {
+		t.Fatalf("duplicate ids: %v", err)
+	}
+}
+
+func TestInstanceExportImportHandlers(t *testing.T) {
+	dataDir = t.TempDir()
+	seedInstance(t)
+	app := fiber.New()
+	app.Post("/export", handleInstanceExport)
+	app.Post("/import", handleInstanceImport)
+
+	req := httptest.NewRequest("POST", "/export", strings.NewReader(`{"passphrase":"short"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("short passphrase: %d", resp.StatusCode)
+	}
+	req = httptest.NewRequest("POST", "/export", strings.NewReader(`{"passphrase":"`+testPassphrase+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, _ := app.Test(req, 10000)
+	archive, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || !strings.Contains(resp.Header.Get("Content-Disposition"), "safe-spac-export-") {
+		t.Fatalf("export: %d %s", resp.StatusCode, resp.Header.Get("Content-Disposition"))
+	}
+
+	importStatus := func(passphrase string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("archive", "export.json.gz")
+		_, _ = fw.Write(archive)
+		_ = mw.WriteField("passphrase", passphrase)
+		_ = mw.WriteField("dry_run", "true")
+		_ = mw.Close()
+		req := httptest.NewRequest("POST", "/import", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		resp, _ := app.Test(req, 10000)
+		return resp.StatusCode
+	}
+	if got := importStatus("not the passphrase"); got != fiber.StatusUnprocessableEntity {
+		t.Fatalf("wrong passphrase: %v", got)
+	}
+	if got := importStatus(testPassphrase); got != 200 {
+		t.Fatalf("dry run import: %v", got)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileLocks holds one mutex per data file path.
+var fileLocks sync.Map
+
+// errUnchanged may be returned by an updateJSON or Mutate callback to skip
+// the write. The caller then sees a nil error.
+var errUnchanged = errors.New("unchanged")
+
+// writes lets snapshots and restores pause every writer in this process.
+// lockFile and writeJSON pass through it.
+var writes = newWriteGate()
+
+// writeGate is a pause switch for writers. Unlike a sync.RWMutex it lets a
+// writer that is already inside enter again (lockFile nested in a Mutate
+// callback), because pause only takes effect once no writer is inside.
+type writeGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	active int
+	paused bool
+}
+
+func newWriteGate() *writeGate {
+	g := &writeGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+func (g *writeGate) enter() {
+	g.mu.Lock()
+	for g.paused {
+		g.cond.Wait()
+	}
+	g.active++
+	g.mu.Unlock()
+}
+
+func (g *writeGate) leave() {
+	g.mu.Lock()
+	g.active--
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// pause waits for the writers in flight to finish and holds new ones back
+// until resume. It must not be called by a goroutine inside the gate.
+func (g *writeGate) pause() {
+	g.mu.Lock()
+	for g.paused || g.active > 0 {
+		g.cond.Wait()
+	}
+	g.paused = true
+	g.mu.Unlock()
+}
+
+func (g *writeGate) resume() {
+	g.mu.Lock()
+	g.paused = false
+	g.cond.Broadcast()
+	g.mu.Unlock()
+}
+
+// lockFile serialises read-modify-write cycles on path. Goroutines in this
+// process queue on a mutex; other processes sharing DATA_DIR are kept out
+// by an advisory flock on path+".lock".
+func lockFile(path string) (unlock func(), err error) {
+	writes.enter()
+	v, _ := fileLocks.LoadOrStore(path, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	fail := func(err error) (func(), error) {
+		mu.Unlock()
+		writes.leave()
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fail(err)
+	}
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return fail(err)
+	}
+	if err := flock(f); err != nil {
+		f.Close()
+		return fail(err)
+	}
+	return func() {
+		_ = funlock(f)
+		f.Close()
+		mu.Unlock()
+		writes.leave()
+	}, nil
+}
+
+// updateJSON loads path into v, lets fn change it and writes it back, all
+// under lockFile. A missing file leaves v at its zero value. Nothing is
+// written when fn fails or returns errUnchanged.
+func updateJSON(path string, v any, fn func() error) error {
+	unlock, err := lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := readJSON(path, v); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fn(); err != nil {
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
+	}
+	return writeJSON(path, v)
+}
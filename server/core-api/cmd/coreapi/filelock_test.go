@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestConcurrentHandlersLoseNoUpdates fires many writers at the same files
+// at once and checks every change survived.
+func TestConcurrentHandlersLoseNoUpdates(t *testing.T) {
+	dataDir = t.TempDir()
+	concurrentHandlers(t)
+}
+
+func TestConcurrentHandlersOnSQLite(t *testing.T) {
+	dataDir = t.TempDir()
+	s, err := newSQLiteStore(filepath.Join(dataDir, "coreapi.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := store
+	store = s
+	defer func() { store = prev; s.Close() }()
+	concurrentHandlers(t)
+}
+
+func concurrentHandlers(t *testing.T) {
+	const n = 20
+	var pending []Registration
+	for i := 0; i < n; i++ {
+		pending = append(pending, Registration{ID: fmt.Sprintf("r%d", i), Email: fmt.Sprintf("u%d@x.org", i), CreatedAt: time.Now().UTC()})
+	}
+	if err := store.Registrations.Mutate(func([]Registration) ([]Registration, error) { return pending, nil }); err != nil {
+		t.Fatal(err)
+	}
+	quota := 3
+	member := User{ID: "m", Email: "m@x.org", Role: "user", Status: "active", InviteQuota: &quota}
+	if err := store.Users.Create(member); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := generateJWT(&member)
+
+	app := fiber.New()
+	app.Post("/registrations/:id/approve", handleRegistrationApprove)
+	app.Post("/teamspeak/users", handleTeamSpeakUserCreate)
+	app.Post("/invites", handleMyInviteCreate)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inviteCodes := map[int]int{}
+	for i := 0; i < n; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := app.Test(httptest.NewRequest("POST", fmt.Sprintf("/registrations/r%d/approve", i), nil), -1)
+			if err != nil || resp.StatusCode != 200 {
+				t.Errorf("approve r%d: %v %v", i, err, resp)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/teamspeak/users", strings.NewReader(fmt.Sprintf(`{"username":"ts%d"}`, i)))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			if err != nil || resp.StatusCode != 200 {
+				t.Errorf("teamspeak create %d: %v %v", i, err, resp)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/invites", strings.NewReader(`{}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Errorf("invite: %v", err)
+				return
+			}
+			mu.Lock()
+			inviteCodes[resp.StatusCode]++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	users, _ := store.Users.List()
+	left, _ := store.Registrations.List()
+	if len(users) != n+1 || len(left) != 0 {
+		t.Fatalf("lost approvals: %d users, %d still pending", len(users), len(left))
+	}
+	ts, _ := store.TeamSpeakUsers.List()
+	if len(ts) != n {
+		t.Fatalf("lost TeamSpeak users: %d of %d", len(ts), n)
+	}
+	invites, _ := store.Invites.List()
+	if len(invites) != quota || inviteCodes[200] != quota || inviteCodes[fiber.StatusForbidden] != n-quota {
+		t.Fatalf("quota raced: %d invites stored, responses %v", len(invites), inviteCodes)
+	}
+}
+
+func TestUpdateJSONSerialisesWriters(t *testing.T) {
+	dataDir = t.TempDir()
+	path := filepath.Join(dataDir, "counter.json")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var n int
+			if err := updateJSON(path, &n, func() error { n++; return nil }); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	var n int
+	if err := readJSON(path, &n); err != nil || n != 50 {
+		t.Fatalf("counter = %d (%v), want 50", n, err)
+	}
+}
+
+// TestSettingsWritesTakeTheLock checks that replacing a settings file waits
+// for whoever holds its lock, as a restore does.
+func TestSettingsWritesTakeTheLock(t *testing.T) {
+	dataDir = t.TempDir()
+	app := fiber.New()
+	app.Put("/rules", handleRegistrationRulesPut)
+	app.Put("/fields", handleRegistrationFieldsPut)
+	app.Put("/email-policy", handleEmailPolicyPut)
+
+	for _, step := range []struct{ path, file, body string }{
+		{"/rules", rulesFile(), `[{"id":"x","decision":"hold"}]`},
+		{"/fields", registrationFieldsFile(), `[{"name":"why","label":"Why","type":"text"}]`},
+		{"/email-policy", emailPolicyFile(), `{"deny_domains":["spam.test"]}`},
+	} {
+		unlock, err := lockFile(step.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan int)
+		go func() {
+			code, _ := send(t, app, "PUT", step.path, "", step.body)
+			done <- code
+		}()
+		select {
+		case <-done:
+			t.Fatalf("%s wrote while the file was locked", step.path)
+		case <-time.After(100 * time.Millisecond):
+		}
+		unlock()
+		if code := <-done; code != 200 {
+			t.Fatalf("%s: %d", step.path, code)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Without flock only the in-process mutex in lockFile applies.
+func flock(*os.File) error { return nil }
+
+func funlock(*os.File) error { return nil }
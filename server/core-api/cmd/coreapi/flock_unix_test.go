@@ -0,0 +1,48 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// An flock held through a separate open file stands in for another
+// process: lockFile must wait for it.
+func TestLockFileWaitsForOtherProcess(t *testing.T) {
+	dataDir = t.TempDir()
+	path := filepath.Join(dataDir, "users.json")
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := lockFile(path)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		close(acquired)
+		unlock()
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while another holder had it")
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	select {
+	case <-acquired:
+	case <-time.After(2 * time.Second):
+		t.Fatal("lock not acquired after release")
+	}
+}
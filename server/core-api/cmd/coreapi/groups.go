@@ -0,0 +1,510 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Group is a team. Users list the groups they belong to directly
+// (User.Groups); a group with a Parent is nested in it, so its members
+// also belong to the parent and every group above. Group names, not IDs,
+// are what other systems see: Authelia groups, the groups in tokens and in
+// forward-auth headers. A group may also carry a TeamSpeak server group
+// and the VPN subnets its members may reach.
+type Group struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description,omitempty"`
+	Parent         string    `json:"parent,omitempty"` // group ID
+	TeamSpeakGroup string    `json:"teamspeak_group,omitempty"`
+	VPNSubnets     []string  `json:"vpn_subnets,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Group names end up in Authelia, HTTP headers and the comma-separated
+// group list of tokens, so they are kept to a safe alphabet.
+var groupNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+func groupsFile() string {
+	return filepath.Join(dataDir, "groups.json")
+}
+
+func loadGroups() ([]Group, error) {
+	var groups []Group
+	if err := readJSON(groupsFile(), &groups); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// validate checks g against the other groups: a unique, well-formed name,
+// an existing parent that does not make a cycle, and valid subnets.
+func (g *Group) validate(groups []Group) error {
+	g.Name = strings.ToLower(strings.TrimSpace(g.Name))
+	if !groupNamePattern.MatchString(g.Name) {
+		return fiber.NewError(fiber.StatusBadRequest, "group name must be lowercase letters, digits, - or _")
+	}
+	if g.Name == autheliaAdminGroup {
+		return fiber.NewError(fiber.StatusBadRequest, "group name "+autheliaAdminGroup+" is reserved for the admin role")
+	}
+	byID := map[string]Group{}
+	for _, other := range groups {
+		if other.ID == g.ID {
+			continue
+		}
+		if other.Name == g.Name {
+			return fiber.NewError(fiber.StatusConflict, "group "+g.Name+" already exists")
+		}
+		byID[other.ID] = other
+	}
+	for p := g.Parent; p != ""; p = byID[p].Parent {
+		if p == g.ID {
+			return fiber.NewError(fiber.StatusBadRequest, "parent would make a cycle")
+		}
+		if _, ok := byID[p]; !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "parent group not found")
+		}
+	}
+	for _, cidr := range g.VPNSubnets {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid vpn subnet "+cidr)
+		}
+	}
+	return nil
+}
+
+// memberOf returns the groups u belongs to, directly or through nesting,
+// by name.
+func memberOf(u *User, groups []Group) []Group {
+	byID := make(map[string]Group, len(groups))
+	for _, g := range groups {
+		byID[g.ID] = g
+	}
+	seen := map[string]bool{}
+	var out []Group
+	for _, id := range u.Groups {
+		for g, ok := byID[id]; ok && !seen[g.ID]; g, ok = byID[g.Parent] {
+			seen[g.ID] = true
+			out = append(out, g)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// userAccess is what a user's groups grant, as exposed to the other
+// subsystems.
+type userAccess struct {
+	UserID          string   `json:"user_id"`
+	Direct          []string `json:"direct"` // group names
+	Groups          []string `json:"groups"` // with the groups they are nested in
+	TeamSpeakGroups []string `json:"teamspeak_groups"`
+	VPNSubnets      []string `json:"vpn_subnets"`
+}
+
+func accessOf(u *User, groups []Group) userAccess {
+	a := userAccess{UserID: u.ID, Direct: []string{}, Groups: []string{}, TeamSpeakGroups: []string{}, VPNSubnets: []string{}}
+	for _, g := range groups {
+		if slices.Contains(u.Groups, g.ID) {
+			a.Direct = append(a.Direct, g.Name)
+		}
+	}
+	sort.Strings(a.Direct)
+	for _, g := range memberOf(u, groups) {
+		a.Groups = append(a.Groups, g.Name)
+		if g.TeamSpeakGroup != "" && !slices.Contains(a.TeamSpeakGroups, g.TeamSpeakGroup) {
+			a.TeamSpeakGroups = append(a.TeamSpeakGroups, g.TeamSpeakGroup)
+		}
+		for _, s := range g.VPNSubnets {
+			if !slices.Contains(a.VPNSubnets, s) {
+				a.VPNSubnets = append(a.VPNSubnets, s)
+			}
+		}
+	}
+	return a
+}
+
+// groupNamesOf lists the names u's token and forward-auth headers carry:
+// its groups, plus autheliaAdminGroup for admins.
+func groupNamesOf(u *User) ([]string, error) {
+	groups, err := loadGroups()
+	if err != nil {
+		return nil, err
+	}
+	names := accessOf(u, groups).Groups
+	if u.Role == "admin" {
+		names = append([]string{autheliaAdminGroup}, names...)
+	}
+	return names, nil
+}
+
+// syncGroupAccess pushes the group memberships of the given users out to
+// Authelia and TeamSpeak. retired names groups that were renamed or
+// deleted, so Authelia entries drop them. Failures are logged: the
+// membership itself is already stored and the next sync retries.
+func syncGroupAccess(userIDs []string, retired ...string) {
+	if len(userIDs) == 0 {
+		return
+	}
+	users, err := store.Users.List()
+	if err != nil {
+		log.Printf("groups: sync: %v", err)
+		return
+	}
+	groups, err := loadGroups()
+	if err != nil {
+		log.Printf("groups: sync: %v", err)
+		return
+	}
+	affected := slices.DeleteFunc(users, func(u User) bool { return !slices.Contains(userIDs, u.ID) })
+	if _, err := syncAutheliaUsers(affected, groups, retired...); err != nil {
+		log.Printf("authelia: syncing groups: %v", err)
+	}
+	for i := range affected {
+		if err := syncTeamSpeakGroup(&affected[i], groups); err != nil {
+			log.Printf("teamspeak: syncing %s: %v", affected[i].ID, err)
+		}
+	}
+}
+
+// syncTeamSpeakGroup sets the server group of u's TeamSpeak account to the
+// first one its groups grant. A server group set by hand, one no group
+// manages, is left alone.
+func syncTeamSpeakGroup(u *User, groups []Group) error {
+	managed := map[string]bool{"": true}
+	for _, g := range groups {
+		managed[g.TeamSpeakGroup] = true
+	}
+	want := ""
+	if granted := accessOf(u, groups).TeamSpeakGroups; len(granted) > 0 {
+		want = granted[0]
+	}
+	account, err := teamSpeakAccountOf(u.ID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil
+		}
+		return err
+	}
+	_, err = store.TeamSpeakUsers.Update(account.ID, func(ts *TeamSpeakUser) error {
+		if ts.Group == want || !managed[ts.Group] {
+			return errUnchanged
+		}
+		ts.Group = want
+		return nil
+	})
+	if errors.Is(err, errNotFound) || errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+// membersOf returns the IDs of the users in group id, directly or, with
+// nested, through a subgroup.
+func membersOf(id string, users []User, groups []Group, nested bool) []string {
+	var ids []string
+	for i := range users {
+		in := slices.Contains(users[i].Groups, id)
+		if !in && nested {
+			in = slices.ContainsFunc(memberOf(&users[i], groups), func(g Group) bool { return g.ID == id })
+		}
+		if in {
+			ids = append(ids, users[i].ID)
+		}
+	}
+	return ids
+}
+
+var groupListSpec = listSpec[Group]{
+	id: func(g *Group) string { return g.ID },
+	sorts: map[string]func(*Group) string{
+		"name":       func(g *Group) string { return g.Name },
+		"created_at": func(g *Group) string { return timeKey(g.CreatedAt) },
+	},
+	defaultSort: "name",
+	search:      []func(*Group) string{func(g *Group) string { return g.Name }, func(g *Group) string { return g.Description }},
+	filters: map[string]func(*Group) string{
+		"parent": func(g *Group) string { return g.Parent },
+	},
+	dates: map[string]func(*Group) time.Time{
+		"created": func(g *Group) time.Time { return g.CreatedAt },
+	},
+}
+
+func handleGroupsList(c *fiber.Ctx) error {
+	groups, err := loadGroups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load groups")
+	}
+	page, err := paginate(c, groups, groupListSpec)
+	if err != nil {
+		return err
+	}
+	return c.JSON(page)
+}
+
+func handleGroupGet(c *fiber.Ctx) error {
+	groups, err := loadGroups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load groups")
+	}
+	i := slices.IndexFunc(groups, func(g Group) bool { return g.ID == c.Params("id") })
+	if i < 0 {
+		return fiber.NewError(fiber.StatusNotFound, "group not found")
+	}
+	subgroups := []string{}
+	for _, g := range groups {
+		if g.Parent == groups[i].ID {
+			subgroups = append(subgroups, g.ID)
+		}
+	}
+	return c.JSON(fiber.Map{"group": groups[i], "subgroups": subgroups})
+}
+
+func handleGroupCreate(c *fiber.Ctx) error {
+	var req Group
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	now := time.Now().UTC()
+	req.ID, req.CreatedAt, req.UpdatedAt = generateID(), now, now
+	var groups []Group
+	err := updateJSON(groupsFile(), &groups, func() error {
+		if err := req.validate(groups); err != nil {
+			return err
+		}
+		groups = append(groups, req)
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "group not found")
+	}
+	recordAudit(c, "group.create", req.ID, req.Name)
+	return c.Status(fiber.StatusCreated).JSON(req)
+}
+
+func handleGroupUpdate(c *fiber.Ctx) error {
+	var req Group
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	var groups []Group
+	var before, after Group
+	err := updateJSON(groupsFile(), &groups, func() error {
+		i := slices.IndexFunc(groups, func(g Group) bool { return g.ID == c.Params("id") })
+		if i < 0 {
+			return errNotFound
+		}
+		before = groups[i]
+		req.ID, req.CreatedAt, req.UpdatedAt = before.ID, before.CreatedAt, time.Now().UTC()
+		if err := req.validate(groups); err != nil {
+			return err
+		}
+		groups[i], after = req, req
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "group not found")
+	}
+	recordAudit(c, "group.update", after.ID, after.Name)
+
+	// Nesting, names and grants all change what members get.
+	users, err := store.Users.List()
+	if err == nil {
+		var retired []string
+		if before.Name != after.Name {
+			retired = append(retired, before.Name)
+		}
+		syncGroupAccess(membersOf(after.ID, users, groups, true), retired...)
+	}
+	return c.JSON(after)
+}
+
+// handleGroupDelete removes a group and every membership of it. A group
+// with subgroups must be emptied of them first.
+func handleGroupDelete(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var groups []Group
+	var deleted Group
+	var members []string
+	err := updateJSON(groupsFile(), &groups, func() error {
+		i := slices.IndexFunc(groups, func(g Group) bool { return g.ID == id })
+		if i < 0 {
+			return errNotFound
+		}
+		if slices.ContainsFunc(groups, func(g Group) bool { return g.Parent == id }) {
+			return fiber.NewError(fiber.StatusConflict, "group has subgroups")
+		}
+		users, err := store.Users.List()
+		if err != nil {
+			return err
+		}
+		// Members of the group, not only direct ones, lose it.
+		members = membersOf(id, users, groups, true)
+		deleted = groups[i]
+		groups = slices.Delete(groups, i, i+1)
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "group not found")
+	}
+	err = store.Users.Mutate(func(users []User) ([]User, error) {
+		changed := false
+		for i := range users {
+			if j := slices.Index(users[i].Groups, id); j >= 0 {
+				users[i].Groups = slices.Delete(users[i].Groups, j, j+1)
+				changed = true
+			}
+		}
+		if !changed {
+			return nil, errUnchanged
+		}
+		return users, nil
+	})
+	if err != nil && !errors.Is(err, errUnchanged) {
+		return storeError(err, "user not found")
+	}
+	recordAudit(c, "group.delete", id, deleted.Name)
+	syncGroupAccess(members, deleted.Name)
+	return c.JSON(fiber.Map{"ok": true, "members_removed": len(members)})
+}
+
+// handleGroupMembers lists the group's members as a page of users;
+// nested=true includes the members of its subgroups.
+func handleGroupMembers(c *fiber.Ctx) error {
+	groups, err := loadGroups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load groups")
+	}
+	id := c.Params("id")
+	if !slices.ContainsFunc(groups, func(g Group) bool { return g.ID == id }) {
+		return fiber.NewError(fiber.StatusNotFound, "group not found")
+	}
+	users, err := store.Users.List()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+	}
+	ids := membersOf(id, users, groups, c.QueryBool("nested"))
+	members := slices.DeleteFunc(users, func(u User) bool { return !slices.Contains(ids, u.ID) })
+	page, err := paginate(c, members, userListSpec)
+	if err != nil {
+		return err
+	}
+	for i := range page.Items {
+		hidePassword(&page.Items[i])
+		redactUser(&page.Items[i])
+	}
+	return c.JSON(page)
+}
+
+func handleGroupMemberAdd(c *fiber.Ctx) error {
+	return setGroupMember(c, true)
+}
+
+func handleGroupMemberRemove(c *fiber.Ctx) error {
+	return setGroupMember(c, false)
+}
+
+func setGroupMember(c *fiber.Ctx, member bool) error {
+	groupID, userID := c.Params("id"), c.Params("user_id")
+	groups, err := loadGroups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load groups")
+	}
+	if member && !slices.ContainsFunc(groups, func(g Group) bool { return g.ID == groupID }) {
+		return fiber.NewError(fiber.StatusNotFound, "group not found")
+	}
+	u, err := store.Users.Update(userID, func(u *User) error {
+		i := slices.Index(u.Groups, groupID)
+		switch {
+		case member && i < 0:
+			u.Groups = append(u.Groups, groupID)
+		case !member && i >= 0:
+			u.Groups = slices.Delete(u.Groups, i, i+1)
+		default:
+			return errUnchanged
+		}
+		u.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	switch {
+	case errors.Is(err, errUnchanged):
+		if u, err = store.Users.Get(userID); err != nil {
+			return storeError(err, "user not found")
+		}
+	case err != nil:
+		return storeError(err, "user not found")
+	default:
+		action := "group.member.remove"
+		if member {
+			action = "group.member.add"
+		}
+		recordAudit(c, action, groupID, userID)
+		syncGroupAccess([]string{userID})
+	}
+	return c.JSON(accessOf(&u, groups))
+}
+
+// handleUserGroups shows what a user's groups grant.
+func handleUserGroups(c *fiber.Ctx) error {
+	u, err := store.Users.Get(c.Params("id"))
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	groups, err := loadGroups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load groups")
+	}
+	return c.JSON(accessOf(&u, groups))
+}
+
+// handleVPNPolicy tells the VPN provisioner which subnets a user's peer
+// may reach. An empty list means the server's default.
+func handleVPNPolicy(c *fiber.Ctx) error {
+	u, err := store.Users.Get(c.Params("user_id"))
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	groups, err := loadGroups()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load groups")
+	}
+	a := accessOf(&u, groups)
+	enabled := u.Status == statusActive && u.VPNConfig != nil && u.VPNConfig.Enabled
+	return c.JSON(fiber.Map{"user_id": u.ID, "enabled": enabled, "groups": a.Groups, "allowed_subnets": a.VPNSubnets})
+}
+
+// handleForwardAuth answers a reverse proxy's forward-auth subrequest. A
+// valid session gets 200 with Remote-User, Remote-Email and Remote-Groups
+// (the headers Authelia sets), anything else 401. ?group=a,b also requires
+// membership of one of the groups, or 403.
+func handleForwardAuth(c *fiber.Ctx) error {
+	u, err := requireCaller(c)
+	if err != nil {
+		return err
+	}
+	names, err := groupNamesOf(u)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load groups")
+	}
+	if want := c.Query("group"); want != "" {
+		if !slices.ContainsFunc(strings.Split(want, ","), func(g string) bool { return slices.Contains(names, strings.TrimSpace(g)) }) {
+			return fiber.NewError(fiber.StatusForbidden, "not a member of "+want)
+		}
+	}
+	c.Set("Remote-User", firstNonEmpty(u.Username, u.Email))
+	c.Set("Remote-Email", u.Email)
+	c.Set("Remote-Groups", strings.Join(names, ","))
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func createGroup(t *testing.T, app *fiber.App, token, body string) string {
+	t.Helper()
+	code, out := send(t, app, "POST", "/api/admin/groups", token, body)
+	if code != fiber.StatusCreated {
+		t.Fatalf("create group %s: %d %v", body, code, out)
+	}
+	return out["id"].(string)
+}
+
+func userAccessOf(t *testing.T, app *fiber.App, token, id string) userAccess {
+	t.Helper()
+	var a userAccess
+	sendFor(t, app, "GET", "/api/users/"+id+"/groups", token, "", &a)
+	return a
+}
+
+func TestGroupNesting(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "u1", Email: "ola@example.org", Role: "user", Status: statusActive})
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	app, admin := testApp(), tokenFor(t, "a1")
+
+	staff := createGroup(t, app, admin, `{"name":"Staff","vpn_subnets":["10.10.0.0/16"]}`)
+	ops := createGroup(t, app, admin, `{"name":"ops","parent":"`+staff+`","teamspeak_group":"Operators","vpn_subnets":["10.20.0.0/24"]}`)
+	for body, want := range map[string]int{
+		`{"name":"staff"}`:                      fiber.StatusConflict,
+		`{"name":"admins"}`:                     fiber.StatusBadRequest,
+		`{"name":"no spaces"}`:                  fiber.StatusBadRequest,
+		`{"name":"x","parent":"ghost"}`:         fiber.StatusBadRequest,
+		`{"name":"x","vpn_subnets":["10.0.0"]}`: fiber.StatusBadRequest,
+	} {
+		if code, _ := send(t, app, "POST", "/api/admin/groups", admin, body); code != want {
+			t.Fatalf("create %s: %d, want %d", body, code, want)
+		}
+	}
+	if code, _ := send(t, app, "PUT", "/api/admin/groups/"+staff, admin, `{"name":"staff","parent":"`+ops+`"}`); code != fiber.StatusBadRequest {
+		t.Fatalf("cycle: %d", code)
+	}
+
+	if code, _ := send(t, app, "PUT", "/api/admin/groups/"+ops+"/members/u1", admin, ``); code != 200 {
+		t.Fatalf("add member: %d", code)
+	}
+	a := userAccessOf(t, app, admin, "u1")
+	if !slices.Equal(a.Direct, []string{"ops"}) || !slices.Equal(a.Groups, []string{"ops", "staff"}) ||
+		!slices.Equal(a.TeamSpeakGroups, []string{"Operators"}) || len(a.VPNSubnets) != 2 {
+		t.Fatalf("access: %+v", a)
+	}
+	for query, want := range map[string]int{"": 0, "?nested=true": 1} {
+		var page listPage[User]
+		sendFor(t, app, "GET", "/api/admin/groups/"+staff+"/members"+query, admin, "", &page)
+		if page.Total != want {
+			t.Fatalf("staff members%s: %d, want %d", query, page.Total, want)
+		}
+	}
+
+	if code, _ := send(t, app, "DELETE", "/api/admin/groups/"+staff, admin, ``); code != fiber.StatusConflict {
+		t.Fatalf("delete group with subgroups: %d", code)
+	}
+	if code, _ := send(t, app, "DELETE", "/api/admin/groups/"+ops, admin, ``); code != 200 {
+		t.Fatalf("delete group: %d", code)
+	}
+	if u, _ := store.Users.Get("u1"); len(u.Groups) != 0 {
+		t.Fatalf("membership survived the group: %v", u.Groups)
+	}
+	if code, _ := send(t, app, "PUT", "/api/admin/groups/"+ops+"/members/u1", admin, ``); code != fiber.StatusNotFound {
+		t.Fatalf("join deleted group: %d", code)
+	}
+}
+
+func TestGroupAccessPropagates(t *testing.T) {
+	dataDir = t.TempDir()
+	prevAuthelia := autheliaUsers
+	autheliaUsers = filepath.Join(t.TempDir(), "users_database.yml")
+	t.Cleanup(func() { autheliaUsers = prevAuthelia })
+	_ = os.WriteFile(autheliaUsers, []byte(`users:
+  ola:
+    email: ola@example.org
+    groups:
+      - users
+`), 0o600)
+	u := User{ID: "u1", Email: "ola@example.org", Username: "ola", Role: "user", Status: statusActive}
+	_ = store.Users.Create(u)
+	createTeamSpeakAccount(t, "u1", "ola")
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	app, admin := testApp(), tokenFor(t, "a1")
+
+	dev := createGroup(t, app, admin, `{"name":"dev","teamspeak_group":"Developers"}`)
+	if code, _ := send(t, app, "PUT", "/api/admin/groups/"+dev+"/members/u1", admin, ``); code != 200 {
+		t.Fatalf("add member: %d", code)
+	}
+	raw, _ := os.ReadFile(autheliaUsers)
+	if !strings.Contains(string(raw), "- dev") || !strings.Contains(string(raw), "- users") {
+		t.Fatalf("authelia after join:\n%s", raw)
+	}
+	if ts, _ := teamSpeakAccountOf("u1"); ts.Group != "Developers" {
+		t.Fatalf("teamspeak group: %q", ts.Group)
+	}
+	// An account linked later starts in the granted server group.
+	_ = store.Users.Create(User{ID: "u2", Email: "ela@example.org", Username: "ela", Role: "user", Status: statusActive, Groups: []string{dev}})
+	createTeamSpeakAccount(t, "u2", "ela")
+	if ts, _ := teamSpeakAccountOf("u2"); ts.Group != "Developers" {
+		t.Fatalf("teamspeak group of a new account: %q", ts.Group)
+	}
+
+	u, _ = store.Users.Get("u1")
+	token, err := generateJWT(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(token)
+	if !strings.Contains(string(payload), ":dev:") {
+		t.Fatalf("token payload %q has no groups", payload)
+	}
+	verify := func(query string) (int, string) {
+		req := httptest.NewRequest("GET", "/api/auth/verify"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Remote-Groups")
+	}
+	if code, groups := verify(""); code != 200 || groups != "dev" {
+		t.Fatalf("verify: %d %q", code, groups)
+	}
+	if code, _ := verify("?group=ops,dev"); code != 200 {
+		t.Fatalf("verify member: %d", code)
+	}
+	if code, _ := verify("?group=ops"); code != fiber.StatusForbidden {
+		t.Fatalf("verify non-member: %d", code)
+	}
+	if code, _ := send(t, app, "GET", "/api/auth/verify", "", ""); code != fiber.StatusUnauthorized {
+		t.Fatalf("verify without session: %d", code)
+	}
+
+	// A rename moves the Authelia group along; leaving drops it.
+	if code, _ := send(t, app, "PUT", "/api/admin/groups/"+dev, admin, `{"name":"developers","teamspeak_group":"Developers"}`); code != 200 {
+		t.Fatalf("rename: %d", code)
+	}
+	raw, _ = os.ReadFile(autheliaUsers)
+	if strings.Contains(string(raw), "- dev\n") || !strings.Contains(string(raw), "- developers") {
+		t.Fatalf("authelia after rename:\n%s", raw)
+	}
+	if code, _ := send(t, app, "DELETE", "/api/admin/groups/"+dev+"/members/u1", admin, ``); code != 200 {
+		t.Fatalf("remove member: %d", code)
+	}
+	raw, _ = os.ReadFile(autheliaUsers)
+	if strings.Contains(string(raw), "developers") || !strings.Contains(string(raw), "- users") {
+		t.Fatalf("authelia after leaving:\n%s", raw)
+	}
+	if ts, _ := teamSpeakAccountOf("u1"); ts.Group != "" {
+		t.Fatalf("teamspeak group after leaving: %q", ts.Group)
+	}
+}
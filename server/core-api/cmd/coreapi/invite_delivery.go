@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Invite delivery states.
+const (
+	deliverySent   = "sent"
+	deliveryFailed = "failed"
+)
+
+var publicBaseURL = strings.TrimRight(envOr("PUBLIC_BASE_URL", ""), "/")
+
+// inviteSigningKey signs invite links; main sets it from
+// loadInviteSigningKey.
+var inviteSigningKey []byte
+
+func inviteKeyFile() string {
+	return filepath.Join(dataDir, "invite_key.json")
+}
+
+// loadInviteSigningKey prefers a dedicated key, falls back to JWT_SECRET and
+// finally to a random key generated once and kept in invite_key.json, so
+// links already sent keep verifying after a restart.
+func loadInviteSigningKey() ([]byte, error) {
+	if k := envOr("INVITE_SIGNING_KEY", envOr("JWT_SECRET", "")); k != "" {
+		return []byte(k), nil
+	}
+	var stored struct {
+		Key       string    `json:"key"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	err := updateJSON(inviteKeyFile(), &stored, func() error {
+		if stored.Key != "" {
+			return errUnchanged
+		}
+		k, err := randomToken(32)
+		if err != nil {
+			return err
+		}
+		stored.Key, stored.CreatedAt = k, time.Now().UTC()
+		log.Printf("INVITE_SIGNING_KEY not set; generated one in %s", inviteKeyFile())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invite signing key: %w", err)
+	}
+	return []byte(stored.Key), nil
+}
+
+// signInvite binds the token to the email it was issued for, so neither can
+// be swapped in a shared link.
+func signInvite(token, email string) string {
+	mac := hmac.New(sha256.New, inviteSigningKey)
+	mac.Write([]byte(token + "\n" + strings.ToLower(email)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func verifyInviteSignature(inv Invite, sig string) bool {
+	return hmac.Equal([]byte(signInvite(inv.Token, inv.Email)), []byte(sig))
+}
+
+// inviteURL returns the signed sign-up link for inv, or "" when no public
+// base URL is configured.
+func inviteURL(inv Invite) string {
+	if publicBaseURL == "" {
+		return ""
+	}
+	q := url.Values{}
+	q.Set("invite", inv.Token)
+	q.Set("sig", signInvite(inv.Token, inv.Email))
+	if inv.Email != "" {
+		q.Set("email", inv.Email)
+	}
+	return publicBaseURL + "/register?" + q.Encode()
+}
+
+// sendInvite emails inv and then stores the delivery outcome. The mail goes
+// out after the invite is saved and outside the invites lock, so a slow
+// relay holds up no other invite write.
+func sendInvite(inv *Invite) error {
+	deliverInvite(inv)
+	_, err := store.Invites.Update(inv.Token, func(stored *Invite) error {
+		stored.DeliveryStatus = inv.DeliveryStatus
+		stored.DeliveryError = inv.DeliveryError
+		stored.DeliveredAt = inv.DeliveredAt
+		return nil
+	})
+	return err
+}
+
+// deliverInvite emails the invite link and records the outcome on inv.
+func deliverInvite(inv *Invite) {
+	link := inviteURL(*inv)
+	if inv.Email == "" || link == "" {
+		inv.DeliveryStatus = deliveryFailed
+		inv.DeliveryError = "invite has no email address or PUBLIC_BASE_URL is not set"
+		return
+	}
+	body := "You have been invited to join Safe-Spac.\n\nRegister here: " + link +
+		"\n\nThe invitation expires on " + inv.ExpiresAt.Format(time.RFC1123) + "."
+	if err := notifier.Notify(inv.Email, "Your Safe-Spac invitation", body); err != nil {
+		inv.DeliveryStatus = deliveryFailed
+		inv.DeliveryError = err.Error()
+		log.Printf("invite delivery to %s failed: %v", inv.Email, err)
+		return
+	}
+	now := time.Now().UTC()
+	inv.DeliveryStatus = deliverySent
+	inv.DeliveryError = ""
+	inv.DeliveredAt = &now
+}
+
+// handleInviteQR renders the invite link as a PNG QR code.
+func handleInviteQR(c *fiber.Ctx) error {
+	inv, err := store.Invites.Get(c.Params("token"))
+	if err != nil {
+		return storeError(err, "invite not found")
+	}
+	link := inviteURL(inv)
+	if link == "" {
+		return fiber.NewError(fiber.StatusConflict, "PUBLIC_BASE_URL is not configured")
+	}
+	size := c.QueryInt("size", 256)
+	if size < 64 || size > 1024 {
+		size = 256
+	}
+	png, err := qrcode.Encode(link, qrcode.Medium, size)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "qr encoding failed")
+	}
+	c.Set(fiber.HeaderContentType, "image/png")
+	return c.Send(png)
+}
+
+// handleInviteSend (re)sends an invite by email.
+func handleInviteSend(c *fiber.Ctx) error {
+	inv, err := store.Invites.Get(c.Params("token"))
+	if err != nil {
+		return storeError(err, "invite not found")
+	}
+	if inv.Used {
+		return fiber.NewError(fiber.StatusConflict, "invite already used")
+	}
+	if err := sendInvite(&inv); err != nil {
+		return storeError(err, "invite not found")
+	}
+	return c.JSON(fiber.Map{
+		"ok":              inv.DeliveryStatus == deliverySent,
+		"delivery_status": inv.DeliveryStatus,
+		"delivery_error":  inv.DeliveryError,
+	})
+}
+
+// handleInviteCheck lets the sign-up page validate a link before showing
+// the form. The signature is checked first so the endpoint cannot be used
+// to probe for tokens.
+func handleInviteCheck(c *fiber.Ctx) error {
+	inv, err := store.Invites.Get(c.Params("token"))
+	if err != nil && !errors.Is(err, errNotFound) {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load invites")
+	}
+	if err != nil || !verifyInviteSignature(inv, c.Query("sig")) {
+		return fiber.NewError(fiber.StatusNotFound, "invalid invite link")
+	}
+	if inv.Used || time.Now().After(inv.ExpiresAt) {
+		return fiber.NewError(fiber.StatusGone, "invite expired or already used")
+	}
+	return c.JSON(fiber.Map{"ok": true, "email": inv.Email, "expires_at": inv.ExpiresAt})
+}
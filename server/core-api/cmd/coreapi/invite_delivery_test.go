@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type failingNotifier struct{}
+
+func (failingNotifier) Notify(to, subject, body string) error {
+	return errors.New("relay down")
+}
+
+func TestInviteDelivery(t *testing.T) {
+	dataDir = t.TempDir()
+	publicBaseURL = "https://vpn.example.org"
+	defer func() { publicBaseURL = "" }()
+	rec := &recordingNotifier{}
+	notifier = rec
+	defer func() { notifier = logNotifier{} }()
+
+	app := fiber.New()
+	app.Post("/invites", handleInviteCreate)
+	app.Get("/invites/:token/qr", handleInviteQR)
+	app.Post("/invites/:token/send", handleInviteSend)
+	app.Get("/check/:token", handleInviteCheck)
+	app.Post("/register", handleRegistrationSubmit)
+
+	req := httptest.NewRequest("POST", "/invites", strings.NewReader(`{"email":"guest@example.org","send_email":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("create failed: %v", err)
+	}
+	var out struct {
+		Token          string `json:"token"`
+		URL            string `json:"url"`
+		DeliveryStatus string `json:"delivery_status"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if !strings.HasPrefix(out.URL, "https://vpn.example.org/register?") || out.DeliveryStatus != deliverySent {
+		t.Fatalf("unexpected invite response: %+v", out)
+	}
+	if len(rec.sent) != 1 || !strings.Contains(rec.sent[0], out.URL) {
+		t.Fatalf("invite mail missing link: %v", rec.sent)
+	}
+
+	u, _ := url.Parse(out.URL)
+	sig := u.Query().Get("sig")
+	resp, _ = app.Test(httptest.NewRequest("GET", "/check/"+out.Token+"?sig="+sig, nil))
+	if resp.StatusCode != 200 {
+		t.Fatalf("valid link rejected: %d", resp.StatusCode)
+	}
+	resp, _ = app.Test(httptest.NewRequest("GET", "/check/"+out.Token+"?sig=forged", nil))
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("forged signature accepted: %d", resp.StatusCode)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest("GET", "/invites/"+out.Token+"/qr", nil))
+	png, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || !bytes.HasPrefix(png, []byte("\x89PNG")) {
+		t.Fatalf("qr code not rendered: %d", resp.StatusCode)
+	}
+
+	notifier = failingNotifier{}
+	resp, _ = app.Test(httptest.NewRequest("POST", "/invites/"+out.Token+"/send", nil))
+	invites, _ := store.Invites.List()
+	if resp.StatusCode != 200 || invites[0].DeliveryStatus != deliveryFailed || invites[0].DeliveryError == "" {
+		t.Fatalf("failed delivery not tracked: %+v", invites[0])
+	}
+
+	for _, body := range []string{
+		`{"email":"someone@else.org","invite_token":"` + out.Token + `","invite_sig":"` + sig + `"}`,
+		`{"email":"guest@example.org","invite_token":"` + out.Token + `"}`,
+		`{"email":"guest@example.org","invite_token":"` + out.Token + `","invite_sig":"forged"}`,
+	} {
+		if code, _ := send(t, app, "POST", "/register", "", body); code != fiber.StatusForbidden {
+			t.Fatalf("redeemed %s: %d", body, code)
+		}
+	}
+	if code, _ := send(t, app, "POST", "/register", "", `{"email":"guest@example.org","invite_token":"`+out.Token+`","invite_sig":"`+sig+`"}`); code != 200 {
+		t.Fatalf("signed invite refused: %d", code)
+	}
+}
+
+// lockCheckingNotifier fails the test if the invite being mailed is not
+// stored yet, or if the invites lock is still held while mail goes out.
+type lockCheckingNotifier struct{ t *testing.T }
+
+func (n lockCheckingNotifier) Notify(to, subject, body string) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Invites.Mutate(func(list []Invite) ([]Invite, error) {
+			if !slices.ContainsFunc(list, func(inv Invite) bool { return inv.Email == to }) {
+				return nil, errors.New("invite mailed before it was saved")
+			}
+			return nil, errUnchanged
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil && !errors.Is(err, errUnchanged) {
+			n.t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		n.t.Error("invites lock held during delivery")
+	}
+	return nil
+}
+
+func TestInviteMailedAfterSave(t *testing.T) {
+	dataDir = t.TempDir()
+	publicBaseURL = "https://vpn.example.org"
+	defer func() { publicBaseURL = "" }()
+	notifier = lockCheckingNotifier{t}
+	defer func() { notifier = logNotifier{} }()
+
+	app := fiber.New()
+	app.Post("/invites", handleInviteCreate)
+	app.Post("/invites/:token/send", handleInviteSend)
+	code, out := send(t, app, "POST", "/invites", "", `{"email":"guest@example.org","send_email":true}`)
+	if code != 200 || out["delivery_status"] != deliverySent {
+		t.Fatalf("create: %d %v", code, out)
+	}
+	if code, _ := send(t, app, "POST", "/invites/"+out["token"].(string)+"/send", "", ""); code != 200 {
+		t.Fatalf("resend: %d", code)
+	}
+	if inv, _ := store.Invites.Get(out["token"].(string)); inv.DeliveryStatus != deliverySent || inv.DeliveredAt == nil {
+		t.Fatalf("delivery not recorded: %+v", inv)
+	}
+}
+
+func TestSMTPTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept and never greet, like a relay that has stopped answering.
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	n := smtpNotifier{addr: ln.Addr().String(), host: "127.0.0.1", from: "safe-spac@localhost", timeout: 200 * time.Millisecond}
+	start := time.Now()
+	if err := n.Notify("guest@example.org", "hello", "body"); err == nil {
+		t.Fatal("silent relay reported as delivered")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("notify blocked for %s", took)
+	}
+}
+
+func TestInviteSigningKeyPersisted(t *testing.T) {
+	dataDir = t.TempDir()
+	t.Setenv("INVITE_SIGNING_KEY", "")
+	t.Setenv("JWT_SECRET", "")
+	first, err := loadInviteSigningKey()
+	if err != nil || len(first) == 0 {
+		t.Fatalf("generate: %q %v", first, err)
+	}
+	// A restart reads the same key back, so sent links keep verifying.
+	again, err := loadInviteSigningKey()
+	if err != nil || !bytes.Equal(first, again) {
+		t.Fatalf("key changed across loads: %q %q %v", first, again, err)
+	}
+	t.Setenv("INVITE_SIGNING_KEY", "configured")
+	if k, _ := loadInviteSigningKey(); string(k) != "configured" {
+		t.Fatalf("configured key ignored: %q", k)
+	}
+}
+
+func TestComposeMessageRefusesHeaderInjection(t *testing.T) {
+	for _, c := range []struct{ to, subject string }{
+		{"guest@example.org\r\nBcc: all@example.org", "hello"},
+		{"guest@example.org", "hello\nBcc: all@example.org"},
+		{"not an address", "hello"},
+		{"a@example.org, b@example.org", "hello"},
+	} {
+		if _, _, err := composeMessage("safe-spac@localhost", c.to, c.subject, "body"); err == nil {
+			t.Fatalf("accepted to=%q subject=%q", c.to, c.subject)
+		}
+	}
+	rcpt, msg, err := composeMessage("safe-spac@localhost", "Guest <guest@example.org>", "hello", "line one\r\nline two")
+	if err != nil || rcpt != "guest@example.org" || !strings.Contains(msg, "\r\nTo: guest@example.org\r\n") || !strings.HasSuffix(msg, "line two\r\n") {
+		t.Fatalf("message: %q %q %v", rcpt, msg, err)
+	}
+}
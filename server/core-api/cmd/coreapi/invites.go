@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// memberInviteQuota caps how many invites a non-admin member may create
+// unless an admin sets User.InviteQuota for them.
+var memberInviteQuota = envInt("MEMBER_INVITE_QUOTA", 3)
+
+// inviteAllowsEmail reports whether inv may be redeemed by email. Invites
+// issued without an address can be redeemed by anyone holding the token.
+func inviteAllowsEmail(inv Invite, email string) bool {
+	return inv.Email == "" || strings.EqualFold(strings.TrimSpace(inv.Email), strings.TrimSpace(email))
+}
+
+// findValidInvite returns the invite for token if it exists, has not been
+// redeemed or expired, and may be redeemed by email.
+func findValidInvite(token, email string, now time.Time) (*Invite, error) {
+	if token == "" {
+		return nil, nil
+	}
+	inv, err := store.Invites.Get(token)
+	if errors.Is(err, errNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if inv.Used || now.After(inv.ExpiresAt) || !inviteAllowsEmail(inv, email) {
+		return nil, nil
+	}
+	return &inv, nil
+}
+
+// inviteCreator returns the user ID that created the invite, if known.
+func inviteCreator(token string) string {
+	if token == "" {
+		return ""
+	}
+	inv, err := store.Invites.Get(token)
+	if err != nil {
+		return ""
+	}
+	return inv.CreatedBy
+}
+
+// errInviteUsed is returned when an invite already sponsored another
+// account: one invite, one member.
+var errInviteUsed = fiber.NewError(fiber.StatusConflict, "invite already used")
+
+// markInviteUsed redeems the invite for token on behalf of userID. It fails
+// with errInviteUsed when someone else redeemed it first; unknown tokens
+// are ignored.
+func markInviteUsed(token, userID string) error {
+	if token == "" {
+		return nil
+	}
+	_, err := store.Invites.Update(token, func(inv *Invite) error {
+		if inv.Used {
+			if inv.RedeemedBy == userID {
+				return errUnchanged
+			}
+			return errInviteUsed
+		}
+		inv.Used = true
+		inv.RedeemedBy = userID
+		return nil
+	})
+	if errors.Is(err, errNotFound) || errors.Is(err, errUnchanged) {
+		return nil
+	}
+	return err
+}
+
+// releaseInvite undoes markInviteUsed when the account userID redeemed the
+// invite for could not be created after all.
+func releaseInvite(token, userID string) {
+	if token == "" {
+		return
+	}
+	_, err := store.Invites.Update(token, func(inv *Invite) error {
+		if inv.RedeemedBy != userID {
+			return errUnchanged
+		}
+		inv.Used = false
+		inv.RedeemedBy = ""
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNotFound) && !errors.Is(err, errUnchanged) {
+		log.Printf("invite %s: releasing: %v", token, err)
+	}
+}
+
+// createInvitedUser redeems the user's invite and then stores the user, so
+// a spent invite never sponsors a second account.
+func createInvitedUser(user User) error {
+	if err := markInviteUsed(user.InviteToken, user.ID); err != nil {
+		return err
+	}
+	if err := store.Users.Create(user); err != nil {
+		releaseInvite(user.InviteToken, user.ID)
+		return err
+	}
+	return nil
+}
+
+// createInvite handles both the admin and the member invite endpoints.
+// Members are held to their quota; creator may be nil for anonymous admin
+// calls.
+func createInvite(c *fiber.Ctx, creator *User, enforceQuota bool) error {
+	var req struct {
+		Email     string `json:"email"`
+		ExpiresH  int    `json:"expires_hours"`
+		SendEmail bool   `json:"send_email"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	if req.ExpiresH <= 0 {
+		req.ExpiresH = 72
+	}
+	if req.Email != "" {
+		if err := enforceEmailPolicy(req.Email, c.IP(), "invite"); err != nil {
+			return err
+		}
+	}
+	token, err := randomToken(24)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "token gen failed")
+	}
+	inv := Invite{
+		Token:     token,
+		Email:     req.Email,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: time.Now().UTC().Add(time.Duration(req.ExpiresH) * time.Hour),
+		Used:      false,
+	}
+	if creator != nil {
+		inv.CreatedBy = creator.ID
+	}
+
+	// The quota check and the insert share one locked update so parallel
+	// requests cannot overspend it.
+	err = store.Invites.Mutate(func(list []Invite) ([]Invite, error) {
+		if enforceQuota {
+			if used := countInvitesBy(list, creator.ID); used >= inviteQuotaFor(creator) {
+				return nil, fiber.NewError(fiber.StatusForbidden, "invite quota exhausted")
+			}
+		}
+		return append(list, inv), nil
+	})
+	if err != nil {
+		return storeError(err, "invite not found")
+	}
+	if req.SendEmail {
+		if err := sendInvite(&inv); err != nil {
+			log.Printf("invite %s: recording delivery: %v", inv.Token, err)
+		}
+	}
+	resp := fiber.Map{"ok": true, "token": inv.Token, "sig": signInvite(inv.Token, inv.Email), "expires_at": inv.ExpiresAt}
+	if link := inviteURL(inv); link != "" {
+		resp["url"] = link
+	}
+	if inv.DeliveryStatus != "" {
+		resp["delivery_status"] = inv.DeliveryStatus
+	}
+	return c.JSON(resp)
+}
+
+func inviteQuotaFor(user *User) int {
+	if user.InviteQuota != nil {
+		return *user.InviteQuota
+	}
+	return memberInviteQuota
+}
+
+// countInvitesBy counts the invites a user has spent: redeemed ones and
+// ones still open. Expired unused invites are given back.
+func countInvitesBy(invites []Invite, userID string) int {
+	now := time.Now()
+	n := 0
+	for _, inv := range invites {
+		if inv.CreatedBy == userID && (inv.Used || now.Before(inv.ExpiresAt)) {
+			n++
+		}
+	}
+	return n
+}
+
+func handleMyInviteCreate(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "authentication required")
+	}
+	return createInvite(c, user, user.Role != "admin")
+}
+
+func handleMyInvitesList(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "authentication required")
+	}
+	invites, err := store.Invites.List()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load invites")
+	}
+	mine := []Invite{}
+	for _, inv := range invites {
+		if inv.CreatedBy == user.ID {
+			mine = append(mine, inv)
+		}
+	}
+	quota := -1
+	if user.Role != "admin" {
+		quota = inviteQuotaFor(user)
+	}
+	return c.JSON(fiber.Map{"invites": mine, "quota": quota, "used": countInvitesBy(invites, user.ID)})
+}
+
+func handleInviteQuotaSet(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	var req struct {
+		Quota *int `json:"quota"` // null restores the default
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	if req.Quota != nil && *req.Quota < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "quota must not be negative")
+	}
+	_, err := store.Users.Update(userID, func(u *User) error {
+		u.InviteQuota = req.Quota
+		u.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	recordAudit(c, "user.invite_quota", userID, "")
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+// InviteTreeNode is one member in the who-invited-whom tree.
+type InviteTreeNode struct {
+	UserID      string            `json:"user_id"`
+	Username    string            `json:"username"`
+	Email       string            `json:"email"`
+	Status      string            `json:"status"`
+	InviteToken string            `json:"invite_token,omitempty"`
+	Children    []*InviteTreeNode `json:"children"`
+}
+
+// buildInviteTree links users to their sponsors. Users without a known
+// sponsor become roots.
+func buildInviteTree(users []User) []*InviteTreeNode {
+	nodes := make(map[string]*InviteTreeNode, len(users))
+	for _, u := range users {
+		nodes[u.ID] = &InviteTreeNode{
+			UserID:      u.ID,
+			Username:    u.Username,
+			Email:       u.Email,
+			Status:      u.Status,
+			InviteToken: u.InviteToken,
+			Children:    []*InviteTreeNode{},
+		}
+	}
+	roots := []*InviteTreeNode{}
+	for _, u := range users {
+		if parent, ok := nodes[u.InvitedBy]; ok && u.InvitedBy != u.ID {
+			parent.Children = append(parent.Children, nodes[u.ID])
+		} else {
+			roots = append(roots, nodes[u.ID])
+		}
+	}
+	return roots
+}
+
+// handleInviteTree returns the full invite tree, or the subtree below
+// ?root=<user_id>.
+func handleInviteTree(c *fiber.Ctx) error {
+	users, err := store.Users.List()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+	}
+	roots := buildInviteTree(users)
+	if rootID := c.Query("root"); rootID != "" {
+		if node := findTreeNode(roots, rootID); node != nil {
+			return c.JSON(node)
+		}
+		return fiber.NewError(fiber.StatusNotFound, "user not found")
+	}
+	return c.JSON(roots)
+}
+
+func findTreeNode(nodes []*InviteTreeNode, userID string) *InviteTreeNode {
+	for _, n := range nodes {
+		if n.UserID == userID {
+			return n
+		}
+		if found := findTreeNode(n.Children, userID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// descendants returns the IDs of everyone invited, directly or further
+// down the tree, by userID.
+func descendants(users []User, userID string) []string {
+	children := make(map[string][]string)
+	for _, u := range users {
+		if u.InvitedBy != "" && u.InvitedBy != u.ID {
+			children[u.InvitedBy] = append(children[u.InvitedBy], u.ID)
+		}
+	}
+	var out []string
+	seen := map[string]bool{userID: true}
+	queue := []string{userID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, child := range children[id] {
+			if seen[child] {
+				continue
+			}
+			seen[child] = true
+			out = append(out, child)
+			queue = append(queue, child)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// handleUserSuspend suspends a member and revokes their open invites. With
+// cascade set, everyone below them in the invite tree is flagged for review.
+func handleUserSuspend(c *fiber.Ctx) error {
+	userID := c.Params("id")
+	var req struct {
+		Reason  string `json:"reason"`
+		Cascade bool   `json:"cascade"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+		}
+	}
+	res, err := changeStatus(c, userID, statusSuspended, req.Reason)
+	if err != nil {
+		return err
+	}
+	flagged := []string{}
+	if req.Cascade {
+		err = store.Users.Mutate(func(users []User) ([]User, error) {
+			sponsor := slices.IndexFunc(users, func(u User) bool { return u.ID == userID })
+			if sponsor < 0 {
+				return nil, errUnchanged
+			}
+			reason := "sponsor " + firstNonEmpty(users[sponsor].Username, users[sponsor].Email) + " was suspended: " + req.Reason
+			review := make(map[string]bool)
+			for _, id := range descendants(users, userID) {
+				review[id] = true
+			}
+			now := time.Now().UTC()
+			for i := range users {
+				if review[users[i].ID] {
+					users[i].NeedsReview = true
+					users[i].ReviewReason = reason
+					users[i].UpdatedAt = now
+					flagged = append(flagged, users[i].ID)
+				}
+			}
+			if len(flagged) == 0 {
+				return nil, errUnchanged
+			}
+			return users, nil
+		})
+		if err != nil {
+			return storeError(err, "user not found")
+		}
+	}
+	return c.JSON(fiber.Map{"ok": true, "change": res, "flagged_for_review": flagged, "invites_revoked": res.InvitesRevoked})
+}
+
+// revokeOpenInvites deletes unredeemed invites created by userID.
+func revokeOpenInvites(userID string) (int, error) {
+	revoked := 0
+	err := store.Invites.Mutate(func(invites []Invite) ([]Invite, error) {
+		kept := invites[:0]
+		for _, inv := range invites {
+			if inv.CreatedBy == userID && !inv.Used {
+				revoked++
+				continue
+			}
+			kept = append(kept, inv)
+		}
+		if revoked == 0 {
+			return nil, errUnchanged
+		}
+		return kept, nil
+	})
+	return revoked, err
+}
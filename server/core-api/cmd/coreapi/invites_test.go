@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestInviteQuotaTreeAndSuspendCascade(t *testing.T) {
+	dataDir = t.TempDir()
+	memberInviteQuota = 1
+	defer func() { memberInviteQuota = 3 }()
+
+	sponsor := User{ID: "s", Email: "s@x.org", Username: "sponsor", Role: "user", Status: "active"}
+	if err := writeJSON(filepath.Join(dataDir, "users.json"), []User{sponsor}); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := generateJWT(&sponsor)
+
+	app := fiber.New()
+	app.Post("/invites", handleMyInviteCreate)
+	app.Get("/tree", handleInviteTree)
+	app.Post("/users/:id/suspend", handleUserSuspend)
+	createInvite := func() (int, string) {
+		req := httptest.NewRequest("POST", "/invites", strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out struct {
+			Token string `json:"token"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp.StatusCode, out.Token
+	}
+
+	code, inv := createInvite()
+	if code != 200 || inv == "" {
+		t.Fatalf("member invite failed: %d", code)
+	}
+	if code, _ := createInvite(); code != fiber.StatusForbidden {
+		t.Fatalf("quota not enforced: %d", code)
+	}
+
+	reg := Registration{ID: "r1", Email: "child@x.org", Username: "child", InviteToken: inv, CreatedAt: time.Now().UTC()}
+	child := newUserFromRegistration(reg)
+	if child.InvitedBy != "s" || child.InviteToken != inv {
+		t.Fatalf("user not linked to invite: %+v", child)
+	}
+	if err := store.Users.Create(child); err != nil {
+		t.Fatal(err)
+	}
+	_ = markInviteUsed(inv, child.ID)
+	grandchild := User{ID: "g", Email: "g@x.org", Username: "grandchild", Status: "active", InvitedBy: child.ID}
+	if err := store.Users.Create(grandchild); err != nil {
+		t.Fatal(err)
+	}
+
+	invites, _ := store.Invites.List()
+	if len(invites) != 1 || invites[0].CreatedBy != "s" || invites[0].RedeemedBy != child.ID {
+		t.Fatalf("invite not attributed: %+v", invites)
+	}
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/tree", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roots []*InviteTreeNode
+	if err := json.NewDecoder(resp.Body).Decode(&roots); err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || len(roots[0].Children) != 1 || len(roots[0].Children[0].Children) != 1 {
+		t.Fatalf("unexpected tree: %+v", roots)
+	}
+
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@x.org", Role: "admin", Status: "active"})
+	if code, _ := send(t, app, "POST", "/users/s/suspend", tokenFor(t, "a1"), `{"reason":"abuse","cascade":true}`); code != 200 {
+		t.Fatalf("suspend failed: %d", code)
+	}
+	var users []User
+	_ = readJSON(filepath.Join(dataDir, "users.json"), &users)
+	for _, u := range users {
+		switch u.ID {
+		case "s":
+			if u.Status != "suspended" {
+				t.Fatalf("sponsor not suspended")
+			}
+		case "a1":
+		default:
+			if !u.NeedsReview || !strings.Contains(u.ReviewReason, "abuse") {
+				t.Fatalf("invitee %s not flagged: %+v", u.ID, u)
+			}
+		}
+	}
+}
+
+func TestInviteSponsorsOneAccount(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@x.org", Username: "admin", Role: "admin", Status: "active"})
+	_ = store.Invites.Create(Invite{Token: "inv", CreatedBy: "a1", ExpiresAt: time.Now().Add(time.Hour)})
+	_ = store.Invites.Create(Invite{Token: "old", CreatedBy: "a1", ExpiresAt: time.Now().Add(-time.Hour)})
+	app, admin := testApp(), tokenFor(t, "a1")
+
+	if code, _ := send(t, app, "POST", "/api/auth/register", "", `{"email":"late@x.org","username":"late","invite_token":"old","invite_sig":"`+signInvite("old", "")+`"}`); code != fiber.StatusForbidden {
+		t.Fatalf("expired invite accepted: %d", code)
+	}
+
+	// Registrations that arrived while the invite was still open: only the
+	// first approval may redeem it.
+	for _, id := range []string{"r1", "r2", "r3"} {
+		_ = store.Registrations.Create(Registration{ID: id, Email: id + "@x.org", Username: id, InviteToken: "inv", Status: "pending", CreatedAt: time.Now()})
+	}
+	if code, _ := send(t, app, "POST", "/api/admin/registrations/r1/approve", admin, ``); code != 200 {
+		t.Fatalf("first approval: %d", code)
+	}
+	first, _ := store.Users.FindByEmail("r1@x.org")
+	if code, _ := send(t, app, "POST", "/api/admin/registrations/r2/approve", admin, ``); code != fiber.StatusConflict {
+		t.Fatalf("second approval on a used invite: %d", code)
+	}
+	var bulk struct {
+		Results []bulkResult `json:"results"`
+	}
+	if code := sendFor(t, app, "POST", "/api/admin/registrations/bulk", admin, `{"action":"approve","ids":["r3"]}`, &bulk); code != 200 || len(bulk.Results) != 1 || bulk.Results[0].OK {
+		t.Fatalf("bulk approval on a used invite: %d %+v", code, bulk)
+	}
+	if inv, _ := store.Invites.Get("inv"); inv.RedeemedBy != first.ID {
+		t.Fatalf("invite redeemed by %q, want %q", inv.RedeemedBy, first.ID)
+	}
+	if users, _ := store.Users.List(); len(users) != 2 {
+		t.Fatalf("one invite sponsored %d accounts", len(users)-1)
+	}
+	for _, id := range []string{"r2", "r3"} {
+		if reg, err := store.Registrations.Get(id); err != nil || len(reg.Approvals) != 0 {
+			t.Fatalf("registration %s after refused approval: %+v %v", id, reg, err)
+		}
+	}
+}
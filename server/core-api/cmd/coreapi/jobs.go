@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+var (
+	backupInterval = envDuration("BACKUP_INTERVAL", configDuration(appConfig.Data.BackupInterval, 24*time.Hour))
+	backupKeep     = envInt("BACKUP_KEEP", 7)
+)
+
+// registerJobs adds the built-in periodic jobs to s.
+func registerJobs(s *jobScheduler) error {
+	jobs := []Job{
+		{Name: "captcha_cleanup", Spec: "@every 1m", Run: func(context.Context) error {
+			return cleanupExpiredCaptchas()
+		}},
+		{Name: "rejected_cleanup", Spec: "@every 10m", Jitter: time.Minute, Run: func(context.Context) error {
+			return cleanupRejectedRegistrations()
+		}},
+		{Name: "invite_reaper", Spec: "@hourly", Jitter: 5 * time.Minute, Run: func(context.Context) error {
+			_, err := reapExpiredInvites(time.Now().UTC())
+			return err
+		}},
+		{Name: "session_prune", Spec: "@every 15m", Jitter: time.Minute, Run: func(context.Context) error {
+			_, err := pruneExpiredSessions()
+			return err
+		}},
+		{Name: "stale_vpn_peers", Spec: "@every 15m", Jitter: time.Minute, Run: func(context.Context) error {
+			_, err := disableStaleVPNPeers()
+			return err
+		}},
+		{Name: "erasure_requests", Spec: "@hourly", Jitter: 5 * time.Minute, Run: eraseDueRequests},
+		{Name: "backup", Spec: "@every " + backupInterval.String(), Jitter: time.Minute, Run: backupDataFiles},
+	}
+	for _, j := range jobs {
+		if err := s.Add(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reapExpiredInvites deletes unused invites past their expiry. Redeemed
+// invites are kept because the invite tree is built from them.
+func reapExpiredInvites(now time.Time) (int, error) {
+	removed := 0
+	err := store.Invites.Mutate(func(invites []Invite) ([]Invite, error) {
+		kept := invites[:0]
+		for _, inv := range invites {
+			if inv.Used || now.Before(inv.ExpiresAt) {
+				kept = append(kept, inv)
+			}
+		}
+		if removed = len(invites) - len(kept); removed == 0 {
+			return nil, errUnchanged
+		}
+		return kept, nil
+	})
+	return removed, err
+}
+
+// disableStaleVPNPeers turns off VPN access for users that are no longer
+// active. An active user's peer without a public key yet is left alone:
+// that is how an admin's enable looks until the key is set.
+func disableStaleVPNPeers() (int, error) {
+	now := time.Now().UTC()
+	disabled := 0
+	err := store.Users.Mutate(func(users []User) ([]User, error) {
+		for i := range users {
+			vpn := users[i].VPNConfig
+			if vpn == nil || !vpn.Enabled || users[i].Status == statusActive {
+				continue
+			}
+			cfg := *vpn // the config may be shared with a cached copy of the user
+			cfg.Enabled = false
+			users[i].VPNConfig = &cfg
+			users[i].UpdatedAt = now
+			disabled++
+			log.Printf("vpn: disabled stale peer for user %s (status %s)", users[i].ID, users[i].Status)
+		}
+		if disabled == 0 {
+			return nil, errUnchanged
+		}
+		return users, nil
+	})
+	return disabled, err
+}
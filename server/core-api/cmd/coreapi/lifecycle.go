@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// User statuses. A deleted user keeps its record, for the audit log and
+// the invite tree, but can never come back; erasure removes the record.
+const (
+	statusPending   = "pending"
+	statusActive    = "active"
+	statusSuspended = "suspended"
+	statusDeleted   = "deleted"
+)
+
+// statusTransitions lists where each status may go.
+var statusTransitions = map[string][]string{
+	statusPending:   {statusActive, statusDeleted},
+	statusActive:    {statusSuspended, statusDeleted},
+	statusSuspended: {statusActive, statusDeleted},
+}
+
+// userRoles are the built-in roles; admins can define more (CustomRole).
+var userRoles = []string{"admin", "user"}
+
+func countActiveAdmins(users []User) int {
+	n := 0
+	for _, u := range users {
+		if u.Role == "admin" && u.Status == statusActive {
+			n++
+		}
+	}
+	return n
+}
+
+// lifecycleResult is what a role or status change did, side effects
+// included.
+type lifecycleResult struct {
+	UserID          string `json:"user_id"`
+	From            string `json:"from"`
+	To              string `json:"to"`
+	SessionsRevoked int    `json:"sessions_revoked"`
+	VPNDisabled     bool   `json:"vpn_disabled"`
+	InvitesRevoked  int    `json:"invites_revoked"`
+	Authelia        bool   `json:"authelia_updated"`
+}
+
+// setStatus validates and applies a status transition. Leaving active
+// also switches the VPN peer off; coming back does not switch it on.
+func setStatus(to string) func(*User) error {
+	return func(u *User) error {
+		if !slices.Contains(statusTransitions[u.Status], to) {
+			return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("cannot change status from %q to %q", u.Status, to))
+		}
+		u.Status = to
+		if to != statusActive && u.VPNConfig != nil && u.VPNConfig.Enabled {
+			cfg := *u.VPNConfig // the caller's copy of the user must not change
+			cfg.Enabled = false
+			u.VPNConfig = &cfg
+		}
+		return nil
+	}
+}
+
+func setRole(to string) func(*User) error {
+	return func(u *User) error {
+		if err := validRole(to); err != nil {
+			return err
+		}
+		if u.Role == to {
+			return fiber.NewError(fiber.StatusConflict, "user already has role "+to)
+		}
+		u.Role = to
+		return nil
+	}
+}
+
+// changeUser applies change to the user with id, in one locked update that
+// refuses to leave no active admin behind, and then carries out the side
+// effects: sessions are revoked whenever the role or status changes, and a
+// user leaving active also loses its open invites. The Authelia entry
+// follows the new role and status.
+func changeUser(id, reason string, change func(*User) error) (before, after User, res lifecycleResult, err error) {
+	if strings.TrimSpace(reason) == "" {
+		return before, after, res, fiber.NewError(fiber.StatusBadRequest, "reason required")
+	}
+	err = store.Users.Mutate(func(users []User) ([]User, error) {
+		i := slices.IndexFunc(users, func(u User) bool { return u.ID == id })
+		if i < 0 {
+			return nil, errNotFound
+		}
+		before = users[i]
+		if err := change(&users[i]); err != nil {
+			return nil, err
+		}
+		if before.Role == "admin" && before.Status == statusActive && countActiveAdmins(users) == 0 {
+			return nil, fiber.NewError(fiber.StatusConflict, "cannot demote or deactivate the last active admin")
+		}
+		if users[i].Status != before.Status {
+			users[i].StatusReason = reason
+		}
+		users[i].UpdatedAt = time.Now().UTC()
+		after = users[i]
+		return users, nil
+	})
+	if err != nil {
+		return before, after, res, err
+	}
+
+	res.UserID = id
+	res.VPNDisabled = before.VPNConfig != nil && before.VPNConfig.Enabled && !after.VPNConfig.Enabled
+	if res.SessionsRevoked, err = removeSessions(func(s Session) bool { return s.UserID == id }); err != nil {
+		return before, after, res, err
+	}
+	if before.Status == statusActive && after.Status != statusActive {
+		if res.InvitesRevoked, err = revokeOpenInvites(id); err != nil {
+			return before, after, res, err
+		}
+	}
+	// The change itself stands; a stale Authelia entry is logged and fixed
+	// by the next change.
+	if res.Authelia, err = syncAutheliaUser(after); err != nil {
+		log.Printf("authelia: syncing %s: %v", id, err)
+		err = nil
+	}
+	return before, after, res, nil
+}
+
+// changeStatus moves the user with id to status and records it. The
+// caller must hold users.manage.
+func changeStatus(c *fiber.Ctx, id, status, reason string) (lifecycleResult, error) {
+	if _, err := requirePermission(c, permUsersManage); err != nil {
+		return lifecycleResult{}, err
+	}
+	if err := checkTarget(c, id); err != nil {
+		return lifecycleResult{}, err
+	}
+	before, after, res, err := changeUser(id, reason, setStatus(status))
+	if err != nil {
+		return res, storeError(err, "user not found")
+	}
+	res.From, res.To = before.Status, after.Status
+	recordAudit(c, "user.status", id, res.From+" -> "+res.To+": "+reason)
+	return res, nil
+}
+
+type lifecycleRequest struct {
+	Role   string `json:"role"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+func handleUserStatusChange(c *fiber.Ctx) error {
+	var req lifecycleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	res, err := changeStatus(c, c.Params("id"), req.Status, req.Reason)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"ok": true, "change": res})
+}
+
+func handleUserRoleChange(c *fiber.Ctx) error {
+	if _, err := requirePermission(c, permRolesManage); err != nil {
+		return err
+	}
+	var req lifecycleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	id := c.Params("id")
+	if err := checkGrant(c, req.Role, nil); err != nil {
+		return err
+	}
+	if err := checkTarget(c, id); err != nil {
+		return err
+	}
+	before, after, res, err := changeUser(id, req.Reason, setRole(req.Role))
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	res.From, res.To = before.Role, after.Role
+	recordAudit(c, "user.role", id, res.From+" -> "+res.To+": "+req.Reason)
+	return c.JSON(fiber.Map{"ok": true, "change": res})
+}
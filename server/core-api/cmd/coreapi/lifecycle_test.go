@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "u1", Email: "new@example.org", Role: "user", Status: statusPending})
+	app, admin := testApp(), tokenFor(t, "a1")
+
+	for _, step := range []struct {
+		status, reason string
+		want           int
+	}{
+		{statusActive, "", fiber.StatusBadRequest},
+		{statusSuspended, "skipping ahead", fiber.StatusConflict},
+		{statusActive, "vetted", 200},
+		{statusActive, "again", fiber.StatusConflict},
+		{statusSuspended, "abuse", 200},
+		{statusActive, "appeal upheld", 200},
+		{statusDeleted, "left", 200},
+		{statusActive, "undo", fiber.StatusConflict},
+		{"archived", "no such status", fiber.StatusConflict},
+	} {
+		if code, _ := send(t, app, "PUT", "/api/users/u1/status", admin, `{"status":"`+step.status+`","reason":"`+step.reason+`"}`); code != step.want {
+			t.Fatalf("to %s (%q): %d, want %d", step.status, step.reason, code, step.want)
+		}
+	}
+	if u, _ := store.Users.Get("u1"); u.Status != statusDeleted || u.StatusReason != "left" {
+		t.Fatalf("after transitions: %+v", u)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/ghost/status", admin, `{"status":"active","reason":"x"}`); code != fiber.StatusNotFound {
+		t.Fatalf("unknown user: %d", code)
+	}
+
+	// Role and status are not changed through the plain update.
+	if code, _ := send(t, app, "PUT", "/api/users/a1", admin, `{"email":"admin@example.org","role":"user"}`); code != fiber.StatusBadRequest {
+		t.Fatalf("role through update: %d", code)
+	}
+}
+
+func TestLastAdminGuard(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "a1@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "a2", Email: "a2@example.org", Role: "admin", Status: statusSuspended})
+	app, admin := testApp(), tokenFor(t, "a1")
+
+	if code, _ := send(t, app, "PUT", "/api/users/a1/role", admin, `{"role":"user","reason":"step down"}`); code != fiber.StatusConflict {
+		t.Fatalf("demote last admin: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/a1/status", admin, `{"status":"suspended","reason":"oops"}`); code != fiber.StatusConflict {
+		t.Fatalf("suspend last admin: %d", code)
+	}
+	if code, _ := send(t, app, "DELETE", "/api/users/a1?reason=gone", admin, ``); code != fiber.StatusConflict {
+		t.Fatalf("delete last admin: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/a2/status", admin, `{"status":"active","reason":"back"}`); code != 200 {
+		t.Fatalf("reactivate second admin: %d", code)
+	}
+	admin = tokenFor(t, "a2") // a1 loses its session when it steps down
+	if code, _ := send(t, app, "PUT", "/api/users/a1/role", admin, `{"role":"user","reason":"step down"}`); code != 200 {
+		t.Fatalf("demote with another admin: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/a1/role", admin, `{"role":"user","reason":"again"}`); code != fiber.StatusConflict {
+		t.Fatalf("same role: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/a1/role", admin, `{"role":"root","reason":"typo"}`); code != fiber.StatusBadRequest {
+		t.Fatalf("unknown role: %d", code)
+	}
+}
+
+func TestStatusChangeSideEffects(t *testing.T) {
+	dataDir = t.TempDir()
+	prevAuthelia := autheliaUsers
+	autheliaUsers = filepath.Join(t.TempDir(), "users_database.yml")
+	t.Cleanup(func() { autheliaUsers = prevAuthelia })
+	_ = os.WriteFile(autheliaUsers, []byte(`# Authelia users (file backend)
+users:
+  mia:
+    displayname: Mia
+    email: mia@example.org
+    groups:
+      - users
+`), 0o600)
+
+	u := User{ID: "m1", Email: "mia@example.org", Username: "mia", Role: "user", Status: statusActive,
+		Password: hashPassword("correct horse"), VPNConfig: &VPNConfig{PublicKey: "pub", Enabled: true}}
+	_ = store.Users.Create(u)
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Invites.Create(Invite{Token: "open", CreatedBy: "m1", ExpiresAt: time.Now().Add(time.Hour)})
+	if _, err := generateJWT(&u); err != nil {
+		t.Fatal(err)
+	}
+	app, admin := testApp(), tokenFor(t, "a1")
+
+	if code, _ := send(t, app, "PUT", "/api/users/m1/status", admin, `{"status":"suspended","reason":"abuse"}`); code != 200 {
+		t.Fatalf("suspend: %d", code)
+	}
+	got, _ := store.Users.Get("m1")
+	sessions, _ := store.Sessions.List()
+	signedIn := slices.ContainsFunc(sessions, func(s Session) bool { return s.UserID == "m1" })
+	invites, _ := store.Invites.List()
+	if got.VPNConfig.Enabled || signedIn || len(invites) != 0 {
+		t.Fatalf("suspend side effects: vpn %v, signed in %v, %d invites", got.VPNConfig.Enabled, signedIn, len(invites))
+	}
+	if code, _ := send(t, app, "POST", "/api/auth/login", "", `{"email":"mia@example.org","password":"correct horse"}`); code != fiber.StatusForbidden {
+		t.Fatalf("suspended login: %d", code)
+	}
+	raw, _ := os.ReadFile(autheliaUsers)
+	if !strings.Contains(string(raw), "disabled: true") || !strings.Contains(string(raw), "# Authelia users") {
+		t.Fatalf("authelia after suspend:\n%s", raw)
+	}
+
+	if code, _ := send(t, app, "PUT", "/api/users/m1/status", admin, `{"status":"active","reason":"appeal"}`); code != 200 {
+		t.Fatalf("reactivate: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/m1/role", admin, `{"role":"admin","reason":"new moderator"}`); code != 200 {
+		t.Fatalf("promote: %d", code)
+	}
+	raw, _ = os.ReadFile(autheliaUsers)
+	if strings.Contains(string(raw), "disabled: true") || !strings.Contains(string(raw), "- admins") {
+		t.Fatalf("authelia after promotion:\n%s", raw)
+	}
+	if got, _ := store.Users.Get("m1"); got.VPNConfig.Enabled {
+		t.Fatal("reactivation switched the VPN back on")
+	}
+	if code, _ := send(t, app, "POST", "/api/auth/login", "", `{"email":"mia@example.org","password":"correct horse"}`); code != 200 {
+		t.Fatalf("login after reactivation: %d", code)
+	}
+}
+
+func TestLifecycleNeedsCaller(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "u1", Email: "member@example.org", Role: "user", Status: statusActive})
+	member := tokenFor(t, "u1")
+
+	// The handlers check the caller themselves, not only the route guards.
+	app := fiber.New()
+	app.Put("/users/:id/status", handleUserStatusChange)
+	app.Put("/users/:id/role", handleUserRoleChange)
+	for _, step := range []struct {
+		path, token, body string
+		want              int
+	}{
+		{"/users/u1/role", "", `{"role":"admin","reason":"me"}`, fiber.StatusUnauthorized},
+		{"/users/a1/status", "", `{"status":"suspended","reason":"coup"}`, fiber.StatusUnauthorized},
+		{"/users/u1/role", member, `{"role":"admin","reason":"me"}`, fiber.StatusForbidden},
+		{"/users/a1/status", member, `{"status":"suspended","reason":"coup"}`, fiber.StatusForbidden},
+	} {
+		if code, _ := send(t, app, "PUT", step.path, step.token, step.body); code != step.want {
+			t.Fatalf("%s as %q: %d, want %d", step.path, step.token, code, step.want)
+		}
+	}
+	if u, _ := store.Users.Get("u1"); u.Role != "user" {
+		t.Fatalf("role changed: %q", u.Role)
+	}
+	if entries, _ := store.Audit.List(0); len(entries) != 0 {
+		t.Fatalf("refused changes audited: %+v", entries)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// List endpoints share one query language:
+//
+//	?limit=50                 page size (default 100, at most maxListLimit)
+//	?cursor=...               next_cursor from the previous page
+//	?sort=created_at          any sortable field; -created_at sorts descending
+//	?q=alice                  case-insensitive substring of the search fields
+//	?role=admin,user          filters; a comma-separated list matches any value
+//	?created_after=2024-01-01 date ranges, RFC 3339 or a plain date
+//
+// and answer with a listPage. Cursors are keyset cursors: they carry the
+// sort key and ID of the last item returned, so records created or deleted
+// between requests neither repeat nor skip the rest of the list.
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listSpec describes what a collection can be sorted, searched and
+// filtered by. Sort keys are strings that order correctly byte-wise; see
+// timeKey and boolKey.
+type listSpec[T any] struct {
+	id          func(*T) string
+	sorts       map[string]func(*T) string
+	defaultSort string
+	search      []func(*T) string
+	filters     map[string]func(*T) string    // compared case-insensitively
+	dates       map[string]func(*T) time.Time // queried as <name>_after / <name>_before
+}
+
+// listPage is the envelope every list endpoint returns. Total counts the
+// records matching the filters, across all pages.
+type listPage[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// listCursor is encoded as URL-safe base64 JSON. Sort is kept so a cursor
+// cannot be replayed against a different order.
+type listCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+func timeKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+func boolKey(b bool) string {
+	return strconv.FormatBool(b)
+}
+
+func encodeCursor(cur listCursor) string {
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (listCursor, error) {
+	var cur listCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(raw, &cur)
+	}
+	return cur, err
+}
+
+// parseListDate accepts RFC 3339 timestamps and plain dates (midnight UTC).
+func parseListDate(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+// paginate filters, sorts and pages list according to the query of c.
+// Invalid parameters are a 400; unknown ones are ignored.
+func paginate[T any](c *fiber.Ctx, list []T, spec listSpec[T]) (listPage[T], error) {
+	limit := defaultListLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return listPage[T]{}, fiber.NewError(fiber.StatusBadRequest, "invalid limit")
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	order := firstNonEmpty(c.Query("sort"), spec.defaultSort)
+	field, desc := strings.TrimPrefix(order, "-"), strings.HasPrefix(order, "-")
+	sortKey, ok := spec.sorts[field]
+	if !ok {
+		return listPage[T]{}, fiber.NewError(fiber.StatusBadRequest, "cannot sort by "+field)
+	}
+
+	match := []func(*T) bool{}
+	if q := strings.ToLower(strings.TrimSpace(c.Query("q"))); q != "" {
+		match = append(match, func(item *T) bool {
+			for _, f := range spec.search {
+				if strings.Contains(strings.ToLower(f(item)), q) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	for name, value := range spec.filters {
+		v := c.Query(name)
+		if v == "" {
+			continue
+		}
+		wanted := strings.Split(strings.ToLower(v), ",")
+		match = append(match, func(item *T) bool {
+			got := strings.ToLower(value(item))
+			for _, w := range wanted {
+				if strings.TrimSpace(w) == got {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	for name, date := range spec.dates {
+		for _, bound := range []string{"after", "before"} {
+			v := c.Query(name + "_" + bound)
+			if v == "" {
+				continue
+			}
+			t, err := parseListDate(v)
+			if err != nil {
+				return listPage[T]{}, fiber.NewError(fiber.StatusBadRequest, "invalid "+name+"_"+bound)
+			}
+			after := bound == "after"
+			match = append(match, func(item *T) bool {
+				if after {
+					return !date(item).Before(t)
+				}
+				return date(item).Before(t)
+			})
+		}
+	}
+
+	items := make([]T, 0, len(list))
+next:
+	for i := range list {
+		for _, m := range match {
+			if !m(&list[i]) {
+				continue next
+			}
+		}
+		items = append(items, list[i])
+	}
+
+	// Ties are broken by ID so the order, and the cursor, are total.
+	less := func(aKey, aID, bKey, bID string) bool {
+		if aKey != bKey {
+			return (aKey < bKey) != desc
+		}
+		return aID < bID
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return less(sortKey(&items[i]), spec.id(&items[i]), sortKey(&items[j]), spec.id(&items[j]))
+	})
+
+	start := 0
+	if v := c.Query("cursor"); v != "" {
+		cur, err := decodeCursor(v)
+		if err != nil || cur.Sort != order {
+			return listPage[T]{}, fiber.NewError(fiber.StatusBadRequest, "invalid cursor")
+		}
+		start = sort.Search(len(items), func(i int) bool {
+			return less(cur.Key, cur.ID, sortKey(&items[i]), spec.id(&items[i]))
+		})
+	}
+
+	page := listPage[T]{Items: items[start:min(start+limit, len(items))], Total: len(items)}
+	if end := start + len(page.Items); end < len(items) {
+		last := &items[end-1]
+		page.NextCursor = encodeCursor(listCursor{Sort: order, Key: sortKey(last), ID: spec.id(last)})
+	}
+	return page, nil
+}
+
+var userListSpec = listSpec[User]{
+	id: userID,
+	sorts: map[string]func(*User) string{
+		"created_at": func(u *User) string { return timeKey(u.CreatedAt) },
+		"updated_at": func(u *User) string { return timeKey(u.UpdatedAt) },
+		"username":   func(u *User) string { return strings.ToLower(u.Username) },
+		"email":      func(u *User) string { return strings.ToLower(u.Email) },
+		"role":       func(u *User) string { return u.Role },
+		"status":     func(u *User) string { return u.Status },
+	},
+	defaultSort: "created_at",
+	search:      []func(*User) string{func(u *User) string { return u.Username }, func(u *User) string { return u.Email }},
+	filters: map[string]func(*User) string{
+		"role":         func(u *User) string { return u.Role },
+		"status":       func(u *User) string { return u.Status },
+		"vpn_enabled":  func(u *User) string { return boolKey(u.VPNConfig != nil && u.VPNConfig.Enabled) },
+		"needs_review": func(u *User) string { return boolKey(u.NeedsReview) },
+	},
+	dates: map[string]func(*User) time.Time{
+		"created": func(u *User) time.Time { return u.CreatedAt },
+		"updated": func(u *User) time.Time { return u.UpdatedAt },
+	},
+}
+
+var registrationListSpec = listSpec[Registration]{
+	id: registrationID,
+	sorts: map[string]func(*Registration) string{
+		"created_at": func(r *Registration) string { return timeKey(r.CreatedAt) },
+		"username":   func(r *Registration) string { return strings.ToLower(r.Username) },
+		"email":      func(r *Registration) string { return strings.ToLower(r.Email) },
+		"status":     func(r *Registration) string { return r.Status },
+		// Zero-padded so scores sort numerically; they never go below zero.
+		"spam_score": func(r *Registration) string { return fmt.Sprintf("%010d", r.SpamScore) },
+	},
+	defaultSort: "created_at",
+	search:      []func(*Registration) string{func(r *Registration) string { return r.Username }, func(r *Registration) string { return r.Email }},
+	filters: map[string]func(*Registration) string{
+		"status": func(r *Registration) string { return r.Status },
+	},
+	dates: map[string]func(*Registration) time.Time{
+		"created": func(r *Registration) time.Time { return r.CreatedAt },
+	},
+}
+
+var inviteListSpec = listSpec[Invite]{
+	id: inviteToken,
+	sorts: map[string]func(*Invite) string{
+		"created_at": func(inv *Invite) string { return timeKey(inv.CreatedAt) },
+		"expires_at": func(inv *Invite) string { return timeKey(inv.ExpiresAt) },
+		"email":      func(inv *Invite) string { return strings.ToLower(inv.Email) },
+	},
+	defaultSort: "created_at",
+	search:      []func(*Invite) string{func(inv *Invite) string { return inv.Email }},
+	filters: map[string]func(*Invite) string{
+		"used":            func(inv *Invite) string { return boolKey(inv.Used) },
+		"delivery_status": func(inv *Invite) string { return inv.DeliveryStatus },
+		"created_by":      func(inv *Invite) string { return inv.CreatedBy },
+	},
+	dates: map[string]func(*Invite) time.Time{
+		"created": func(inv *Invite) time.Time { return inv.CreatedAt },
+		"expires": func(inv *Invite) time.Time { return inv.ExpiresAt },
+	},
+}
+
+// TeamSpeak users have no email or timestamps; they are searched by
+// username and listed in username order.
+var teamSpeakUserListSpec = listSpec[TeamSpeakUser]{
+	id: teamSpeakUserID,
+	sorts: map[string]func(*TeamSpeakUser) string{
+		"username": func(u *TeamSpeakUser) string { return strings.ToLower(u.Username) },
+		"group":    func(u *TeamSpeakUser) string { return u.Group },
+		"status":   func(u *TeamSpeakUser) string { return u.Status },
+	},
+	defaultSort: "username",
+	search:      []func(*TeamSpeakUser) string{func(u *TeamSpeakUser) string { return u.Username }},
+	filters: map[string]func(*TeamSpeakUser) string{
+		"group":  func(u *TeamSpeakUser) string { return u.Group },
+		"status": func(u *TeamSpeakUser) string { return u.Status },
+	},
+}
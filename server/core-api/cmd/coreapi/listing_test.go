@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func listUsers(t *testing.T, app *fiber.App, query string) (int, listPage[User]) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest("GET", "/users?"+query, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page listPage[User]
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, page
+}
+
+func TestListFiltersAndSearch(t *testing.T) {
+	prev := store
+	store = newMemoryStore()
+	defer func() { store = prev }()
+	dataDir = t.TempDir()
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, u := range []User{
+		{Username: "alice", Email: "alice@example.org", Role: "admin", Status: "active", VPNConfig: &VPNConfig{Enabled: true}},
+		{Username: "bob", Email: "bob@example.org", Role: "user", Status: "active"},
+		{Username: "carol", Email: "c@alice.example", Role: "user", Status: "suspended", VPNConfig: &VPNConfig{Enabled: false}},
+		{Username: "dave", Email: "dave@example.org", Role: "user", Status: "pending"},
+	} {
+		u.ID = fmt.Sprintf("u%d", i)
+		u.CreatedAt = day.AddDate(0, 0, i)
+		_ = store.Users.Create(u)
+	}
+	app := fiber.New()
+	app.Get("/users", handleUsersList)
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"alice", "bob", "carol", "dave"}},
+		{"q=ALICE", []string{"alice", "carol"}},
+		{"role=user&status=active,suspended", []string{"bob", "carol"}},
+		{"vpn_enabled=true", []string{"alice"}},
+		{"vpn_enabled=false&sort=-username", []string{"dave", "carol", "bob"}},
+		{"created_after=2024-03-02&created_before=2024-03-04", []string{"bob", "carol"}},
+		{"created_after=2024-03-03T00:00:00Z&sort=-created_at", []string{"dave", "carol"}},
+	} {
+		code, page := listUsers(t, app, tc.query)
+		var got []string
+		for _, u := range page.Items {
+			got = append(got, u.Username)
+		}
+		if code != 200 || page.Total != len(tc.want) || fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: %d %v (total %d), want %v", tc.query, code, got, page.Total, tc.want)
+		}
+	}
+	for _, query := range []string{"limit=0", "limit=x", "sort=password", "created_after=yesterday", "cursor=bm9wZQ"} {
+		if code, _ := listUsers(t, app, query); code != fiber.StatusBadRequest {
+			t.Errorf("%q: %d, want 400", query, code)
+		}
+	}
+}
+
+func TestListCursorPagination(t *testing.T) {
+	prev := store
+	store = newMemoryStore()
+	defer func() { store = prev }()
+	dataDir = t.TempDir()
+	created := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		// Pairs share a timestamp, so the ID has to break the tie.
+		_ = store.Users.Create(User{ID: fmt.Sprintf("u%d", i), Username: fmt.Sprintf("user%d", i), CreatedAt: created.Add(time.Duration(i/2) * time.Hour)})
+	}
+	app := fiber.New()
+	app.Get("/users", handleUsersList)
+
+	walk := func(sort string) []string {
+		var ids []string
+		query := "limit=3&sort=" + sort
+		for pages := 0; pages < 5; pages++ {
+			code, page := listUsers(t, app, query)
+			if code != 200 || page.Total != 7 {
+				t.Fatalf("%s: %d total %d", query, code, page.Total)
+			}
+			for _, u := range page.Items {
+				ids = append(ids, u.ID)
+			}
+			if page.NextCursor == "" {
+				return ids
+			}
+			query = "limit=3&sort=" + sort + "&cursor=" + page.NextCursor
+		}
+		t.Fatalf("%s: cursor never ran out", sort)
+		return nil
+	}
+	if got := fmt.Sprint(walk("created_at")); got != "[u0 u1 u2 u3 u4 u5 u6]" {
+		t.Fatalf("ascending: %s", got)
+	}
+	if got := fmt.Sprint(walk("-created_at")); got != "[u6 u4 u5 u2 u3 u0 u1]" {
+		t.Fatalf("descending: %s", got)
+	}
+
+	// A record deleted behind the cursor does not shift the next page.
+	_, first := listUsers(t, app, "limit=3")
+	_ = store.Users.Delete("u1")
+	_, second := listUsers(t, app, "limit=3&cursor="+first.NextCursor)
+	if len(second.Items) != 3 || second.Items[0].ID != "u3" || second.Total != 6 {
+		t.Fatalf("after delete: %+v", second)
+	}
+	if code, _ := listUsers(t, app, "limit=3&sort=username&cursor="+first.NextCursor); code != fiber.StatusBadRequest {
+		t.Fatalf("cursor reused with another sort: %d", code)
+	}
+}
@@ -7,14 +7,18 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/docker/docker/api/types"
@@ -41,12 +45,23 @@ type User struct {
 	ID        string    `json:"id"`
 	Email     string    `json:"email"`
 	Username  string    `json:"username"`
-	Password  string    `json:"-"` // Hashed password
+	Password  string    `json:"password,omitempty"` // Hashed password; never sent to clients (see hidePassword)
 	Role      string    `json:"role"` // admin, user
-	Status    string    `json:"status"` // active, suspended, pending
+	Status    string    `json:"status"` // pending, active, suspended, deleted; see statusTransitions
+	StatusReason string `json:"status_reason,omitempty"` // given with the last status change
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	VPNConfig *VPNConfig `json:"vpn_config,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	Groups    []string  `json:"groups,omitempty"` // IDs of the groups joined directly; see memberOf
+	ApprovedBy []Approval `json:"approved_by,omitempty"`
+	Profile   map[string]any `json:"profile,omitempty"` // questionnaire answers from registration
+	InviteToken string   `json:"invite_token,omitempty"` // invite redeemed at sign-up
+	InvitedBy string    `json:"invited_by,omitempty"` // user ID of the invite's creator
+	InviteQuota *int    `json:"invite_quota,omitempty"` // overrides memberInviteQuota
+	NeedsReview bool    `json:"needs_review,omitempty"`
+	ReviewReason string `json:"review_reason,omitempty"`
+	ErasureRequestedAt *time.Time `json:"erasure_requested_at,omitempty"` // see ERASURE_GRACE
 }
 
 type VPNConfig struct {
@@ -61,9 +76,17 @@ type Registration struct {
 	Email     string    `json:"email"`
 	Username  string    `json:"username"`
 	Password  string    `json:"password"`
-	Status    string    `json:"status"` // pending, approved, rejected
+	Status    string    `json:"status"` // pending, quarantined, approved, rejected
 	CreatedAt time.Time `json:"created_at"`
 	InviteToken string  `json:"invite_token,omitempty"`
+	SourceIP  string    `json:"source_ip,omitempty"`
+	CaptchaPassed bool  `json:"captcha_passed,omitempty"`
+	RuleID    string    `json:"rule_id,omitempty"` // auto-moderation rule that matched
+	Approvals []Approval `json:"approvals,omitempty"`
+	Answers   map[string]any `json:"answers,omitempty"` // questionnaire answers
+	SpamScore int       `json:"spam_score"`
+	SpamSignals []SpamSignalResult `json:"spam_signals,omitempty"`
+	ApprovalsRequired int `json:"approvals_required,omitempty"` // filled in list responses only
 }
 
 type Invite struct {
@@ -72,10 +95,16 @@ type Invite struct {
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
 	Used      bool      `json:"used"`
+	CreatedBy string    `json:"created_by,omitempty"` // user ID of the sponsor
+	RedeemedBy string   `json:"redeemed_by,omitempty"` // user ID created from this invite
+	DeliveryStatus string `json:"delivery_status,omitempty"` // sent, failed
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	DeliveryError string `json:"delivery_error,omitempty"`
 }
 
 type TeamSpeakUser struct {
 	ID       string `json:"id"`
+	UserID   string `json:"user_id,omitempty"` // the Safe-Spac user owning the account
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Group    string `json:"group"`
@@ -98,11 +127,86 @@ type captchaFileEntry struct {
 }
 
 func main() {
+	checkOnly := flag.Bool("check", false, "report pending migrations without applying them and exit")
+	migrateOnly := flag.Bool("migrate-only", false, "apply pending migrations and exit")
+	exportTo := flag.String("export", "", "write an instance export (passphrase from EXPORT_PASSPHRASE) to this file and exit")
+	importFrom := flag.String("import", "", "import an instance export (passphrase from EXPORT_PASSPHRASE) and exit")
+	importMode := flag.String("import-mode", "merge", "merge or replace, with --import")
+	dryRun := flag.Bool("dry-run", false, "with --import, report what would change without writing")
+	flag.Parse()
+	if *checkOnly {
+		os.Exit(checkMigrations(os.Stdout))
+	}
+
+	// Drop interrupted writes and replace corrupt files with their last good copy
+	if _, err := recoverDataFiles(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Bring the data files up to the current schema
+	if _, err := migrateDataFiles(context.Background(), dataMigrations); err != nil {
+		log.Fatal(err)
+	}
+
 	// Initialize data files
 	ensureDataFiles()
+
+	// Load or create the key that signs invite links
+	inviteKey, err := loadInviteSigningKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	inviteSigningKey = inviteKey
+
+	// Unwrap the data keys and open the configured storage backend
+	keys, err := loadKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+	secretKeys = keys
+	if secretKeys == nil {
+		log.Printf("MASTER_KEY not set; VPN private keys and TeamSpeak passwords are stored unencrypted")
+	}
+	opened, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = opened
+	if secretKeys != nil {
+		if _, err := resealSecrets(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *migrateOnly {
+		log.Printf("Migrations complete")
+		_ = store.Close()
+		return
+	}
+	if *exportTo != "" {
+		err := exportToFile(*exportTo, os.Getenv("EXPORT_PASSPHRASE"))
+		_ = store.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Exported to %s", *exportTo)
+		return
+	}
+	if *importFrom != "" {
+		report, err := importFromFile(context.Background(), *importFrom, os.Getenv("EXPORT_PASSPHRASE"), *importMode, *dryRun)
+		_ = store.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	if err := bootstrapAdmin(); err != nil {
+		log.Fatal(err)
+	}
 	
 	// Create Fiber app
-	app := fiber.New(fiber.Config{
+	app := fiber.New(withClientIP(fiber.Config{
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -113,7 +217,7 @@ func main() {
 				"code":  code,
 			})
 		},
-	})
+	}))
 
 	// Middleware
 	app.Use(logger.New())
@@ -124,7 +228,50 @@ func main() {
 	}))
 
 	// API routes
-	api := app.Group("/api")
+	routes(app.Group("/api"))
+	
+	// Health check
+	app.Get("/health", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "healthy", "timestamp": time.Now().UTC()})
+	})
+
+	// Background jobs
+	if err := registerJobs(scheduler); err != nil {
+		log.Fatal(err)
+	}
+	scheduler.Start()
+
+	// Stop accepting requests and drain jobs on SIGINT/SIGTERM
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Printf("Shutting down")
+		_ = app.ShutdownWithTimeout(10 * time.Second)
+	}()
+
+	// Start server
+	port := envOr("PORT", "8080")
+	log.Printf("Starting Safe-Spac Core API on port %s", port)
+	if err := app.Listen(":" + port); err != nil {
+		log.Fatal(err)
+	}
+	scheduler.Stop()
+	if err := store.Close(); err != nil {
+		log.Printf("Closing store: %v", err)
+	}
+}
+
+// routes mounts the API handlers on api.
+func routes(api fiber.Router) {
+	// First-run setup, open only while no admin exists
+	api.Get("/setup", handleSetupStatus)
+	api.Post("/setup", handleSetup)
+	
+	// Routes below declare who may call them: requires(perm) for a
+	// permission from permissionCatalogue, requiresSelfOr when users may
+	// also reach their own record, signedIn when any session will do.
+	// Setup, the auth routes and the health check are public.
 	
 	// Auth routes
 	auth := api.Group("/auth")
@@ -133,77 +280,221 @@ func main() {
 	auth.Post("/logout", handleLogout)
 	auth.Post("/captcha/challenge", handleCaptchaChallenge)
 	auth.Post("/captcha/verify", handleCaptchaVerify)
+	auth.Get("/registration-fields", handleRegistrationFieldsGet)
+	auth.Get("/invites/:token", handleInviteCheck)
+	auth.Get("/verify", handleForwardAuth)
 	
 	// User management
 	users := api.Group("/users")
-	users.Get("/", handleUsersList)
-	users.Get("/:id", handleUserGet)
-	users.Put("/:id", handleUserUpdate)
-	users.Delete("/:id", handleUserDelete)
-	users.Post("/:id/vpn/enable", handleVPNEnable)
-	users.Post("/:id/vpn/disable", handleVPNDisable)
+	users.Get("/", requires(permUsersRead), handleUsersList)
+	users.Post("/", requires(permUsersManage), handleUserCreate)
+	users.Get("/:id", requiresSelfOr(permUsersRead, "id"), handleUserGet)
+	users.Put("/:id", requires(permUsersManage), handleUserUpdate)
+	users.Delete("/:id", requires(permUsersManage), handleUserDelete)
+	users.Post("/:id/vpn/enable", requires(permVPNManage), handleVPNEnable)
+	users.Post("/:id/vpn/disable", requires(permVPNManage), handleVPNDisable)
+	users.Post("/:id/suspend", requires(permUsersManage), handleUserSuspend)
+	users.Put("/:id/status", requires(permUsersManage), handleUserStatusChange)
+	users.Put("/:id/role", requires(permRolesManage), handleUserRoleChange)
+	users.Get("/:id/groups", requiresSelfOr(permUsersRead, "id"), handleUserGroups)
+	users.Get("/:id/permissions", requiresSelfOr(permUsersRead, "id"), handleUserPermissions)
+	
+	// The caller's own data
+	me := api.Group("/me")
+	me.Get("/export", signedIn, handleMyDataExport)
+	me.Post("/erasure", signedIn, handleMyErasureRequest)
+	me.Delete("/erasure", signedIn, handleMyErasureCancel)
+	
+	// Member invites
+	invites := api.Group("/invites")
+	invites.Get("/", signedIn, handleMyInvitesList)
+	invites.Post("/", signedIn, handleMyInviteCreate)
 	
 	// Admin routes
 	admin := api.Group("/admin")
-	admin.Get("/registrations", handleRegistrationsList)
-	admin.Post("/registrations/:id/approve", handleRegistrationApprove)
-	admin.Post("/registrations/:id/reject", handleRegistrationReject)
-	admin.Post("/invites", handleInviteCreate)
-	admin.Get("/invites", handleInvitesList)
-	admin.Delete("/invites/:token", handleInviteDelete)
-	admin.Post("/authelia/restart", handleAutheliaRestart)
+	admin.Get("/registrations", requires(permRegistrationsRead), handleRegistrationsList)
+	admin.Post("/registrations/:id/approve", requires(permApproveRegistrations), handleRegistrationApprove)
+	admin.Post("/registrations/:id/reject", requires(permApproveRegistrations), handleRegistrationReject)
+	admin.Post("/registrations/:id/veto", requires(permApproveRegistrations), handleRegistrationVeto)
+	admin.Get("/registrations/rejected", requires(permRegistrationsRead), handleRejectedList)
+	admin.Post("/registrations/bulk", requires(permApproveRegistrations), handleRegistrationsBulk)
+	admin.Get("/registration-rules", requires(permRegistrationsSettings), handleRegistrationRulesGet)
+	admin.Put("/registration-rules", requires(permRegistrationsSettings), handleRegistrationRulesPut)
+	admin.Post("/registration-rules/dry-run", requires(permRegistrationsSettings), handleRegistrationRulesDryRun)
+	admin.Get("/registration-fields", requires(permRegistrationsSettings), handleRegistrationFieldsGet)
+	admin.Put("/registration-fields", requires(permRegistrationsSettings), handleRegistrationFieldsPut)
+	admin.Get("/email-policy", requires(permRegistrationsSettings), handleEmailPolicyGet)
+	admin.Put("/email-policy", requires(permRegistrationsSettings), handleEmailPolicyPut)
+	admin.Get("/email-policy/blocked", requires(permRegistrationsRead), handleBlockedSignupsList)
+	admin.Post("/invites", requires(permInvitesManage), handleInviteCreate)
+	admin.Get("/invites", requires(permInvitesManage), handleInvitesList)
+	admin.Get("/invites/tree", requires(permInvitesManage), handleInviteTree)
+	admin.Get("/invites/:token/qr", requires(permInvitesManage), handleInviteQR)
+	admin.Post("/invites/:token/send", requires(permInvitesManage), handleInviteSend)
+	admin.Delete("/invites/:token", requires(permInvitesManage), handleInviteDelete)
+	admin.Put("/users/:id/invite-quota", requires(permInvitesManage), handleInviteQuotaSet)
+	admin.Post("/users/:id/erase", requires(permPrivacyErase), handleUserErase)
+	admin.Get("/erasures", requires(permPrivacyErase), handleErasuresList)
+	admin.Post("/authelia/restart", requires(permContainersRestart), handleAutheliaRestart)
+	admin.Get("/jobs", requires(permJobsManage), handleJobsList)
+	admin.Post("/jobs/:name/run", requires(permJobsManage), handleJobRun)
+	admin.Get("/audit", requires(permAuditRead), handleAuditList)
+	admin.Get("/keys", requires(permKeysManage), handleKeysList)
+	admin.Post("/keys/rotate", requires(permKeysManage), handleKeysRotate)
+	admin.Get("/backups", requires(permBackupsManage), handleBackupsList)
+	admin.Post("/backups", requires(permBackupsManage), handleBackupCreate)
+	admin.Get("/backups/:name", requires(permBackupsManage), handleBackupDownload)
+	admin.Post("/backups/:name/verify", requires(permBackupsManage), handleBackupVerify)
+	admin.Post("/backups/:name/restore", requires(permBackupsManage), handleBackupRestore)
+	admin.Post("/export", requires(permInstanceTransfer), handleInstanceExport)
+	admin.Post("/import", requires(permInstanceTransfer), handleInstanceImport)
+	admin.Get("/groups", requires(permUsersRead), handleGroupsList)
+	admin.Post("/groups", requires(permGroupsManage), handleGroupCreate)
+	admin.Get("/groups/:id", requires(permUsersRead), handleGroupGet)
+	admin.Put("/groups/:id", requires(permGroupsManage), handleGroupUpdate)
+	admin.Delete("/groups/:id", requires(permGroupsManage), handleGroupDelete)
+	admin.Get("/groups/:id/members", requires(permUsersRead), handleGroupMembers)
+	admin.Put("/groups/:id/members/:user_id", requires(permGroupsManage), handleGroupMemberAdd)
+	admin.Delete("/groups/:id/members/:user_id", requires(permGroupsManage), handleGroupMemberRemove)
+	admin.Get("/permissions", requires(permRolesManage), handlePermissionsList)
+	admin.Get("/roles", requires(permRolesManage), handleRolesList)
+	admin.Post("/roles", requires(permRolesManage), handleRoleCreate)
+	admin.Put("/roles/:name", requires(permRolesManage), handleRoleUpdate)
+	admin.Delete("/roles/:name", requires(permRolesManage), handleRoleDelete)
 	
 	// VPN routes
 	vpn := api.Group("/vpn")
-	vpn.Get("/config/:user_id", handleVPNConfigGet)
-	vpn.Post("/config/:user_id", handleVPNConfigUpdate)
-	vpn.Get("/status", handleVPNStatus)
+	vpn.Get("/config/:user_id", requiresSelfOr(permVPNRead, "user_id"), handleVPNConfigGet)
+	vpn.Post("/config/:user_id", requires(permVPNManage), handleVPNConfigUpdate)
+	vpn.Get("/status", requires(permVPNRead), handleVPNStatus)
+	vpn.Get("/policy/:user_id", requiresSelfOr(permVPNRead, "user_id"), handleVPNPolicy)
 	
 	// TeamSpeak routes
 	teamspeak := api.Group("/teamspeak")
-	teamspeak.Get("/users", handleTeamSpeakUsersList)
-	teamspeak.Post("/users", handleTeamSpeakUserCreate)
-	teamspeak.Put("/users/:id", handleTeamSpeakUserUpdate)
-	teamspeak.Delete("/users/:id", handleTeamSpeakUserDelete)
-	teamspeak.Get("/channels", handleTeamSpeakChannelsList)
-	teamspeak.Post("/channels", handleTeamSpeakChannelCreate)
-	
-	// Health check
-	app.Get("/health", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "healthy", "timestamp": time.Now().UTC()})
-	})
-
-	// Start server
-	port := envOr("PORT", "8080")
-	log.Printf("Starting Safe-Spac Core API on port %s", port)
-	if err := app.Listen(":" + port); err != nil {
-		log.Fatal(err)
-	}
+	teamspeak.Get("/users", requires(permTeamSpeakRead), handleTeamSpeakUsersList)
+	teamspeak.Post("/users", requires(permTeamSpeakManage), handleTeamSpeakUserCreate)
+	teamspeak.Put("/users/:id", requires(permTeamSpeakManage), handleTeamSpeakUserUpdate)
+	teamspeak.Delete("/users/:id", requires(permTeamSpeakManage), handleTeamSpeakUserDelete)
+	teamspeak.Get("/channels", requires(permTeamSpeakRead), handleTeamSpeakChannelsList)
+	teamspeak.Post("/channels", requires(permTeamSpeakManage), handleTeamSpeakChannelCreate)
 }
 
 // Auth handlers
 func handleRegistrationSubmit(c *fiber.Ctx) error {
-	var req Registration
-	if err := c.BodyParser(&req); err != nil {
+	var body struct {
+		Email         string `json:"email"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		InviteToken   string `json:"invite_token"`
+		InviteSig     string `json:"invite_sig"` // sig from the invite link
+		CaptchaID     string `json:"captcha_id"`
+		CaptchaAnswer *int   `json:"captcha_answer"`
+		Answers       map[string]any `json:"answers"`
+		Website       string `json:"website"` // honeypot, hidden from people
+		FormStartedAt int64  `json:"form_started_at"` // unix milliseconds
+	}
+	if err := c.BodyParser(&body); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 	}
 	
-	if req.Email == "" {
+	if body.Email == "" {
 		return fiber.NewError(fiber.StatusBadRequest, "email required")
 	}
+	if err := enforceEmailPolicy(body.Email, c.IP(), "registration"); err != nil {
+		return err
+	}
+	if body.InviteToken != "" {
+		inv, err := findValidInvite(body.InviteToken, body.Email, time.Now())
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to load invites")
+		}
+		if inv == nil {
+			return fiber.NewError(fiber.StatusForbidden, "invite is invalid, used, expired or for a different email address")
+		}
+		if !verifyInviteSignature(*inv, body.InviteSig) {
+			return fiber.NewError(fiber.StatusForbidden, "invalid invite link")
+		}
+	}
 	
-	req.ID = generateID()
-	req.CreatedAt = time.Now().UTC()
-	req.Status = "pending"
-
-	path := filepath.Join(dataDir, "pending.json")
-	var list []Registration
-	_ = readJSON(path, &list)
-	list = append(list, req)
-	if err := writeJSON(path, list); err != nil {
+	req := Registration{
+		ID:          generateID(),
+		Email:       body.Email,
+		Username:    body.Username,
+		Password:    body.Password,
+		Status:      "pending",
+		CreatedAt:   time.Now().UTC(),
+		InviteToken: body.InviteToken,
+		SourceIP:    c.IP(),
+	}
+	if body.CaptchaID != "" && body.CaptchaAnswer != nil {
+		if err := consumeCaptcha(body.CaptchaID, *body.CaptchaAnswer); err != nil {
+			return err
+		}
+		req.CaptchaPassed = true
+	}
+	fields, err := loadRegistrationFields()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load registration fields")
+	}
+	if req.Answers, err = validateAnswers(fields, body.Answers); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	until, blocked, err := reapplyBlockedUntil(req.Email, req.SourceIP, req.CreatedAt)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load rejections")
+	}
+	if blocked {
+		return fiber.NewError(fiber.StatusTooManyRequests, "registration blocked until "+until.Format(time.RFC3339))
+	}
+
+	in := spamInput{Registration: req, Honeypot: body.Website, ReceivedAt: req.CreatedAt}
+	if body.FormStartedAt > 0 {
+		in.FormStartedAt = time.UnixMilli(body.FormStartedAt).UTC()
+	}
+	req.SpamScore, req.SpamSignals = scoreRegistration(in)
+
+	if req.SpamScore >= spamRejectScore {
+		if err := recordRejection(req, fmt.Sprintf("spam score %d", req.SpamScore), ""); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return fiber.NewError(fiber.StatusForbidden, "registration rejected")
+	}
+	var rule *RegistrationRule
+	if req.SpamScore >= spamQuarantineScore {
+		// Quarantined submissions always wait for a person, whatever the rules say.
+		req.Status = "quarantined"
+	} else if rule, err = evaluateRegistrationRules(req, req.CreatedAt); err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to evaluate registration rules")
+	}
+	if rule != nil {
+		req.RuleID = rule.ID
+	}
+	decision := decisionOf(rule)
+	if decision == ruleApprove && multiApproval() {
+		// A rule is not an approver: under a multi-approver policy it only
+		// holds the registration for people to sign off.
+		decision = ruleHold
+	}
+	switch decision {
+	case ruleApprove:
+		user := newUserFromRegistration(req)
+		if err := createInvitedUser(user); err != nil {
+			return storeError(err, "invite not found")
+		}
+		notifyApproved(user)
+		return c.JSON(fiber.Map{"ok": true, "id": req.ID, "status": "approved", "user_id": user.ID})
+	case ruleReject:
+		if err := recordRejection(req, "auto-rejected by rule "+rule.ID, ""); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return fiber.NewError(fiber.StatusForbidden, "registration rejected")
+	}
+
+	if err := store.Registrations.Create(req); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
-	return c.JSON(fiber.Map{"ok": true, "id": req.ID})
+	return c.JSON(fiber.Map{"ok": true, "id": req.ID, "status": req.Status})
 }
 
 func handleLogin(c *fiber.Ctx) error {
@@ -215,35 +506,29 @@ func handleLogin(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 	}
 	
-	// Load users and find matching user
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
-	}
-	
-	var user *User
-	for i := range users {
-		if users[i].Email == req.Email {
-			user = &users[i]
-			break
-		}
-	}
-	
-	if user == nil {
+	// Find matching user
+	user, err := store.Users.FindByEmail(req.Email)
+	if errors.Is(err, errNotFound) {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
 	}
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+	}
 	
 	// Verify password
 	if !verifyPassword(req.Password, user.Password) {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid credentials")
 	}
+	if user.Status != statusActive {
+		return fiber.NewError(fiber.StatusForbidden, "account is "+user.Status)
+	}
 	
 	// Generate JWT token (simplified)
-	token, err := generateJWT(user)
+	token, err := generateJWT(&user)
 	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to generate token")
 	}
+	hidePassword(&user)
 	
 	return c.JSON(fiber.Map{
 		"ok": true,
@@ -253,311 +538,287 @@ func handleLogin(c *fiber.Ctx) error {
 }
 
 func handleLogout(c *fiber.Ctx) error {
-	// In a real implementation, you'd invalidate the JWT token
+	token := strings.TrimSpace(strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "))
+	if _, sessionID, ok := tokenClaims(token); ok {
+		if err := deleteSession(sessionID); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+	}
 	return c.JSON(fiber.Map{"ok": true})
 }
 
 // User management handlers
 func handleUsersList(c *fiber.Ctx) error {
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
+	users, err := store.Users.List()
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
 	}
-	return c.JSON(users)
+	page, err := paginate(c, users, userListSpec)
+	if err != nil {
+		return err
+	}
+	reveal, err := revealSecrets(c, "")
+	if err != nil {
+		return err
+	}
+	for i := range page.Items {
+		hidePassword(&page.Items[i])
+		if !reveal {
+			redactUser(&page.Items[i])
+		}
+	}
+	return c.JSON(page)
 }
 
 func handleUserGet(c *fiber.Ctx) error {
-	userID := c.Params("id")
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+	user, err := store.Users.Get(c.Params("id"))
+	if err != nil {
+		return storeError(err, "user not found")
 	}
-	
-	for _, user := range users {
-		if user.ID == userID {
-			return c.JSON(user)
-		}
+	reveal, err := revealSecrets(c, user.ID)
+	if err != nil {
+		return err
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "user not found")
+	hidePassword(&user)
+	if !reveal {
+		redactUser(&user)
+	}
+	return c.JSON(user)
 }
 
 func handleUserUpdate(c *fiber.Ctx) error {
 	userID := c.Params("id")
+	// A new email or username is a password reset away from the account.
+	if err := checkTarget(c, userID); err != nil {
+		return err
+	}
 	var req User
 	if err := c.BodyParser(&req); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 	}
 	
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
-	}
-	
-	for i := range users {
-		if users[i].ID == userID {
-			users[i].Username = req.Username
-			users[i].Email = req.Email
-			users[i].UpdatedAt = time.Now().UTC()
-			if err := writeJSON(usersPath, users); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
+	_, err := store.Users.Update(userID, func(u *User) error {
+		// Role and status only change through their own endpoints, which
+		// validate the change and carry out its side effects.
+		if (req.Role != "" && req.Role != u.Role) || (req.Status != "" && req.Status != u.Status) {
+			return fiber.NewError(fiber.StatusBadRequest, "use PUT /api/users/:id/role or /status to change role or status")
 		}
+		u.Username = req.Username
+		u.Email = req.Email
+		u.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "user not found")
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "user not found")
+	recordAudit(c, "user.update", userID, "")
+	return c.JSON(fiber.Map{"ok": true})
 }
 
+// handleUserDelete moves the user to the deleted status; the record stays
+// until it is erased.
 func handleUserDelete(c *fiber.Ctx) error {
-	userID := c.Params("id")
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
-	}
-	
-	for i := range users {
-		if users[i].ID == userID {
-			users = append(users[:i], users[i+1:]...)
-			if err := writeJSON(usersPath, users); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
+	var req lifecycleRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 		}
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "user not found")
+	res, err := changeStatus(c, c.Params("id"), statusDeleted, firstNonEmpty(c.Query("reason"), req.Reason))
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"ok": true, "change": res})
 }
 
 // Admin handlers
 func handleRegistrationsList(c *fiber.Ctx) error {
-	path := filepath.Join(dataDir, "pending.json")
-	var registrations []Registration
-	if err := readJSON(path, &registrations); err != nil {
+	registrations, err := store.Registrations.List()
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to load registrations")
 	}
-	return c.JSON(registrations)
+	page, err := paginate(c, registrations, registrationListSpec)
+	if err != nil {
+		return err
+	}
+	for i := range page.Items {
+		page.Items[i].ApprovalsRequired = requiredApprovals
+	}
+	return c.JSON(page)
 }
 
 func handleRegistrationApprove(c *fiber.Ctx) error {
 	regID := c.Params("id")
-	
-	// Load pending registrations
-	pendingPath := filepath.Join(dataDir, "pending.json")
-	var pending []Registration
-	if err := readJSON(pendingPath, &pending); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load registrations")
+	approver, err := approvalCaller(c)
+	if err != nil {
+		return err
 	}
 	
-	// Find and approve registration
-	var approvedReg *Registration
-	for i := range pending {
-		if pending[i].ID == regID {
-			approvedReg = &pending[i]
-			pending = append(pending[:i], pending[i+1:]...)
-			break
+	// Record the approval; a complete registration leaves pending.json and
+	// becomes a user in the same locked update.
+	var approvedReg Registration
+	var user User
+	complete := false
+	err = store.Registrations.Mutate(func(pending []Registration) ([]Registration, error) {
+		for i := range pending {
+			if pending[i].ID != regID {
+				continue
+			}
+			var err error
+			if complete, err = addApproval(&pending[i], approver, time.Now().UTC()); err != nil {
+				return nil, err
+			}
+			approvedReg = pending[i]
+			if !complete {
+				return pending, nil
+			}
+			user = newUserFromRegistration(approvedReg)
+			if err := createInvitedUser(user); err != nil {
+				return nil, err
+			}
+			return append(pending[:i], pending[i+1:]...), nil
 		}
+		return nil, errNotFound
+	})
+	if err != nil {
+		return storeError(err, "registration not found")
 	}
-	
-	if approvedReg == nil {
-		return fiber.NewError(fiber.StatusNotFound, "registration not found")
-	}
-	
-	// Save updated pending list
-	if err := writeJSON(pendingPath, pending); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-	}
-	
-	// Create user
-	user := User{
-		ID:        generateID(),
-		Email:     approvedReg.Email,
-		Username:  approvedReg.Username,
-		Password:  hashPassword(approvedReg.Password),
-		Role:      "user",
-		Status:    "active",
-		CreatedAt: time.Now().UTC(),
-		UpdatedAt: time.Now().UTC(),
+	recordAudit(c, "registration.approve", regID, user.ID)
+	if !complete {
+		return c.JSON(fiber.Map{
+			"ok": true,
+			"status": "pending",
+			"approvals": len(approvedReg.Approvals),
+			"approvals_required": requiredApprovals,
+		})
 	}
 	
-	// Add to users
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	_ = readJSON(usersPath, &users)
-	users = append(users, user)
-	if err := writeJSON(usersPath, users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-	}
+	notifyApproved(user)
 	
 	return c.JSON(fiber.Map{"ok": true, "user_id": user.ID})
 }
 
 func handleRegistrationReject(c *fiber.Ctx) error {
 	regID := c.Params("id")
-	
-	// Load pending registrations
-	pendingPath := filepath.Join(dataDir, "pending.json")
-	var pending []Registration
-	if err := readJSON(pendingPath, &pending); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load registrations")
+	var req struct {
+		Reason string `json:"reason"`
+		Notify bool   `json:"notify"`
 	}
-	
-	// Remove rejected registration
-	for i := range pending {
-		if pending[i].ID == regID {
-			pending = append(pending[:i], pending[i+1:]...)
-			if err := writeJSON(pendingPath, pending); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&req); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 		}
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "registration not found")
-}
-
-func handleInviteCreate(c *fiber.Ctx) error {
-	var req struct {
-		Email    string `json:"email"`
-		ExpiresH int    `json:"expires_hours"`
+	caller, err := currentUser(c)
+	if err != nil {
+		return err
 	}
-	if err := c.BodyParser(&req); err != nil {
-		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	
+	// Move rejected registration into the rejection history
+	rejected, err := takeRegistration(regID, func(reg Registration) error {
+		return recordRejection(reg, req.Reason, usernameOf(caller))
+	})
+	if err != nil {
+		return storeError(err, "registration not found")
 	}
-	if req.ExpiresH <= 0 {
-		req.ExpiresH = 72
+	recordAudit(c, "registration.reject", regID, req.Reason)
+	if req.Notify {
+		notifyRejected([]Registration{rejected}, req.Reason)
 	}
-	token, err := randomToken(24)
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+func handleRejectedList(c *fiber.Ctx) error {
+	list, err := loadRejected()
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "token gen failed")
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load rejections")
 	}
-	inv := Invite{
-		Token:     token,
-		Email:     req.Email,
-		CreatedAt: time.Now().UTC(),
-		ExpiresAt: time.Now().UTC().Add(time.Duration(req.ExpiresH) * time.Hour),
-		Used:      false,
-	}
-	path := filepath.Join(dataDir, "invites.json")
-	var list []Invite
-	_ = readJSON(path, &list)
-	list = append(list, inv)
-	if err := writeJSON(path, list); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	return c.JSON(pruneRejected(list, time.Now().UTC()))
+}
+
+func handleInviteCreate(c *fiber.Ctx) error {
+	creator, err := currentUser(c)
+	if err != nil {
+		return err
 	}
-	return c.JSON(fiber.Map{"ok": true, "token": inv.Token, "expires_at": inv.ExpiresAt})
+	return createInvite(c, creator, false)
 }
 
 func handleInvitesList(c *fiber.Ctx) error {
-	path := filepath.Join(dataDir, "invites.json")
-	var invites []Invite
-	if err := readJSON(path, &invites); err != nil {
+	invites, err := store.Invites.List()
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to load invites")
 	}
-	return c.JSON(invites)
+	page, err := paginate(c, invites, inviteListSpec)
+	if err != nil {
+		return err
+	}
+	return c.JSON(page)
 }
 
 func handleInviteDelete(c *fiber.Ctx) error {
-	token := c.Params("token")
-	path := filepath.Join(dataDir, "invites.json")
-	var invites []Invite
-	if err := readJSON(path, &invites); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load invites")
-	}
-	
-	for i := range invites {
-		if invites[i].Token == token {
-			invites = append(invites[:i], invites[i+1:]...)
-			if err := writeJSON(path, invites); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
-		}
+	if err := store.Invites.Delete(c.Params("token")); err != nil {
+		return storeError(err, "invite not found")
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "invite not found")
+	recordAudit(c, "invite.delete", c.Params("token"), "")
+	return c.JSON(fiber.Map{"ok": true})
 }
 
 // VPN handlers
 func handleVPNEnable(c *fiber.Ctx) error {
 	userID := c.Params("id")
 	
-	// Load users
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
-	}
-	
 	// Find user and enable VPN
-	for i := range users {
-		if users[i].ID == userID {
-			if users[i].VPNConfig == nil {
-				users[i].VPNConfig = &VPNConfig{}
-			}
-			users[i].VPNConfig.Enabled = true
-			users[i].UpdatedAt = time.Now().UTC()
-			
-			if err := writeJSON(usersPath, users); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
+	_, err := store.Users.Update(userID, func(u *User) error {
+		if u.VPNConfig == nil {
+			u.VPNConfig = &VPNConfig{}
 		}
+		u.VPNConfig.Enabled = true
+		u.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "user not found")
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "user not found")
+	recordAudit(c, "vpn.enable", userID, "")
+	return c.JSON(fiber.Map{"ok": true})
 }
 
 func handleVPNDisable(c *fiber.Ctx) error {
 	userID := c.Params("id")
 	
-	// Load users
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
-	}
-	
 	// Find user and disable VPN
-	for i := range users {
-		if users[i].ID == userID {
-			if users[i].VPNConfig != nil {
-				users[i].VPNConfig.Enabled = false
-				users[i].UpdatedAt = time.Now().UTC()
-				
-				if err := writeJSON(usersPath, users); err != nil {
-					return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-				}
-				return c.JSON(fiber.Map{"ok": true})
-			}
+	_, err := store.Users.Update(userID, func(u *User) error {
+		if u.VPNConfig == nil {
+			return errNotFound
 		}
+		u.VPNConfig.Enabled = false
+		u.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "user not found")
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "user not found")
+	recordAudit(c, "vpn.disable", userID, "")
+	return c.JSON(fiber.Map{"ok": true})
 }
 
 func handleVPNConfigGet(c *fiber.Ctx) error {
-	userID := c.Params("user_id")
-	
-	// Load users
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+	user, err := store.Users.Get(c.Params("user_id"))
+	if err == nil && user.VPNConfig == nil {
+		err = errNotFound
 	}
-	
-	// Find user and return VPN config
-	for _, user := range users {
-		if user.ID == userID && user.VPNConfig != nil {
-			return c.JSON(user.VPNConfig)
-		}
+	if err != nil {
+		return storeError(err, "VPN config not found")
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "VPN config not found")
+	reveal, err := revealSecrets(c, user.ID)
+	if err != nil {
+		return err
+	}
+	if !reveal {
+		redactUser(&user)
+	}
+	return c.JSON(user.VPNConfig)
 }
 
 func handleVPNConfigUpdate(c *fiber.Ctx) error {
@@ -567,33 +828,24 @@ func handleVPNConfigUpdate(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 	}
 	
-	// Load users
-	usersPath := filepath.Join(dataDir, "users.json")
-	var users []User
-	if err := readJSON(usersPath, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
-	}
-	
 	// Find user and update VPN config
-	for i := range users {
-		if users[i].ID == userID {
-			if users[i].VPNConfig == nil {
-				users[i].VPNConfig = &VPNConfig{}
-			}
-			users[i].VPNConfig.PublicKey = req.PublicKey
-			users[i].VPNConfig.PrivateKey = req.PrivateKey
-			users[i].VPNConfig.IPAddress = req.IPAddress
-			users[i].VPNConfig.Enabled = req.Enabled
-			users[i].UpdatedAt = time.Now().UTC()
-			
-			if err := writeJSON(usersPath, users); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
+	_, err := store.Users.Update(userID, func(u *User) error {
+		if u.VPNConfig == nil {
+			u.VPNConfig = &VPNConfig{}
 		}
+		u.VPNConfig.PublicKey = req.PublicKey
+		if req.PrivateKey != redactedSecret {
+			u.VPNConfig.PrivateKey = req.PrivateKey
+		}
+		u.VPNConfig.IPAddress = req.IPAddress
+		u.VPNConfig.Enabled = req.Enabled
+		u.UpdatedAt = time.Now().UTC()
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "user not found")
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "user not found")
+	return c.JSON(fiber.Map{"ok": true})
 }
 
 func handleVPNStatus(c *fiber.Ctx) error {
@@ -608,12 +860,24 @@ func handleVPNStatus(c *fiber.Ctx) error {
 
 // TeamSpeak handlers
 func handleTeamSpeakUsersList(c *fiber.Ctx) error {
-	path := filepath.Join(dataDir, "teamspeak_users.json")
-	var users []TeamSpeakUser
-	if err := readJSON(path, &users); err != nil {
+	users, err := store.TeamSpeakUsers.List()
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "failed to load TeamSpeak users")
 	}
-	return c.JSON(users)
+	page, err := paginate(c, users, teamSpeakUserListSpec)
+	if err != nil {
+		return err
+	}
+	reveal, err := revealSecrets(c, "")
+	if err != nil {
+		return err
+	}
+	if !reveal {
+		for i := range page.Items {
+			redactTeamSpeakUser(&page.Items[i])
+		}
+	}
+	return c.JSON(page)
 }
 
 func handleTeamSpeakUserCreate(c *fiber.Ctx) error {
@@ -622,17 +886,45 @@ func handleTeamSpeakUserCreate(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 	}
 	
+	if req.UserID != "" {
+		if _, err := store.Users.Get(req.UserID); errors.Is(err, errNotFound) {
+			return fiber.NewError(fiber.StatusBadRequest, "unknown user_id")
+		} else if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+		}
+		if _, err := teamSpeakAccountOf(req.UserID); err == nil {
+			return fiber.NewError(fiber.StatusConflict, "user already has a TeamSpeak account")
+		} else if !errors.Is(err, errNotFound) {
+			return fiber.NewError(fiber.StatusInternalServerError, "failed to load TeamSpeak users")
+		}
+	}
+	
 	req.ID = generateID()
-	path := filepath.Join(dataDir, "teamspeak_users.json")
-	var users []TeamSpeakUser
-	_ = readJSON(path, &users)
-	users = append(users, req)
-	if err := writeJSON(path, users); err != nil {
+	if err := store.TeamSpeakUsers.Create(req); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
+	if req.UserID != "" {
+		// A linked account starts in the server group the user's groups grant.
+		syncGroupAccess([]string{req.UserID})
+	}
 	return c.JSON(fiber.Map{"ok": true, "id": req.ID})
 }
 
+// teamSpeakAccountOf returns the TeamSpeak account linked to the user with
+// userID, or errNotFound. Accounts have IDs of their own.
+func teamSpeakAccountOf(userID string) (TeamSpeakUser, error) {
+	accounts, err := store.TeamSpeakUsers.List()
+	if err != nil {
+		return TeamSpeakUser{}, err
+	}
+	for _, ts := range accounts {
+		if ts.UserID == userID {
+			return ts, nil
+		}
+	}
+	return TeamSpeakUser{}, errNotFound
+}
+
 func handleTeamSpeakUserUpdate(c *fiber.Ctx) error {
 	userID := c.Params("id")
 	var req TeamSpeakUser
@@ -640,47 +932,24 @@ func handleTeamSpeakUserUpdate(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 	}
 	
-	path := filepath.Join(dataDir, "teamspeak_users.json")
-	var users []TeamSpeakUser
-	if err := readJSON(path, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load TeamSpeak users")
-	}
-	
-	for i := range users {
-		if users[i].ID == userID {
-			users[i].Username = req.Username
-			users[i].Group = req.Group
-			users[i].Status = req.Status
-			
-			if err := writeJSON(path, users); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
-		}
+	_, err := store.TeamSpeakUsers.Update(userID, func(u *TeamSpeakUser) error {
+		u.Username = req.Username
+		u.Group = req.Group
+		u.Status = req.Status
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "TeamSpeak user not found")
 	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "TeamSpeak user not found")
+	return c.JSON(fiber.Map{"ok": true})
 }
 
 func handleTeamSpeakUserDelete(c *fiber.Ctx) error {
-	userID := c.Params("id")
-	path := filepath.Join(dataDir, "teamspeak_users.json")
-	var users []TeamSpeakUser
-	if err := readJSON(path, &users); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "failed to load TeamSpeak users")
+	if err := store.TeamSpeakUsers.Delete(c.Params("id")); err != nil {
+		return storeError(err, "TeamSpeak user not found")
 	}
-	
-	for i := range users {
-		if users[i].ID == userID {
-			users = append(users[:i], users[i+1:]...)
-			if err := writeJSON(path, users); err != nil {
-				return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-			}
-			return c.JSON(fiber.Map{"ok": true})
-		}
-	}
-	
-	return fiber.NewError(fiber.StatusNotFound, "TeamSpeak user not found")
+	recordAudit(c, "teamspeak_user.delete", c.Params("id"), "")
+	return c.JSON(fiber.Map{"ok": true})
 }
 
 func handleTeamSpeakChannelsList(c *fiber.Ctx) error {
@@ -724,8 +993,7 @@ func handleCaptchaChallenge(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusInternalServerError, "token gen failed")
 	}
 	hash := sha256.Sum256([]byte(strconv.Itoa(sum)))
-	captchaStore.Store(id, captchaEntry{answerHash: hash[:], expiresAt: time.Now().Add(captchaExpiration)})
-	if err := saveCaptchaStore(); err != nil {
+	if err := store.Captchas.Put(id, captchaEntry{answerHash: hash[:], expiresAt: time.Now().Add(captchaExpiration)}); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "persist failed")
 	}
 	return c.JSON(captchaChallenge{ID: id, Question: fmt.Sprintf("%d + %d", a, b)})
@@ -739,25 +1007,34 @@ func handleCaptchaVerify(c *fiber.Ctx) error {
 	if err := c.BodyParser(&req); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
 	}
-	val, ok := captchaStore.Load(req.ID)
-	if !ok {
+	if err := consumeCaptcha(req.ID, req.Answer); err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+// consumeCaptcha checks answer against challenge id and removes the
+// challenge on success so it cannot be replayed.
+func consumeCaptcha(id string, answer int) error {
+	entry, err := store.Captchas.Take(id)
+	if errors.Is(err, errNotFound) {
 		return fiber.NewError(fiber.StatusBadRequest, "unknown captcha")
 	}
-	entry := val.(captchaEntry)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "persist failed")
+	}
 	if time.Now().After(entry.expiresAt) {
-		captchaStore.Delete(req.ID)
-		_ = saveCaptchaStore()
 		return fiber.NewError(fiber.StatusBadRequest, "expired captcha")
 	}
-	hash := sha256.Sum256([]byte(strconv.Itoa(req.Answer)))
+	hash := sha256.Sum256([]byte(strconv.Itoa(answer)))
 	if !bytes.Equal(hash[:], entry.answerHash) {
+		// A wrong answer leaves the challenge open for another try.
+		if err := store.Captchas.Put(id, entry); err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "persist failed")
+		}
 		return fiber.NewError(fiber.StatusBadRequest, "invalid answer")
 	}
-	captchaStore.Delete(req.ID)
-	if err := saveCaptchaStore(); err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, "persist failed")
-	}
-	return c.JSON(fiber.Map{"ok": true})
+	return nil
 }
 
 // Utility functions
@@ -768,8 +1045,19 @@ func generateID() string {
 }
 
 func generateJWT(user *User) (string, error) {
-	// Simplified JWT generation - in production use proper JWT library
-	payload := fmt.Sprintf("%s:%s:%s", user.ID, user.Email, user.Role)
+	// Simplified JWT generation - in production use proper JWT library.
+	// The trailing session ID ties the token to a revocable session; the
+	// comma-separated group names before it are informational, checks
+	// use the live membership.
+	groups, err := groupNamesOf(user)
+	if err != nil {
+		return "", err
+	}
+	session, err := createSession(user.ID)
+	if err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%s:%s:%s:%s:%s", user.ID, user.Email, user.Role, strings.Join(groups, ","), session.ID)
 	return base64.StdEncoding.EncodeToString([]byte(payload)), nil
 }
 
@@ -835,39 +1123,34 @@ func randomToken(n int) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// readJSON decodes the data file at path after checking it against its
+// checksum. A corrupt file yields errCorruptFile, never an empty value.
 func readJSON(path string, v any) error {
-	f, err := os.Open(path)
+	raw, err := checkDataFile(path)
 	if err != nil {
+		if errors.Is(err, errCorruptFile) {
+			log.Printf("CORRUPT DATA FILE %v", err)
+		}
 		return err
 	}
-	defer f.Close()
-	return json.NewDecoder(f).Decode(v)
+	return json.Unmarshal(raw, v)
 }
 
+// writeJSON durably replaces the data file at path with v (see
+// writeDataFile). A file that exists but fails its check is left alone:
+// writing over it would destroy whatever could still be recovered.
 func writeJSON(path string, v any) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return err
-	}
-	tmp := path + ".tmp"
-	f, err := os.Create(tmp)
-	if err != nil {
-		return err
-	}
-	enc := json.NewEncoder(f)
-	if err := enc.Encode(v); err != nil {
-		f.Close()
-		os.Remove(tmp)
-		return err
-	}
-	if err := f.Close(); err != nil {
-		os.Remove(tmp)
-		return err
-	}
-	if err := os.Rename(tmp, path); err != nil {
-		os.Remove(tmp)
+	writes.enter()
+	defer writes.leave()
+	if _, err := checkDataFile(path); err != nil && !os.IsNotExist(err) {
+		if errors.Is(err, errCorruptFile) {
+			log.Printf("REFUSING TO OVERWRITE %v", err)
+		}
 		return err
 	}
-	return nil
+	return writeDataFile(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
 }
 
 func ensureDataFiles() {
@@ -878,59 +1161,9 @@ func ensureDataFiles() {
 	cleanupExpiredCaptchas()
 }
 
-func loadCaptchaStore() error {
-	var m map[string]captchaFileEntry
-	if err := readJSON(captchaStoreFile(), &m); err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	now := time.Now()
-	for k, v := range m {
-		if now.After(v.ExpiresAt) {
-			continue
-		}
-		hash, err := base64.StdEncoding.DecodeString(v.AnswerHash)
-		if err != nil {
-			continue
-		}
-		captchaStore.Store(k, captchaEntry{answerHash: hash, expiresAt: v.ExpiresAt})
-	}
-	return saveCaptchaStore()
-}
-
-func saveCaptchaStore() error {
-	m := make(map[string]captchaFileEntry)
-	captchaStore.Range(func(k, v any) bool {
-		entry := v.(captchaEntry)
-		m[k.(string)] = captchaFileEntry{
-			AnswerHash: base64.StdEncoding.EncodeToString(entry.answerHash),
-			ExpiresAt:  entry.expiresAt,
-		}
-		return true
-	})
-	return writeJSON(captchaStoreFile(), m)
-}
-
-func captchaStoreFile() string {
-	return filepath.Join(dataDir, "captcha_store.json")
-}
-
-func cleanupExpiredCaptchas() {
-	now := time.Now()
-	changed := false
-	captchaStore.Range(func(k, v any) bool {
-		entry := v.(captchaEntry)
-		if now.After(entry.expiresAt) {
-			captchaStore.Delete(k)
-			changed = true
-		}
-		return true
-	})
-	if changed {
-		_ = saveCaptchaStore()
-	}
+func cleanupExpiredCaptchas() error {
+	_, err := store.Captchas.DeleteExpired(time.Now())
+	return err
 }
 
 func cryptoRandomInt(max int) (int, error) {
@@ -941,11 +1174,3 @@ func cryptoRandomInt(max int) (int, error) {
 	return int(n.Int64()), nil
 }
 
-func init() {
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			cleanupExpiredCaptchas()
-		}
-	}()
-}
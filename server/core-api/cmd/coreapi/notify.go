@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Notifier delivers short plain-text messages to applicants and members.
+type Notifier interface {
+	Notify(to, subject, body string) error
+}
+
+var notifier Notifier = newNotifier()
+
+// newNotifier picks SMTP delivery when SMTP_HOST is configured and falls
+// back to writing notifications to the log otherwise.
+func newNotifier() Notifier {
+	host := strings.TrimSpace(envOr("SMTP_HOST", ""))
+	if host == "" {
+		return logNotifier{}
+	}
+	return smtpNotifier{
+		addr:     host + ":" + envOr("SMTP_PORT", "587"),
+		host:     host,
+		username: envOr("SMTP_USER", ""),
+		password: envOr("SMTP_PASSWORD", ""),
+		from:     envOr("SMTP_FROM", "safe-spac@localhost"),
+		timeout:  envDuration("SMTP_TIMEOUT", 30*time.Second),
+	}
+}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(to, subject, body string) error {
+	log.Printf("notify %s: %s", to, subject)
+	return nil
+}
+
+type smtpNotifier struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+	timeout  time.Duration // bounds the whole exchange, dial included
+}
+
+// Notify does what smtp.SendMail does, on a connection with a deadline so
+// a relay that stops answering cannot hang the caller.
+func (n smtpNotifier) Notify(to, subject, body string) error {
+	rcpt, msg, err := composeMessage(n.from, to, subject, body)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", n.addr, n.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(n.timeout)); err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+	if n.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.username, n.password, n.host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(n.from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(rcpt); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// composeMessage builds the message and returns the bare recipient
+// address. to comes from users, so it must parse as one address, and
+// neither it nor the subject may carry a line break into the headers.
+func composeMessage(from, to, subject, body string) (string, string, error) {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return "", "", errors.New("line break in mail header")
+	}
+	addr, err := mail.ParseAddress(to)
+	if err != nil {
+		return "", "", fmt.Errorf("recipient %q: %w", to, err)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, addr.Address, subject, body)
+	return addr.Address, msg, nil
+}
+
+// notify sends a message and only logs failures; a broken mail relay must
+// not fail the admin action that triggered it.
+func notify(to, subject, body string) bool {
+	if strings.TrimSpace(to) == "" {
+		return false
+	}
+	if err := notifier.Notify(to, subject, body); err != nil {
+		log.Printf("notify %s failed: %v", to, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every route in main() either is public, needs only a session (signedIn)
+// or declares one of these permissions (requires, requiresSelfOr). Admins
+// hold all of them; anyone else holds those of their role plus any granted
+// to them directly (User.Permissions).
+const (
+	permUsersRead         = "users.read"
+	permUsersManage       = "users.manage"
+	permRolesManage       = "roles.manage"
+	permGroupsManage      = "groups.manage"
+	permRegistrationsRead = "registrations.read"
+	// permApproveRegistrations also covers rejecting, vetoing and bulk
+	// actions.
+	permApproveRegistrations  = "registrations.approve"
+	permRegistrationsSettings = "registrations.settings"
+	permInvitesManage         = "invites.manage"
+	permPrivacyErase          = "privacy.erase"
+	permContainersRestart     = "containers.restart"
+	permJobsManage            = "jobs.manage"
+	permAuditRead             = "audit.read"
+	permKeysManage            = "keys.manage"
+	permRevealSecrets         = "secrets.reveal"
+	permBackupsManage         = "backups.manage"
+	permInstanceTransfer      = "instance.transfer"
+	permVPNRead               = "vpn.read"
+	permVPNManage             = "vpn.manage"
+	permTeamSpeakRead         = "teamspeak.read"
+	permTeamSpeakManage       = "teamspeak.manage"
+)
+
+type permissionInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// permissionCatalogue lists every permission, in the order the admin panel
+// shows them.
+var permissionCatalogue = []permissionInfo{
+	{permUsersRead, "List and view users and their groups and permissions"},
+	{permUsersManage, "Create, edit, suspend and delete users"},
+	{permRolesManage, "Define roles and assign them to users"},
+	{permGroupsManage, "Manage groups and their members"},
+	{permRegistrationsRead, "View pending and rejected registrations"},
+	{permApproveRegistrations, "Approve, reject and veto registrations"},
+	{permRegistrationsSettings, "Edit registration rules, fields and the email policy"},
+	{permInvitesManage, "Create, send and revoke invites and set invite quotas"},
+	{permPrivacyErase, "Erase user data and view erasure requests"},
+	{permContainersRestart, "Restart service containers"},
+	{permJobsManage, "View and run background jobs"},
+	{permAuditRead, "Read the audit log"},
+	{permKeysManage, "View and rotate data encryption keys"},
+	{permRevealSecrets, "See other users' VPN private keys and TeamSpeak passwords"},
+	{permBackupsManage, "Create, download, verify and restore backups"},
+	{permInstanceTransfer, "Export and import the whole instance"},
+	{permVPNRead, "View VPN configurations, status and policies"},
+	{permVPNManage, "Change VPN configurations and keys and switch peers on or off"},
+	{permTeamSpeakRead, "View TeamSpeak users"},
+	{permTeamSpeakManage, "Manage TeamSpeak users and channels"},
+}
+
+func knownPermission(perm string) bool {
+	return slices.ContainsFunc(permissionCatalogue, func(p permissionInfo) bool { return p.Name == perm })
+}
+
+// CustomRole is a named set of permissions an admin defined. Users hold it
+// by name in User.Role, like the built-in roles; the name is fixed once
+// created.
+type CustomRole struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Permissions []string  `json:"permissions"`
+	Builtin     bool      `json:"builtin,omitempty"` // admin and user; only in listings
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func rolesFile() string {
+	return filepath.Join(dataDir, "roles.json")
+}
+
+// rolesCache keeps roles.json decoded between permission checks, which
+// every guarded request makes. As cachedCollection does without a
+// watcher, each load compares the file's checksum, so edits by hand or by
+// another process are still picked up.
+var rolesCache struct {
+	sync.Mutex
+	stamp string
+	roles []CustomRole
+}
+
+func loadRoles() ([]CustomRole, error) {
+	// The checksum is read first: a write landing before the data is read
+	// leaves a stale stamp and the next load reads the file again.
+	stamp, err := readChecksum(rolesFile() + checksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	rolesCache.Lock()
+	defer rolesCache.Unlock()
+	if stamp != "" && stamp == rolesCache.stamp {
+		return slices.Clone(rolesCache.roles), nil
+	}
+	var roles []CustomRole
+	if err := readJSON(rolesFile(), &roles); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	rolesCache.stamp, rolesCache.roles = stamp, roles
+	return slices.Clone(roles), nil
+}
+
+// validRole returns 400 unless role is built in or defined.
+func validRole(role string) error {
+	if slices.Contains(userRoles, role) {
+		return nil
+	}
+	roles, err := loadRoles()
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(roles, func(r CustomRole) bool { return r.Name == role }) {
+		return fiber.NewError(fiber.StatusBadRequest, "unknown role "+role)
+	}
+	return nil
+}
+
+// rolePermissions returns the permissions role grants.
+func rolePermissions(role string, roles []CustomRole) []string {
+	if role == "admin" {
+		perms := make([]string, len(permissionCatalogue))
+		for i, p := range permissionCatalogue {
+			perms[i] = p.Name
+		}
+		return perms
+	}
+	if i := slices.IndexFunc(roles, func(r CustomRole) bool { return r.Name == role }); i >= 0 {
+		return roles[i].Permissions
+	}
+	return nil
+}
+
+// effectivePermissions returns what user may do, sorted.
+func effectivePermissions(user *User) ([]string, error) {
+	roles, err := loadRoles()
+	if err != nil {
+		return nil, err
+	}
+	perms := append(slices.Clone(rolePermissions(user.Role, roles)), user.Permissions...)
+	sort.Strings(perms)
+	return slices.Compact(perms), nil
+}
+
+// requires is the guard a route declares: the caller must be signed in and
+// hold perm.
+func requires(perm string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if _, err := requirePermission(c, perm); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+// requiresSelfOr lets users at their own record, named by the route
+// parameter param; anyone else needs perm.
+func requiresSelfOr(perm, param string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := requireCaller(c)
+		if err != nil {
+			return err
+		}
+		if user.ID != c.Params(param) && !hasPermission(user, perm) {
+			return fiber.NewError(fiber.StatusForbidden, "missing permission "+perm)
+		}
+		return c.Next()
+	}
+}
+
+// signedIn guards the routes where the handler itself decides what the
+// caller may see, such as /api/me.
+func signedIn(c *fiber.Ctx) error {
+	if _, err := requireCaller(c); err != nil {
+		return err
+	}
+	return c.Next()
+}
+
+// checkGrant refuses to let a caller who is not an admin hand out the admin
+// role or permissions they do not hold themselves.
+func checkGrant(c *fiber.Ctx, role string, perms []string) error {
+	caller, err := requireCaller(c)
+	if err != nil || caller.Role == "admin" {
+		return err
+	}
+	if role == "admin" {
+		return fiber.NewError(fiber.StatusForbidden, "only admins can grant the admin role")
+	}
+	roles, err := loadRoles()
+	if err != nil {
+		return err
+	}
+	for _, p := range append(slices.Clone(rolePermissions(role, roles)), perms...) {
+		if !hasPermission(caller, p) {
+			return fiber.NewError(fiber.StatusForbidden, "cannot grant "+p+" without holding it")
+		}
+	}
+	return nil
+}
+
+// checkTarget refuses to let a caller who is not an admin change an
+// admin's role or status.
+func checkTarget(c *fiber.Ctx, id string) error {
+	caller, err := requireCaller(c)
+	if err != nil || caller.Role == "admin" {
+		return err
+	}
+	target, err := store.Users.Get(id)
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	if target.Role == "admin" {
+		return fiber.NewError(fiber.StatusForbidden, "only admins can change an admin")
+	}
+	return nil
+}
+
+// validate normalises r and checks its name and permissions.
+func (r *CustomRole) validate() error {
+	r.Name = strings.ToLower(strings.TrimSpace(r.Name))
+	if !groupNamePattern.MatchString(r.Name) {
+		return fiber.NewError(fiber.StatusBadRequest, "role name must be lowercase letters, digits, - or _")
+	}
+	if slices.Contains(userRoles, r.Name) {
+		return fiber.NewError(fiber.StatusBadRequest, "role "+r.Name+" is built in")
+	}
+	for _, p := range r.Permissions {
+		if !knownPermission(p) {
+			return fiber.NewError(fiber.StatusBadRequest, "unknown permission "+p)
+		}
+	}
+	sort.Strings(r.Permissions)
+	r.Permissions = slices.Compact(r.Permissions)
+	if r.Permissions == nil {
+		r.Permissions = []string{}
+	}
+	r.Builtin = false
+	return nil
+}
+
+func handlePermissionsList(c *fiber.Ctx) error {
+	return c.JSON(permissionCatalogue)
+}
+
+// handleRolesList lists the built-in roles first, then the custom ones.
+func handleRolesList(c *fiber.Ctx) error {
+	roles, err := loadRoles()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load roles")
+	}
+	out := []CustomRole{
+		{Name: "admin", Description: "Everything", Permissions: rolePermissions("admin", nil), Builtin: true},
+		{Name: "user", Description: "Own account, VPN and invites only", Permissions: []string{}, Builtin: true},
+	}
+	return c.JSON(append(out, roles...))
+}
+
+func handleRoleCreate(c *fiber.Ctx) error {
+	var req CustomRole
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	if err := req.validate(); err != nil {
+		return err
+	}
+	if err := checkGrant(c, "", req.Permissions); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	req.CreatedAt, req.UpdatedAt = now, now
+	var roles []CustomRole
+	err := updateJSON(rolesFile(), &roles, func() error {
+		if slices.ContainsFunc(roles, func(r CustomRole) bool { return r.Name == req.Name }) {
+			return fiber.NewError(fiber.StatusConflict, "role "+req.Name+" already exists")
+		}
+		roles = append(roles, req)
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "role not found")
+	}
+	recordAudit(c, "role.create", req.Name, strings.Join(req.Permissions, ","))
+	return c.Status(fiber.StatusCreated).JSON(req)
+}
+
+// handleRoleUpdate replaces a role's description and permissions. Holders
+// get the new permissions with their next request.
+func handleRoleUpdate(c *fiber.Ctx) error {
+	var req CustomRole
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	req.Name = c.Params("name")
+	if err := req.validate(); err != nil {
+		return err
+	}
+	if err := checkGrant(c, "", req.Permissions); err != nil {
+		return err
+	}
+	var roles []CustomRole
+	err := updateJSON(rolesFile(), &roles, func() error {
+		i := slices.IndexFunc(roles, func(r CustomRole) bool { return r.Name == req.Name })
+		if i < 0 {
+			return errNotFound
+		}
+		req.CreatedAt, req.UpdatedAt = roles[i].CreatedAt, time.Now().UTC()
+		roles[i] = req
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "role not found")
+	}
+	recordAudit(c, "role.update", req.Name, strings.Join(req.Permissions, ","))
+	return c.JSON(req)
+}
+
+// handleRoleDelete removes a role nobody holds; users who are not deleted
+// must be given another role first.
+func handleRoleDelete(c *fiber.Ctx) error {
+	name := c.Params("name")
+	// roles.json stays locked, and is rewritten while users.json is locked
+	// too, so a role cannot be assigned between the check and the delete:
+	// assignments validate the role under the users lock.
+	unlock, err := lockFile(rolesFile())
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	defer unlock()
+	err = store.Users.Mutate(func(users []User) ([]User, error) {
+		if slices.ContainsFunc(users, func(u User) bool { return u.Role == name && u.Status != statusDeleted }) {
+			return nil, fiber.NewError(fiber.StatusConflict, "role "+name+" is still assigned")
+		}
+		var roles []CustomRole
+		if err := readJSON(rolesFile(), &roles); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		i := slices.IndexFunc(roles, func(r CustomRole) bool { return r.Name == name })
+		if i < 0 {
+			return nil, errNotFound
+		}
+		if err := writeJSON(rolesFile(), slices.Delete(roles, i, i+1)); err != nil {
+			return nil, err
+		}
+		return nil, errUnchanged
+	})
+	if err != nil {
+		return storeError(err, "role not found")
+	}
+	recordAudit(c, "role.delete", name, "")
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+// handleUserPermissions shows what a user may do and where it comes from.
+func handleUserPermissions(c *fiber.Ctx) error {
+	user, err := store.Users.Get(c.Params("id"))
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	roles, err := loadRoles()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load roles")
+	}
+	perms, err := effectivePermissions(&user)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load roles")
+	}
+	fromRole := rolePermissions(user.Role, roles)
+	direct := user.Permissions
+	if fromRole == nil {
+		fromRole = []string{}
+	}
+	if direct == nil {
+		direct = []string{}
+	}
+	if perms == nil {
+		perms = []string{}
+	}
+	return c.JSON(fiber.Map{"user_id": user.ID, "role": user.Role, "permissions": perms, "from_role": fromRole, "direct": direct})
+}
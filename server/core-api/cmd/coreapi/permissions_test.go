@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCustomRolePermissions(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "m1", Email: "mod@example.org", Role: "user", Status: statusActive})
+	_ = store.Users.Create(User{ID: "u1", Email: "member@example.org", Role: "user", Status: statusActive})
+	app := testApp()
+	admin := tokenFor(t, "a1")
+
+	for body, want := range map[string]int{
+		`{"name":"admin"}`: fiber.StatusBadRequest,
+		`{"name":"x","permissions":["vpn.everything"]}`:                                                      fiber.StatusBadRequest,
+		`{"name":"moderator","permissions":["registrations.read","registrations.approve","invites.manage"]}`: fiber.StatusCreated,
+	} {
+		if code, _ := send(t, app, "POST", "/api/admin/roles", admin, body); code != want {
+			t.Fatalf("create role %s: %d, want %d", body, code, want)
+		}
+	}
+	if code, _ := send(t, app, "POST", "/api/admin/roles", admin, `{"name":"moderator"}`); code != fiber.StatusConflict {
+		t.Fatalf("duplicate role: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/m1/role", admin, `{"role":"moderator","reason":"helps with sign-ups"}`); code != 200 {
+		t.Fatalf("assign role: %d", code)
+	}
+
+	mod := tokenFor(t, "m1")
+	for _, step := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/api/admin/registrations", mod, 200},
+		{"GET", "/api/admin/invites", mod, 200},
+		{"POST", "/api/vpn/config/u1", mod, fiber.StatusForbidden},
+		{"POST", "/api/admin/authelia/restart", mod, fiber.StatusForbidden},
+		{"GET", "/api/admin/registrations", "", fiber.StatusUnauthorized},
+		{"GET", "/api/admin/registrations", tokenFor(t, "u1"), fiber.StatusForbidden},
+		{"GET", "/api/me/export", tokenFor(t, "u1"), 200},
+		{"GET", "/api/users/u1/permissions", tokenFor(t, "u1"), 200},
+		{"GET", "/api/users/u1/permissions", mod, fiber.StatusForbidden},
+	} {
+		if code, _ := send(t, app, step.method, step.path, step.token, `{}`); code != step.want {
+			t.Fatalf("%s %s: %d, want %d", step.method, step.path, code, step.want)
+		}
+	}
+
+	var got struct {
+		Role        string   `json:"role"`
+		Permissions []string `json:"permissions"`
+	}
+	sendFor(t, app, "GET", "/api/users/m1/permissions", admin, "", &got)
+	if got.Role != "moderator" || !slices.Equal(got.Permissions, []string{"invites.manage", "registrations.approve", "registrations.read"}) {
+		t.Fatalf("effective permissions: %+v", got)
+	}
+
+	if code, _ := send(t, app, "DELETE", "/api/admin/roles/moderator", admin, ``); code != fiber.StatusConflict {
+		t.Fatalf("delete assigned role: %d", code)
+	}
+}
+
+func TestRoleGrantLimits(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "a2", Email: "second@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "l1", Email: "lead@example.org", Role: "user", Status: statusActive,
+		Permissions: []string{permRolesManage, permApproveRegistrations, permUsersManage}})
+	_ = store.Users.Create(User{ID: "u1", Email: "member@example.org", Role: "user", Status: statusActive})
+	app := testApp()
+	lead := tokenFor(t, "l1")
+
+	if code, _ := send(t, app, "POST", "/api/admin/roles", lead, `{"name":"vpn-ops","permissions":["vpn.manage"]}`); code != fiber.StatusForbidden {
+		t.Fatalf("grant unheld permission: %d", code)
+	}
+	if code, _ := send(t, app, "POST", "/api/admin/roles", lead, `{"name":"approver","permissions":["registrations.approve"]}`); code != fiber.StatusCreated {
+		t.Fatalf("grant held permission: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/u1/role", lead, `{"role":"approver","reason":"trusted"}`); code != 200 {
+		t.Fatalf("assign held role: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/u1/role", lead, `{"role":"admin","reason":"why not"}`); code != fiber.StatusForbidden {
+		t.Fatalf("grant admin: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/a2/role", lead, `{"role":"user","reason":"coup"}`); code != fiber.StatusForbidden {
+		t.Fatalf("demote admin: %d", code)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/a2", lead, `{"email":"lead+takeover@example.org"}`); code != fiber.StatusForbidden {
+		t.Fatalf("rewrite admin email: %d", code)
+	}
+	if u, _ := store.Users.Get("a2"); u.Email != "second@example.org" {
+		t.Fatalf("admin email changed to %q", u.Email)
+	}
+	if code, _ := send(t, app, "PUT", "/api/users/u1", lead, `{"email":"member@example.org","username":"member"}`); code != 200 {
+		t.Fatalf("update member: %d", code)
+	}
+}
+
+func TestRolesCache(t *testing.T) {
+	dataDir = t.TempDir()
+	if err := writeJSON(rolesFile(), []CustomRole{{Name: "helper", Permissions: []string{permUsersRead}}}); err != nil {
+		t.Fatal(err)
+	}
+	user := &User{ID: "h1", Role: "helper"}
+	if !hasPermission(user, permUsersRead) {
+		t.Fatal("role permission not granted")
+	}
+
+	// While the checksum matches, the file is not read again.
+	raw, _ := os.ReadFile(rolesFile())
+	if err := os.WriteFile(rolesFile(), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPermission(user, permUsersRead) {
+		t.Fatal("unchanged roles re-read")
+	}
+	_ = os.WriteFile(rolesFile(), raw, 0o600)
+
+	// Any write, by hand or by another process, moves the checksum.
+	if err := writeJSON(rolesFile(), []CustomRole{{Name: "helper", Permissions: []string{permAuditRead}}}); err != nil {
+		t.Fatal(err)
+	}
+	if hasPermission(user, permUsersRead) || !hasPermission(user, permAuditRead) {
+		t.Fatal("edited role not picked up")
+	}
+}
+
+func TestRoleDeleteRacingAssignment(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "u1", Email: "member@example.org", Role: "user", Status: statusActive})
+	_ = writeJSON(rolesFile(), []CustomRole{{Name: "helper", Permissions: []string{permUsersRead}}})
+	app, admin := testApp(), tokenFor(t, "a1")
+
+	// Hold users.json as an assignment in progress would.
+	unlock, err := lockFile(filepath.Join(dataDir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan int, 1)
+	go func() {
+		req := httptest.NewRequest("DELETE", "/api/admin/roles/helper", nil)
+		req.Header.Set("Authorization", "Bearer "+admin)
+		resp, err := app.Test(req, -1)
+		if err != nil {
+			done <- 0
+			return
+		}
+		done <- resp.StatusCode
+	}()
+	select {
+	case code := <-done:
+		t.Fatalf("role delete checked users while they were locked: %d", code)
+	case <-time.After(200 * time.Millisecond):
+	}
+	var users []User
+	_ = readJSON(filepath.Join(dataDir, "users.json"), &users)
+	for i := range users {
+		if users[i].ID == "u1" {
+			users[i].Role = "helper"
+		}
+	}
+	_ = writeJSON(filepath.Join(dataDir, "users.json"), users)
+	unlock()
+
+	if code := <-done; code != fiber.StatusConflict {
+		t.Fatalf("delete of a role assigned meanwhile: %d", code)
+	}
+	if err := validRole("helper"); err != nil {
+		t.Fatalf("assigned role was deleted: %v", err)
+	}
+}
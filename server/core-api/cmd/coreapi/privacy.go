@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// erasureGrace is how long a member's erasure request waits, and can be
+// cancelled, before the erasure_requests job carries it out. 0 erases at
+// once.
+var erasureGrace = envDuration("ERASURE_GRACE", 24*time.Hour)
+
+// Tombstone is all that is left of an erased user: enough to show the
+// erasure happened and to explain dangling user IDs in invites, approvals
+// and the audit log, and nothing that identifies the person.
+type Tombstone struct {
+	UserID      string     `json:"user_id"`
+	RequestedAt *time.Time `json:"requested_at,omitempty"`
+	ErasedAt    time.Time  `json:"erased_at"`
+	ErasedBy    string     `json:"erased_by"` // "self", "erasure job" or the admin
+}
+
+func tombstonesFile() string {
+	return filepath.Join(dataDir, "tombstones.json")
+}
+
+func loadTombstones() ([]Tombstone, error) {
+	var list []Tombstone
+	if err := readJSON(tombstonesFile(), &list); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// personalData is everything GET /api/me/export returns about the caller.
+type personalData struct {
+	ExportedAt     time.Time      `json:"exported_at"`
+	Profile        User           `json:"profile"`
+	TeamSpeak      *TeamSpeakUser `json:"teamspeak,omitempty"`
+	InvitesCreated []Invite       `json:"invites_created"`
+	InviteRedeemed *Invite        `json:"invite_redeemed,omitempty"`
+	Sessions       []sessionInfo  `json:"sessions"`
+	Audit          []AuditEntry   `json:"audit"`
+}
+
+// sessionInfo leaves out the session ID, which is half of a live token.
+type sessionInfo struct {
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// collectPersonalData gathers the records tied to u. Secrets are included
+// in clear: they are the caller's own.
+func collectPersonalData(u User) (personalData, error) {
+	hidePassword(&u)
+	data := personalData{ExportedAt: time.Now().UTC(), Profile: u, InvitesCreated: []Invite{}, Sessions: []sessionInfo{}, Audit: []AuditEntry{}}
+	ts, err := teamSpeakAccountOf(u.ID)
+	switch {
+	case err == nil:
+		data.TeamSpeak = &ts
+	case !errors.Is(err, errNotFound):
+		return data, err
+	}
+	invites, err := store.Invites.List()
+	if err != nil {
+		return data, err
+	}
+	for i := range invites {
+		if invites[i].CreatedBy == u.ID {
+			data.InvitesCreated = append(data.InvitesCreated, invites[i])
+		}
+		if invites[i].RedeemedBy == u.ID {
+			data.InviteRedeemed = &invites[i]
+		}
+	}
+	sessions, err := store.Sessions.List()
+	if err != nil {
+		return data, err
+	}
+	for _, s := range sessions {
+		if s.UserID == u.ID {
+			data.Sessions = append(data.Sessions, sessionInfo{s.CreatedAt, s.ExpiresAt})
+		}
+	}
+	entries, err := store.Audit.List(0)
+	if err != nil {
+		return data, err
+	}
+	name := usernameOf(&u)
+	for _, e := range entries {
+		if e.Target == u.ID || (name != "" && e.Actor == name) {
+			data.Audit = append(data.Audit, e)
+		}
+	}
+	return data, nil
+}
+
+// erasureResult counts what eraseUser removed or anonymised.
+type erasureResult struct {
+	UserID            string `json:"user_id"`
+	Sessions          int    `json:"sessions"`
+	InvitesDeleted    int    `json:"invites_deleted"`
+	InvitesAnonymized int    `json:"invites_anonymized"`
+	TeamSpeak         bool   `json:"teamspeak"`
+	AutheliaRemoved   bool   `json:"authelia"`
+	Rejections        int    `json:"rejections"`
+	BlockedSignups    int    `json:"blocked_signups"`
+	Approvals         int    `json:"approvals"`
+	AuditEntries      int    `json:"audit_entries"`
+}
+
+// erasedName stands in for an erased user's name in records that keep
+// their place, such as audit entries and approvals. The tombstone explains
+// the ID.
+func erasedName(id string) string {
+	return "erased:" + id
+}
+
+// eraseUser removes the user with id from every file that holds personal
+// data and leaves a Tombstone. The tombstone is written first and each
+// step tolerates records already gone, so a failed erasure can simply be
+// run again. The last active admin cannot be erased.
+func eraseUser(id, by string) (erasureResult, error) {
+	res := erasureResult{UserID: id}
+	u, err := store.Users.Get(id)
+	if err != nil {
+		return res, err
+	}
+	if u.Role == "admin" {
+		users, err := store.Users.List()
+		if err != nil {
+			return res, err
+		}
+		if countActiveAdmins(users) <= 1 && u.Status == statusActive {
+			return res, fiber.NewError(fiber.StatusConflict, "cannot erase the last active admin")
+		}
+	}
+
+	var tombstones []Tombstone
+	err = updateJSON(tombstonesFile(), &tombstones, func() error {
+		for _, t := range tombstones {
+			if t.UserID == id {
+				return errUnchanged
+			}
+		}
+		tombstones = append(tombstones, Tombstone{UserID: id, RequestedAt: u.ErasureRequestedAt, ErasedAt: time.Now().UTC(), ErasedBy: by})
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	// Access goes first.
+	if res.Sessions, err = removeSessions(func(s Session) bool { return s.UserID == id }); err != nil {
+		return res, err
+	}
+	if res.AutheliaRemoved, err = removeAutheliaUser(u.Username, u.Email); err != nil {
+		return res, fmt.Errorf("authelia: %w", err)
+	}
+	ts, err := teamSpeakAccountOf(id)
+	if err == nil {
+		err = store.TeamSpeakUsers.Delete(ts.ID)
+		res.TeamSpeak = err == nil
+	}
+	if err != nil && !errors.Is(err, errNotFound) {
+		return res, err
+	}
+	// Unredeemed invites go; redeemed ones stay for the invite tree, which
+	// only needs the IDs, but lose the address they were sent to.
+	err = store.Invites.Mutate(func(invites []Invite) ([]Invite, error) {
+		kept := invites[:0]
+		for _, inv := range invites {
+			switch {
+			case inv.CreatedBy == id && !inv.Used:
+				res.InvitesDeleted++
+				continue
+			case (inv.CreatedBy == id || inv.RedeemedBy == id) && inv.Email != "":
+				inv.Email = ""
+				inv.DeliveryError = ""
+				res.InvitesAnonymized++
+			}
+			kept = append(kept, inv)
+		}
+		if res.InvitesDeleted+res.InvitesAnonymized == 0 {
+			return nil, errUnchanged
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return res, err
+	}
+	if err := scrubRecords(&u, &res); err != nil {
+		return res, err
+	}
+	if err := store.Users.Delete(id); err != nil && !errors.Is(err, errNotFound) {
+		return res, err
+	}
+	return res, dropPreviousCopies()
+}
+
+// scrubRecords removes u's earlier rejected applications and blocked
+// sign-ups, and replaces u's name where u acted on others: rejections,
+// approvals and the audit log.
+func scrubRecords(u *User, res *erasureResult) error {
+	names := []string{u.Username, u.Email}
+	pseudonym := erasedName(u.ID)
+	var rejected []RejectedRegistration
+	err := updateJSON(rejectedFile(), &rejected, func() error {
+		kept, changed := rejected[:0], false
+		for _, r := range rejected {
+			if strings.EqualFold(r.Email, u.Email) {
+				res.Rejections++
+				changed = true
+				continue
+			}
+			if actorIn(r.RejectedBy, names) {
+				r.RejectedBy = pseudonym
+				changed = true
+			}
+			kept = append(kept, r)
+		}
+		if !changed {
+			return errUnchanged
+		}
+		rejected = kept
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("rejections: %w", err)
+	}
+	var blocked []BlockedSignup
+	err = updateJSON(blockedSignupsFile(), &blocked, func() error {
+		kept := blocked[:0]
+		for _, b := range blocked {
+			if strings.EqualFold(b.Email, u.Email) {
+				res.BlockedSignups++
+				continue
+			}
+			kept = append(kept, b)
+		}
+		if res.BlockedSignups == 0 {
+			return errUnchanged
+		}
+		blocked = kept
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("blocked sign-ups: %w", err)
+	}
+	err = store.Registrations.Mutate(func(pending []Registration) ([]Registration, error) {
+		for i := range pending {
+			for j := range pending[i].Approvals {
+				if a := &pending[i].Approvals[j]; a.UserID == u.ID && a.Username != pseudonym {
+					a.Username = pseudonym
+					res.Approvals++
+				}
+			}
+		}
+		if res.Approvals == 0 {
+			return nil, errUnchanged
+		}
+		return pending, nil
+	})
+	if err != nil {
+		return fmt.Errorf("approvals: %w", err)
+	}
+	if res.AuditEntries, err = store.Audit.RenameActor(names, pseudonym); err != nil {
+		return fmt.Errorf("audit: %w", err)
+	}
+	return nil
+}
+
+// removeAutheliaUser deletes the entries of the Authelia users file whose
+// name is one of names or whose email matches, keeping the rest of the
+// file, comments included. It reports whether anything was removed.
+func removeAutheliaUser(names ...string) (bool, error) {
+	matches := func(s string) bool {
+		for _, n := range names {
+			if n != "" && strings.EqualFold(n, s) {
+				return true
+			}
+		}
+		return false
+	}
+	return editAutheliaUsers(func(name, email string, _ *yaml.Node) (bool, bool) {
+		return matches(name) || matches(email), false
+	})
+}
+
+// runDueErasures carries out erasure requests older than erasureGrace.
+func runDueErasures(now time.Time) (int, error) {
+	users, err := store.Users.List()
+	if err != nil {
+		return 0, err
+	}
+	erased := 0
+	for _, u := range users {
+		if u.ErasureRequestedAt == nil || now.Sub(*u.ErasureRequestedAt) < erasureGrace {
+			continue
+		}
+		if _, err := eraseUser(u.ID, "erasure job"); err != nil {
+			return erased, fmt.Errorf("erase %s: %w", u.ID, err)
+		}
+		log.Printf("Erased user %s as requested on %s", u.ID, u.ErasureRequestedAt.Format(time.RFC3339))
+		_ = store.Audit.Append(AuditEntry{At: now.UTC(), Actor: "erasure job", Action: "user.erase", Target: u.ID})
+		erased++
+	}
+	return erased, nil
+}
+
+// requireCaller returns the authenticated caller or 401.
+func requireCaller(c *fiber.Ctx) (*User, error) {
+	user, err := currentUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "authentication required")
+	}
+	return user, nil
+}
+
+func handleMyDataExport(c *fiber.Ctx) error {
+	user, err := requireCaller(c)
+	if err != nil {
+		return err
+	}
+	data, err := collectPersonalData(*user)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	recordAudit(c, "user.data_export", user.ID, "")
+	c.Attachment("safe-spac-" + user.ID + ".json")
+	return c.JSON(data)
+}
+
+// handleMyErasureRequest asks for the caller's account to be erased. The
+// caller confirms by repeating their email address.
+func handleMyErasureRequest(c *fiber.Ctx) error {
+	user, err := requireCaller(c)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Confirm string `json:"confirm"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	if req.Confirm == "" || !strings.EqualFold(strings.TrimSpace(req.Confirm), user.Email) {
+		return fiber.NewError(fiber.StatusBadRequest, "confirm must repeat your email address")
+	}
+	if erasureGrace <= 0 {
+		res, err := eraseUser(user.ID, "self")
+		if err != nil {
+			return storeError(err, "user not found")
+		}
+		recordAudit(nil, "user.erase", user.ID, "self-service")
+		return c.JSON(fiber.Map{"ok": true, "erased": res})
+	}
+	now := time.Now().UTC()
+	updated, err := store.Users.Update(user.ID, func(u *User) error {
+		if u.ErasureRequestedAt == nil {
+			u.ErasureRequestedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	recordAudit(c, "user.erasure_request", user.ID, "")
+	return c.JSON(fiber.Map{"ok": true, "requested_at": updated.ErasureRequestedAt, "erase_after": updated.ErasureRequestedAt.Add(erasureGrace)})
+}
+
+func handleMyErasureCancel(c *fiber.Ctx) error {
+	user, err := requireCaller(c)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Users.Update(user.ID, func(u *User) error {
+		if u.ErasureRequestedAt == nil {
+			return errUnchanged
+		}
+		u.ErasureRequestedAt = nil
+		return nil
+	}); err != nil && !errors.Is(err, errUnchanged) {
+		return storeError(err, "user not found")
+	}
+	recordAudit(c, "user.erasure_cancel", user.ID, "")
+	return c.JSON(fiber.Map{"ok": true})
+}
+
+// handleErasuresList shows pending requests and past erasures.
+func handleErasuresList(c *fiber.Ctx) error {
+	users, err := store.Users.List()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load users")
+	}
+	type pending struct {
+		UserID      string    `json:"user_id"`
+		Username    string    `json:"username"`
+		RequestedAt time.Time `json:"requested_at"`
+		EraseAfter  time.Time `json:"erase_after"`
+	}
+	list := []pending{}
+	for _, u := range users {
+		if u.ErasureRequestedAt != nil {
+			list = append(list, pending{u.ID, usernameOf(&u), *u.ErasureRequestedAt, u.ErasureRequestedAt.Add(erasureGrace)})
+		}
+	}
+	tombstones, err := loadTombstones()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	if tombstones == nil {
+		tombstones = []Tombstone{}
+	}
+	return c.JSON(fiber.Map{"pending": list, "erased": tombstones})
+}
+
+// handleUserErase erases a user at once, with or without a request.
+func handleUserErase(c *fiber.Ctx) error {
+	by := "admin"
+	if caller, err := currentUser(c); err == nil && caller != nil {
+		by = usernameOf(caller)
+	}
+	res, err := eraseUser(c.Params("id"), by)
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	recordAudit(c, "user.erase", res.UserID, "")
+	return c.JSON(fiber.Map{"ok": true, "erased": res})
+}
+
+// eraseDueRequests is the erasure_requests job.
+func eraseDueRequests(context.Context) error {
+	_, err := runDueErasures(time.Now())
+	return err
+}
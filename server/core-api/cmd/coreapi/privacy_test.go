@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func seedMember(t *testing.T) (User, string) {
+	t.Helper()
+	u := User{ID: "m1", Email: "mia@example.org", Username: "mia", Role: "user", Status: "active",
+		VPNConfig: &VPNConfig{PublicKey: "pub", PrivateKey: "priv", IPAddress: "10.66.0.5"}}
+	_ = store.Users.Create(u)
+	createTeamSpeakAccount(t, "m1", "mia")
+	_ = store.Invites.Create(Invite{Token: "open", CreatedBy: "m1", Email: "friend@example.org", ExpiresAt: time.Now().Add(time.Hour)})
+	_ = store.Invites.Create(Invite{Token: "used", CreatedBy: "m1", Email: "pal@example.org", Used: true, RedeemedBy: "p1"})
+	_ = store.Invites.Create(Invite{Token: "mine", CreatedBy: "a1", Email: "mia@example.org", Used: true, RedeemedBy: "m1"})
+	_ = store.Audit.Append(AuditEntry{At: time.Now(), Action: "user.update", Target: "m1"})
+	token, err := generateJWT(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, token
+}
+
+// createTeamSpeakAccount links a TeamSpeak account to userID the way the
+// API does, under an ID of its own, and returns that ID.
+func createTeamSpeakAccount(t *testing.T, userID, username string) string {
+	t.Helper()
+	app := fiber.New()
+	app.Post("/teamspeak/users", handleTeamSpeakUserCreate)
+	code, out := send(t, app, "POST", "/teamspeak/users", "", `{"user_id":"`+userID+`","username":"`+username+`","password":"ts-secret"}`)
+	if code != 200 || out["id"] == userID {
+		t.Fatalf("create TeamSpeak account: %d %v", code, out)
+	}
+	return out["id"].(string)
+}
+
+func TestMyDataExport(t *testing.T) {
+	dataDir = t.TempDir()
+	_, token := seedMember(t)
+	app := testApp()
+
+	if code, _ := send(t, app, "GET", "/api/me/export", "", ""); code != fiber.StatusUnauthorized {
+		t.Fatalf("anonymous export: %d", code)
+	}
+	var data personalData
+	if code := sendFor(t, app, "GET", "/api/me/export", token, "", &data); code != 200 {
+		t.Fatalf("export: %d", code)
+	}
+	if data.Profile.VPNConfig.PrivateKey != "priv" || data.TeamSpeak == nil || len(data.InvitesCreated) != 2 ||
+		data.InviteRedeemed == nil || data.InviteRedeemed.Token != "mine" || len(data.Sessions) != 1 || len(data.Audit) != 1 {
+		t.Fatalf("export contents: %+v", data)
+	}
+}
+
+func TestErasureWorkflow(t *testing.T) {
+	dataDir = t.TempDir()
+	_, token := seedMember(t)
+	prevAuthelia := autheliaUsers
+	autheliaUsers = filepath.Join(t.TempDir(), "users_database.yml")
+	t.Cleanup(func() { autheliaUsers = prevAuthelia })
+	_ = os.WriteFile(autheliaUsers, []byte(`# Authelia users (file backend)
+users:
+  admin@example.com:
+    displayname: Admin
+    email: admin@example.com
+  mia:
+    displayname: Mia
+    email: mia@example.org
+`), 0o600)
+	// Traces of mia outside her own records: an earlier rejected application,
+	// a blocked sign-up, and her decisions on other people's applications.
+	earlier := time.Now().Add(-time.Hour)
+	_ = recordRejection(Registration{ID: "old", Email: "Mia@example.org", Username: "mia", CreatedAt: earlier}, "duplicate", "")
+	_ = recordRejection(Registration{ID: "spam", Email: "spam@example.org", CreatedAt: earlier}, "spam", "mia")
+	_ = recordBlockedSignup(BlockedSignup{Email: "mia@example.org", Context: "registration", Reason: "disposable", At: earlier})
+	_ = store.Registrations.Create(Registration{ID: "r1", Email: "new@example.org", Status: "pending", CreatedAt: earlier,
+		Approvals: []Approval{{UserID: "m1", Username: "mia", At: earlier}}})
+	_ = store.Audit.Append(AuditEntry{At: earlier, Actor: "mia", Action: "registration.approve", Target: "r1"})
+
+	app := testApp()
+	erasure := func(method, body string) int {
+		code, _ := send(t, app, method, "/api/me/erasure", token, body)
+		return code
+	}
+
+	if code := erasure("POST", `{"confirm":"someone@example.org"}`); code != fiber.StatusBadRequest {
+		t.Fatalf("wrong confirmation: %d", code)
+	}
+	if code := erasure("POST", `{"confirm":"Mia@example.org"}`); code != 200 {
+		t.Fatalf("request: %d", code)
+	}
+	if code := erasure("DELETE", ``); code != 200 {
+		t.Fatalf("cancel: %d", code)
+	}
+	if u, _ := store.Users.Get("m1"); u.ErasureRequestedAt != nil {
+		t.Fatal("cancel kept the request")
+	}
+	_ = erasure("POST", `{"confirm":"mia@example.org"}`)
+
+	if n, err := runDueErasures(time.Now()); err != nil || n != 0 {
+		t.Fatalf("erased inside the grace period: %d %v", n, err)
+	}
+	if n, err := runDueErasures(time.Now().Add(erasureGrace)); err != nil || n != 1 {
+		t.Fatalf("due erasures: %d %v", n, err)
+	}
+
+	if _, err := store.Users.Get("m1"); !errors.Is(err, errNotFound) {
+		t.Fatal("user survived erasure")
+	}
+	if accounts, _ := store.TeamSpeakUsers.List(); len(accounts) != 0 {
+		t.Fatalf("TeamSpeak account survived erasure: %+v", accounts)
+	}
+	if sessions, _ := store.Sessions.List(); len(sessions) != 0 {
+		t.Fatalf("sessions survived erasure: %+v", sessions)
+	}
+	if _, err := store.Invites.Get("open"); !errors.Is(err, errNotFound) {
+		t.Fatal("unredeemed invite survived erasure")
+	}
+	for _, token := range []string{"used", "mine"} {
+		if inv, _ := store.Invites.Get(token); inv.Email != "" {
+			t.Fatalf("invite %s keeps %q", token, inv.Email)
+		}
+	}
+	raw, _ := os.ReadFile(autheliaUsers)
+	if strings.Contains(string(raw), "mia") || !strings.Contains(string(raw), "admin@example.com") || !strings.Contains(string(raw), "# Authelia users") {
+		t.Fatalf("authelia file after erasure:\n%s", raw)
+	}
+	if r, _ := store.Registrations.Get("r1"); len(r.Approvals) != 1 || r.Approvals[0].Username != erasedName("m1") {
+		t.Fatalf("approval after erasure: %+v", r.Approvals)
+	}
+	files, _ := os.ReadDir(dataDir)
+	for _, f := range files {
+		if raw, _ := os.ReadFile(filepath.Join(dataDir, f.Name())); strings.Contains(strings.ToLower(string(raw)), "mia") {
+			t.Fatalf("%s still names the erased user:\n%s", f.Name(), raw)
+		}
+	}
+	tombstones, _ := loadTombstones()
+	if len(tombstones) != 1 || tombstones[0].UserID != "m1" || tombstones[0].RequestedAt == nil {
+		t.Fatalf("tombstones: %+v", tombstones)
+	}
+	if b, _ := json.Marshal(tombstones); strings.Contains(string(b), "mia") {
+		t.Fatalf("tombstone identifies the user: %s", b)
+	}
+}
+
+func TestEraseLastAdminRefused(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: "active"})
+	app, admin := testApp(), tokenFor(t, "a1")
+	if code, _ := send(t, app, "POST", "/api/admin/users/a1/erase", admin, ""); code != fiber.StatusConflict {
+		t.Fatalf("erase last admin: %d", code)
+	}
+	if code, _ := send(t, app, "POST", "/api/admin/users/nobody/erase", admin, ""); code != fiber.StatusNotFound {
+		t.Fatalf("erase unknown user: %d", code)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	fieldText     = "text"
+	fieldChoice   = "choice"
+	fieldCheckbox = "checkbox"
+)
+
+// RegistrationField describes one extra question on the sign-up form.
+// Answers are stored under Name on the registration and, once approved,
+// on the user's profile.
+type RegistrationField struct {
+	Name      string   `json:"name"`
+	Label     string   `json:"label"`
+	Type      string   `json:"type"` // text, choice, checkbox
+	Required  bool     `json:"required,omitempty"`
+	Options   []string `json:"options,omitempty"`    // choice only
+	MaxLength int      `json:"max_length,omitempty"` // text only
+	Pattern   string   `json:"pattern,omitempty"`    // text only, Go regexp
+
+	pattern *regexp.Regexp // Pattern compiled by loadRegistrationFields
+}
+
+var fieldNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+func registrationFieldsFile() string {
+	return filepath.Join(dataDir, "registration_fields.json")
+}
+
+// loadRegistrationFields reads the schema and compiles the patterns once,
+// so a file edited by hand with a bad pattern fails here rather than on
+// every submission.
+func loadRegistrationFields() ([]RegistrationField, error) {
+	var fields []RegistrationField
+	if err := readJSON(registrationFieldsFile(), &fields); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for i, f := range fields {
+		if err := f.validate(); err != nil {
+			return nil, err
+		}
+		if f.Type == fieldText && f.Pattern != "" {
+			re, err := regexp.Compile(f.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: invalid pattern", f.Name)
+			}
+			fields[i].pattern = re
+		}
+	}
+	return fields, nil
+}
+
+func (f RegistrationField) validate() error {
+	if !fieldNameRe.MatchString(f.Name) {
+		return fmt.Errorf("field %q: name must be lowercase letters, digits or underscores", f.Name)
+	}
+	switch f.Type {
+	case fieldText:
+		if f.Pattern != "" {
+			if _, err := regexp.Compile(f.Pattern); err != nil {
+				return fmt.Errorf("field %q: invalid pattern", f.Name)
+			}
+		}
+	case fieldChoice:
+		if len(f.Options) == 0 {
+			return fmt.Errorf("field %q: choice needs options", f.Name)
+		}
+	case fieldCheckbox:
+	default:
+		return fmt.Errorf("field %q: type must be text, choice or checkbox", f.Name)
+	}
+	return nil
+}
+
+// validateAnswers checks answers against the schema and returns them
+// normalised. Answers to unknown fields are rejected.
+func validateAnswers(fields []RegistrationField, answers map[string]any) (map[string]any, error) {
+	known := make(map[string]bool, len(fields))
+	out := make(map[string]any)
+	for _, f := range fields {
+		known[f.Name] = true
+		v, present := answers[f.Name]
+		switch f.Type {
+		case fieldText:
+			s, ok := v.(string)
+			if present && v != nil && !ok {
+				return nil, fmt.Errorf("%s must be text", f.Name)
+			}
+			s = strings.TrimSpace(s)
+			if s == "" {
+				if f.Required {
+					return nil, fmt.Errorf("%s is required", f.Name)
+				}
+				continue
+			}
+			if f.MaxLength > 0 && len([]rune(s)) > f.MaxLength {
+				return nil, fmt.Errorf("%s is longer than %d characters", f.Name, f.MaxLength)
+			}
+			if f.pattern != nil && !f.pattern.MatchString(s) {
+				return nil, fmt.Errorf("%s has an invalid format", f.Name)
+			}
+			out[f.Name] = s
+		case fieldChoice:
+			s, ok := v.(string)
+			if present && v != nil && !ok {
+				return nil, fmt.Errorf("%s must be one of the options", f.Name)
+			}
+			if s == "" {
+				if f.Required {
+					return nil, fmt.Errorf("%s is required", f.Name)
+				}
+				continue
+			}
+			valid := false
+			for _, opt := range f.Options {
+				if opt == s {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				return nil, fmt.Errorf("%s must be one of the options", f.Name)
+			}
+			out[f.Name] = s
+		case fieldCheckbox:
+			b, ok := v.(bool)
+			if present && v != nil && !ok {
+				return nil, fmt.Errorf("%s must be true or false", f.Name)
+			}
+			if f.Required && !b {
+				return nil, fmt.Errorf("%s must be checked", f.Name)
+			}
+			out[f.Name] = b
+		}
+	}
+	for k := range answers {
+		if !known[k] {
+			return nil, fmt.Errorf("unknown field %s", k)
+		}
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+func handleRegistrationFieldsGet(c *fiber.Ctx) error {
+	fields, err := loadRegistrationFields()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load registration fields")
+	}
+	if fields == nil {
+		fields = []RegistrationField{}
+	}
+	return c.JSON(fields)
+}
+
+// handleRegistrationFieldsPut replaces the questionnaire schema. Existing
+// answers on pending registrations are kept as they were submitted.
+func handleRegistrationFieldsPut(c *fiber.Ctx) error {
+	var fields []RegistrationField
+	if err := c.BodyParser(&fields); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	seen := make(map[string]bool)
+	for _, f := range fields {
+		if err := f.validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if seen[f.Name] {
+			return fiber.NewError(fiber.StatusBadRequest, "duplicate field "+f.Name)
+		}
+		seen[f.Name] = true
+	}
+	var stored []RegistrationField
+	err := updateJSON(registrationFieldsFile(), &stored, func() error {
+		stored = fields
+		return nil
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"ok": true, "fields": fields})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestQuestionnaireAnswersCarryOverToProfile(t *testing.T) {
+	dataDir = t.TempDir()
+	fields := []RegistrationField{
+		{Name: "referred_by", Label: "Who referred you", Type: fieldText, Required: true, MaxLength: 20},
+		{Name: "usage", Label: "What will you use the VPN for", Type: fieldChoice, Options: []string{"gaming", "work"}},
+		{Name: "rules", Label: "I accept the rules", Type: fieldCheckbox, Required: true},
+	}
+	for _, f := range fields {
+		if err := f.validate(); err != nil {
+			t.Fatalf("valid field rejected: %v", err)
+		}
+	}
+	if err := (RegistrationField{Name: "x", Type: fieldChoice}).validate(); err == nil {
+		t.Fatalf("choice without options accepted")
+	}
+
+	bad := []map[string]any{
+		{"usage": "gaming", "rules": true},
+		{"referred_by": "alice", "rules": false},
+		{"referred_by": "alice", "rules": true, "usage": "mining"},
+		{"referred_by": "alice", "rules": true, "extra": "x"},
+		{"referred_by": "a very long referral name", "rules": true},
+	}
+	for _, answers := range bad {
+		if _, err := validateAnswers(fields, answers); err == nil {
+			t.Fatalf("invalid answers accepted: %v", answers)
+		}
+	}
+
+	answers, err := validateAnswers(fields, map[string]any{"referred_by": " alice ", "usage": "work", "rules": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answers["referred_by"] != "alice" {
+		t.Fatalf("answer not normalised: %v", answers)
+	}
+
+	reg := Registration{ID: "r1", Email: "a@x.org", Username: "a", CreatedAt: time.Now().UTC(), Answers: answers}
+	if err := writeJSON(filepath.Join(dataDir, "pending.json"), []Registration{reg}); err != nil {
+		t.Fatal(err)
+	}
+	user := newUserFromRegistration(reg)
+	if err := store.Users.Create(user); err != nil {
+		t.Fatal(err)
+	}
+	var users []User
+	if err := readJSON(filepath.Join(dataDir, "users.json"), &users); err != nil || len(users) != 1 {
+		t.Fatalf("users: %v %v", users, err)
+	}
+	if users[0].Profile["usage"] != "work" || users[0].Profile["rules"] != true {
+		t.Fatalf("profile not carried over: %v", users[0].Profile)
+	}
+}
+
+func TestQuestionnairePatternFromFile(t *testing.T) {
+	dataDir = t.TempDir()
+	app := fiber.New()
+	app.Post("/register", handleRegistrationSubmit)
+
+	fields := []RegistrationField{{Name: "member_no", Label: "Member number", Type: fieldText, Pattern: `^[0-9]{4}$`}}
+	if err := writeJSON(registrationFieldsFile(), fields); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := send(t, app, "POST", "/register", "", `{"email":"a@x.org","answers":{"member_no":"12ab"}}`); code != fiber.StatusBadRequest {
+		t.Fatalf("answer not matching the pattern: %d", code)
+	}
+	if code, _ := send(t, app, "POST", "/register", "", `{"email":"a@x.org","answers":{"member_no":"1234"}}`); code != 200 {
+		t.Fatalf("matching answer: %d", code)
+	}
+
+	// A bad pattern edited into the file by hand is a server error, not a panic.
+	fields[0].Pattern = `^[0-9`
+	if err := writeJSON(registrationFieldsFile(), fields); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := send(t, app, "POST", "/register", "", `{"email":"b@x.org","answers":{"member_no":"1234"}}`); code != fiber.StatusInternalServerError {
+		t.Fatalf("bad pattern on file: %d", code)
+	}
+}
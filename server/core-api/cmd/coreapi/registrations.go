@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func newUserFromRegistration(reg Registration) User {
+	now := time.Now().UTC()
+	return User{
+		ID:          generateID(),
+		Email:       reg.Email,
+		Username:    reg.Username,
+		Password:    hashPassword(reg.Password),
+		Role:        "user",
+		Status:      "active",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		ApprovedBy:  reg.Approvals,
+		Profile:     reg.Answers,
+		InviteToken: reg.InviteToken,
+		InvitedBy:   inviteCreator(reg.InviteToken),
+	}
+}
+
+// takeRegistration removes a pending registration after fn has handled it,
+// as one locked update. Nothing is removed when fn fails.
+func takeRegistration(id string, fn func(Registration) error) (Registration, error) {
+	var taken Registration
+	err := store.Registrations.Mutate(func(pending []Registration) ([]Registration, error) {
+		for i := range pending {
+			if pending[i].ID == id {
+				taken = pending[i]
+				if err := fn(taken); err != nil {
+					return nil, err
+				}
+				return append(pending[:i], pending[i+1:]...), nil
+			}
+		}
+		return nil, errNotFound
+	})
+	return taken, err
+}
+
+func notifyApproved(user User) {
+	notify(user.Email, "Safe-Spac registration approved",
+		"Your Safe-Spac account has been approved. You can now sign in as "+firstNonEmpty(user.Username, user.Email)+".")
+}
+
+type registrationFilter struct {
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	EmailDomain   string     `json:"email_domain,omitempty"`
+	InviteToken   string     `json:"invite_token,omitempty"`
+}
+
+func (f registrationFilter) empty() bool {
+	return f.CreatedAfter == nil && f.CreatedBefore == nil && f.EmailDomain == "" && f.InviteToken == ""
+}
+
+func (f registrationFilter) match(reg Registration) bool {
+	if f.CreatedAfter != nil && reg.CreatedAt.Before(*f.CreatedAfter) {
+		return false
+	}
+	if f.CreatedBefore != nil && !reg.CreatedAt.Before(*f.CreatedBefore) {
+		return false
+	}
+	if f.EmailDomain != "" && !strings.EqualFold(emailDomain(reg.Email), strings.TrimPrefix(f.EmailDomain, "@")) {
+		return false
+	}
+	if f.InviteToken != "" && reg.InviteToken != f.InviteToken {
+		return false
+	}
+	return true
+}
+
+type bulkResult struct {
+	ID        string `json:"id"`
+	OK        bool   `json:"ok"`
+	UserID    string `json:"user_id,omitempty"`
+	Approvals int    `json:"approvals,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// handleRegistrationsBulk applies one moderation action to a set of pending
+// registrations selected by ID or by filter. The batch runs as one
+// read-modify-write of pending.json; users.json and rejected.json are each
+// written once inside it.
+func handleRegistrationsBulk(c *fiber.Ctx) error {
+	var req struct {
+		Action string             `json:"action"` // approve, reject, delete
+		IDs    []string           `json:"ids"`
+		Filter registrationFilter `json:"filter"`
+		Reason string             `json:"reason"`
+		Notify bool               `json:"notify"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	switch req.Action {
+	case "approve", "reject", "delete":
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "action must be approve, reject or delete")
+	}
+	if len(req.IDs) == 0 && req.Filter.empty() {
+		return fiber.NewError(fiber.StatusBadRequest, "ids or filter required")
+	}
+	var caller *User
+	var err error
+	if req.Action == "approve" {
+		caller, err = approvalCaller(c)
+	} else {
+		caller, err = currentUser(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	var (
+		results []bulkResult
+		picked  []Registration
+		created []User
+	)
+	err = store.Registrations.Mutate(func(pending []Registration) ([]Registration, error) {
+		selected := make(map[string]bool)
+		if len(req.IDs) > 0 {
+			known := make(map[string]bool, len(pending))
+			for _, reg := range pending {
+				known[reg.ID] = true
+			}
+			for _, id := range req.IDs {
+				if selected[id] {
+					continue
+				}
+				if !known[id] {
+					results = append(results, bulkResult{ID: id, Error: "registration not found"})
+					continue
+				}
+				selected[id] = true
+			}
+		} else {
+			for _, reg := range pending {
+				if req.Filter.match(reg) {
+					selected[reg.ID] = true
+				}
+			}
+		}
+
+		var kept []Registration
+		for _, reg := range pending {
+			if selected[reg.ID] {
+				picked = append(picked, reg)
+			} else {
+				kept = append(kept, reg)
+			}
+		}
+		if kept == nil {
+			kept = []Registration{}
+		}
+
+		var completed []Registration
+		switch req.Action {
+		case "approve":
+			// Under a multi-approver policy a registration only leaves pending.json
+			// once it has collected enough approvals; the rest stay with the
+			// caller's approval added.
+			now := time.Now().UTC()
+			stillPending := make(map[string]Registration)
+			unapproved := make(map[string]Registration)
+			for _, reg := range picked {
+				before := reg
+				complete, err := addApproval(&reg, caller, now)
+				var user User
+				if err == nil && complete {
+					// The invite is redeemed here so a spent one keeps the
+					// registration pending instead of sponsoring it.
+					user = newUserFromRegistration(reg)
+					if err = markInviteUsed(user.InviteToken, user.ID); err != nil {
+						reg = before
+					}
+				}
+				switch {
+				case err != nil:
+					results = append(results, bulkResult{ID: reg.ID, Error: err.Error()})
+					stillPending[reg.ID] = reg
+				case complete:
+					completed = append(completed, reg)
+					created = append(created, user)
+					unapproved[reg.ID] = before
+				default:
+					results = append(results, bulkResult{ID: reg.ID, OK: true, Approvals: len(reg.Approvals)})
+					stillPending[reg.ID] = reg
+				}
+			}
+
+			// New accounts get the same email and username checks as
+			// createUser, against existing users and each other. A
+			// registration that clashes stays pending without the approval.
+			refused := make(map[string]error)
+			if len(created) > 0 {
+				err := store.Users.Mutate(func(users []User) ([]User, error) {
+					clear(refused)
+					n := len(users)
+					for _, user := range created {
+						if err := checkUnique(users, user); err != nil {
+							refused[user.ID] = err
+							continue
+						}
+						users = append(users, user)
+					}
+					if len(users) == n {
+						return nil, errUnchanged
+					}
+					return users, nil
+				})
+				if err != nil {
+					for _, user := range created {
+						releaseInvite(user.InviteToken, user.ID)
+					}
+					return nil, err
+				}
+			}
+			var accepted []Registration
+			var added []User
+			for i, reg := range completed {
+				user := created[i]
+				if err := refused[user.ID]; err != nil {
+					releaseInvite(user.InviteToken, user.ID)
+					results = append(results, bulkResult{ID: reg.ID, Error: err.Error()})
+					stillPending[reg.ID] = unapproved[reg.ID]
+					continue
+				}
+				accepted = append(accepted, reg)
+				added = append(added, user)
+				results = append(results, bulkResult{ID: reg.ID, OK: true, UserID: user.ID, Approvals: len(reg.Approvals)})
+			}
+			completed, created = accepted, added
+
+			kept = kept[:0]
+			for _, reg := range pending {
+				if upd, ok := stillPending[reg.ID]; ok {
+					kept = append(kept, upd)
+				} else if !selected[reg.ID] {
+					kept = append(kept, reg)
+				}
+			}
+			picked = completed
+		case "reject":
+			if len(picked) > 0 {
+				if err := recordRejections(picked, req.Reason, usernameOf(caller)); err != nil {
+					return nil, err
+				}
+			}
+			for _, reg := range picked {
+				results = append(results, bulkResult{ID: reg.ID, OK: true})
+			}
+		case "delete":
+			for _, reg := range picked {
+				results = append(results, bulkResult{ID: reg.ID, OK: true})
+			}
+		}
+
+		if len(selected) == 0 {
+			return nil, errUnchanged
+		}
+		return kept, nil
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	for _, r := range results {
+		if r.OK {
+			recordAudit(c, "registration."+req.Action, r.ID, req.Reason)
+		}
+	}
+
+	for _, user := range created {
+		notifyApproved(user)
+	}
+	if req.Action == "reject" && req.Notify {
+		notifyRejected(picked, req.Reason)
+	}
+
+	return c.JSON(fiber.Map{"ok": true, "action": req.Action, "processed": len(picked), "results": results})
+}
+
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRegistrationsBulkApproveByFilter(t *testing.T) {
+	dataDir = t.TempDir()
+	now := time.Now().UTC()
+	pending := []Registration{
+		{ID: "a", Email: "ann@uni.edu", Username: "ann", CreatedAt: now},
+		{ID: "b", Email: "bob@uni.edu", Username: "bob", CreatedAt: now},
+		{ID: "c", Email: "eve@other.org", Username: "eve", CreatedAt: now},
+	}
+	if err := writeJSON(filepath.Join(dataDir, "pending.json"), pending); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/bulk", handleRegistrationsBulk)
+	req := httptest.NewRequest("POST", "/bulk", strings.NewReader(`{"action":"approve","filter":{"email_domain":"uni.edu"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("bulk failed: %v %v", err, resp.StatusCode)
+	}
+	var out struct {
+		Processed int          `json:"processed"`
+		Results   []bulkResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Processed != 2 || len(out.Results) != 2 {
+		t.Fatalf("unexpected results: %+v", out)
+	}
+
+	var users []User
+	if err := readJSON(filepath.Join(dataDir, "users.json"), &users); err != nil || len(users) != 2 {
+		t.Fatalf("users not created: %v %v", users, err)
+	}
+	var left []Registration
+	if err := readJSON(filepath.Join(dataDir, "pending.json"), &left); err != nil || len(left) != 1 || left[0].ID != "c" {
+		t.Fatalf("unexpected pending: %v %v", left, err)
+	}
+
+	req = httptest.NewRequest("POST", "/bulk", strings.NewReader(`{"action":"reject","ids":["c","missing"],"reason":"spam"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("bulk reject failed: %v %v", err, resp.StatusCode)
+	}
+	out.Results = nil
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	if len(out.Results) != 2 || out.Results[0].Error == "" || !out.Results[1].OK {
+		t.Fatalf("unexpected per-item results: %+v", out.Results)
+	}
+	if rejected, _ := loadRejected(); len(rejected) != 1 || rejected[0].Reason != "spam" {
+		t.Fatalf("rejection not recorded: %+v", rejected)
+	}
+}
+
+func TestRegistrationsBulkApproveKeepsAccountsUnique(t *testing.T) {
+	dataDir = t.TempDir()
+	now := time.Now().UTC()
+	_ = store.Users.Create(User{ID: "m1", Email: "mia@uni.edu", Username: "mia", Status: statusActive})
+	for _, reg := range []Registration{
+		{ID: "a", Email: "ann@uni.edu", Username: "ann", CreatedAt: now},
+		{ID: "b", Email: "ANN@uni.edu", Username: "ann2", CreatedAt: now},
+		{ID: "c", Email: "other@uni.edu", Username: "Mia", CreatedAt: now},
+	} {
+		_ = store.Registrations.Create(reg)
+	}
+
+	app := fiber.New()
+	app.Post("/bulk", handleRegistrationsBulk)
+	var out struct {
+		Results []bulkResult `json:"results"`
+	}
+	if code := sendFor(t, app, "POST", "/bulk", "", `{"action":"approve","ids":["a","b","c"]}`, &out); code != 200 {
+		t.Fatalf("bulk: %d", code)
+	}
+	failed := map[string]string{}
+	for _, r := range out.Results {
+		if !r.OK {
+			failed[r.ID] = r.Error
+		}
+	}
+	if len(failed) != 2 || !strings.Contains(failed["b"], "email") || !strings.Contains(failed["c"], "username") {
+		t.Fatalf("per-item conflicts: %+v", out.Results)
+	}
+	if users, _ := store.Users.List(); len(users) != 2 {
+		t.Fatalf("users after bulk approve: %+v", users)
+	}
+	if left, _ := store.Registrations.List(); len(left) != 2 {
+		t.Fatalf("clashing registrations should stay pending: %+v", left)
+	}
+}
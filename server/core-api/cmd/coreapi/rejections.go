@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	rejectedRetention = envDuration("REJECTED_RETENTION", 30*24*time.Hour)
+	reapplyCooldown   = envDuration("REAPPLY_COOLDOWN", 7*24*time.Hour)
+)
+
+// RejectedRegistration is kept in rejected.json for rejectedRetention so
+// admins can review past decisions and repeat applicants can be throttled.
+type RejectedRegistration struct {
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	Username      string    `json:"username"`
+	SourceIP      string    `json:"source_ip,omitempty"`
+	InviteToken   string    `json:"invite_token,omitempty"`
+	CaptchaPassed bool      `json:"captcha_passed,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	RejectedAt    time.Time `json:"rejected_at"`
+	Reason        string    `json:"reason,omitempty"`
+	RejectedBy    string    `json:"rejected_by,omitempty"`
+	Notified      bool      `json:"notified"`
+}
+
+func rejectedFile() string {
+	return filepath.Join(dataDir, "rejected.json")
+}
+
+func loadRejected() ([]RejectedRegistration, error) {
+	var list []RejectedRegistration
+	if err := readJSON(rejectedFile(), &list); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return list, nil
+}
+
+// recordRejection appends reg to the rejection history, dropping entries
+// that have outlived the retention window on the way. Entries start out
+// not notified; see notifyRejected.
+func recordRejection(reg Registration, reason, by string) error {
+	return recordRejections([]Registration{reg}, reason, by)
+}
+
+func recordRejections(regs []Registration, reason, by string) error {
+	var list []RejectedRegistration
+	return updateJSON(rejectedFile(), &list, func() error {
+		now := time.Now().UTC()
+		list = pruneRejected(list, now)
+		for _, reg := range regs {
+			list = append(list, RejectedRegistration{
+				ID:            reg.ID,
+				Email:         reg.Email,
+				Username:      reg.Username,
+				SourceIP:      reg.SourceIP,
+				InviteToken:   reg.InviteToken,
+				CaptchaPassed: reg.CaptchaPassed,
+				CreatedAt:     reg.CreatedAt,
+				RejectedAt:    now,
+				Reason:        reason,
+				RejectedBy:    by,
+			})
+		}
+		return nil
+	})
+}
+
+// notifyRejected tells the applicants of regs why they were rejected and
+// marks the history entries of those the message reached.
+func notifyRejected(regs []Registration, reason string) {
+	delivered := map[string]bool{}
+	for _, reg := range regs {
+		if notify(reg.Email, "Safe-Spac registration rejected", rejectionMessage(reason)) {
+			delivered[reg.ID] = true
+		}
+	}
+	if len(delivered) == 0 {
+		return
+	}
+	var list []RejectedRegistration
+	err := updateJSON(rejectedFile(), &list, func() error {
+		for i := range list {
+			if delivered[list[i].ID] {
+				list[i].Notified = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("rejections: recording notification: %v", err)
+	}
+}
+
+func pruneRejected(list []RejectedRegistration, now time.Time) []RejectedRegistration {
+	kept := list[:0]
+	for _, r := range list {
+		if now.Sub(r.RejectedAt) < rejectedRetention {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+func cleanupRejectedRegistrations() error {
+	var list []RejectedRegistration
+	return updateJSON(rejectedFile(), &list, func() error {
+		before := len(list)
+		if list = pruneRejected(list, time.Now().UTC()); len(list) == before {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+// reapplyBlockedUntil reports whether a new registration from email or ip
+// falls inside the cooldown of an earlier rejection.
+func reapplyBlockedUntil(email, ip string, now time.Time) (time.Time, bool, error) {
+	list, err := loadRejected()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var until time.Time
+	for _, r := range list {
+		sameEmail := email != "" && strings.EqualFold(r.Email, email)
+		sameIP := ip != "" && r.SourceIP == ip
+		if !sameEmail && !sameIP {
+			continue
+		}
+		if end := r.RejectedAt.Add(reapplyCooldown); end.After(now) && end.After(until) {
+			until = end
+		}
+	}
+	return until, !until.IsZero(), nil
+}
+
+func rejectionMessage(reason string) string {
+	msg := "Your Safe-Spac registration was not approved."
+	if strings.TrimSpace(reason) != "" {
+		msg += fmt.Sprintf("\n\nReason: %s", reason)
+	}
+	return msg
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(envOr(key, "")); err == nil {
+		return d
+	}
+	return def
+}
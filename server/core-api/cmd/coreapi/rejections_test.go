@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type recordingNotifier struct {
+	sent []string
+}
+
+func (n *recordingNotifier) Notify(to, subject, body string) error {
+	n.sent = append(n.sent, to+"|"+subject+"|"+body)
+	return nil
+}
+
+func TestRejectionHistoryAndCooldown(t *testing.T) {
+	dataDir = t.TempDir()
+	rec := &recordingNotifier{}
+	notifier = rec
+	defer func() { notifier = logNotifier{} }()
+
+	pending := []Registration{{ID: "r1", Email: "Spam@Example.org", Username: "spam", SourceIP: "10.1.1.1", CreatedAt: time.Now().UTC()}}
+	if err := writeJSON(filepath.Join(dataDir, "pending.json"), pending); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/reject/:id", handleRegistrationReject)
+	app.Post("/register", handleRegistrationSubmit)
+
+	req := httptest.NewRequest("POST", "/reject/r1", strings.NewReader(`{"reason":"duplicate account","notify":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("reject failed: %v %v", err, resp.StatusCode)
+	}
+
+	list, err := loadRejected()
+	if err != nil || len(list) != 1 || list[0].Reason != "duplicate account" || !list[0].Notified {
+		t.Fatalf("unexpected history: %+v %v", list, err)
+	}
+	if len(rec.sent) != 1 || !strings.Contains(rec.sent[0], "duplicate account") {
+		t.Fatalf("applicant not notified: %v", rec.sent)
+	}
+
+	req = httptest.NewRequest("POST", "/register", strings.NewReader(`{"email":"spam@example.org","username":"again"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("expected cooldown block, got %d", resp.StatusCode)
+	}
+
+	list[0].RejectedAt = time.Now().Add(-reapplyCooldown - time.Minute)
+	if err := writeJSON(rejectedFile(), list); err != nil {
+		t.Fatal(err)
+	}
+	if _, blocked, _ := reapplyBlockedUntil("spam@example.org", "", time.Now()); blocked {
+		t.Fatalf("cooldown should have expired")
+	}
+
+	// A message that does not go out is not recorded as sent.
+	notifier = failingNotifier{}
+	_ = writeJSON(filepath.Join(dataDir, "pending.json"), []Registration{{ID: "r2", Email: "other@example.org"}})
+	req = httptest.NewRequest("POST", "/reject/r2", strings.NewReader(`{"reason":"incomplete","notify":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, err := app.Test(req); err != nil || resp.StatusCode != 200 {
+		t.Fatalf("reject r2: %v", err)
+	}
+	list, _ = loadRejected()
+	if i := slices.IndexFunc(list, func(r RejectedRegistration) bool { return r.ID == "r2" }); i < 0 || list[i].Notified {
+		t.Fatalf("failed notification recorded as sent: %+v", list)
+	}
+}
+
+func TestClientIPBehindProxy(t *testing.T) {
+	ipOf := func(trusted, forwarded string) string {
+		t.Setenv("TRUSTED_PROXIES", trusted)
+		app := fiber.New(withClientIP(fiber.Config{}))
+		app.Get("/", func(c *fiber.Ctx) error { return c.SendString(c.IP()) })
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Forwarded-For", forwarded)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	// app.Test connects from 0.0.0.0.
+	if ip := ipOf("0.0.0.0/32", "203.0.113.7, 10.0.0.2"); ip != "203.0.113.7" {
+		t.Fatalf("through a trusted proxy: %q", ip)
+	}
+	if ip := ipOf("192.0.2.1", "203.0.113.7"); ip != "0.0.0.0" {
+		t.Fatalf("forwarded header from an untrusted peer was used: %q", ip)
+	}
+}
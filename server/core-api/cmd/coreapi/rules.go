@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	ruleApprove = "approve"
+	ruleReject  = "reject"
+	ruleHold    = "hold"
+)
+
+// RegistrationRule is an admin-defined auto-moderation rule. Every condition
+// that is set must hold for the rule to match; rules are evaluated in file
+// order and the first match decides. Registrations matching no rule are held
+// for manual review.
+type RegistrationRule struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Disabled      bool     `json:"disabled,omitempty"`
+	EmailDomains  []string `json:"email_domains,omitempty"`
+	RequireInvite bool     `json:"require_invite,omitempty"`
+	CaptchaPassed *bool    `json:"captcha_passed,omitempty"`
+	SourceCIDRs   []string `json:"source_cidrs,omitempty"`
+	Decision      string   `json:"decision"` // approve, reject, hold
+}
+
+func rulesFile() string {
+	return filepath.Join(dataDir, "registration_rules.json")
+}
+
+func loadRegistrationRules() ([]RegistrationRule, error) {
+	var rules []RegistrationRule
+	if err := readJSON(rulesFile(), &rules); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (r RegistrationRule) validate() error {
+	switch r.Decision {
+	case ruleApprove, ruleReject, ruleHold:
+	default:
+		return fmt.Errorf("rule %q: decision must be approve, reject or hold", r.ID)
+	}
+	for _, cidr := range r.SourceCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("rule %q: invalid cidr %q", r.ID, cidr)
+		}
+	}
+	return nil
+}
+
+func (r RegistrationRule) matches(reg Registration, inviteValid bool) bool {
+	if r.Disabled {
+		return false
+	}
+	if len(r.EmailDomains) > 0 {
+		domain := emailDomain(reg.Email)
+		found := false
+		for _, d := range r.EmailDomains {
+			if strings.EqualFold(strings.TrimPrefix(d, "@"), domain) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.RequireInvite && !inviteValid {
+		return false
+	}
+	if r.CaptchaPassed != nil && *r.CaptchaPassed != reg.CaptchaPassed {
+		return false
+	}
+	if len(r.SourceCIDRs) > 0 {
+		ip := net.ParseIP(reg.SourceIP)
+		if ip == nil {
+			return false
+		}
+		found := false
+		for _, cidr := range r.SourceCIDRs {
+			if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluateRegistrationRules returns the first rule matching reg, or nil.
+func evaluateRegistrationRules(reg Registration, now time.Time) (*RegistrationRule, error) {
+	rules, err := loadRegistrationRules()
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	inv, err := findValidInvite(reg.InviteToken, reg.Email, now)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].matches(reg, inv != nil) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func decisionOf(rule *RegistrationRule) string {
+	if rule == nil {
+		return ruleHold
+	}
+	return rule.Decision
+}
+
+func handleRegistrationRulesGet(c *fiber.Ctx) error {
+	rules, err := loadRegistrationRules()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load registration rules")
+	}
+	if rules == nil {
+		rules = []RegistrationRule{}
+	}
+	return c.JSON(rules)
+}
+
+// handleRegistrationRulesPut replaces the whole ordered rule list.
+func handleRegistrationRulesPut(c *fiber.Ctx) error {
+	var rules []RegistrationRule
+	if err := c.BodyParser(&rules); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	seen := make(map[string]bool)
+	for i := range rules {
+		if rules[i].ID == "" {
+			rules[i].ID = generateID()
+		}
+		if seen[rules[i].ID] {
+			return fiber.NewError(fiber.StatusBadRequest, "duplicate rule id "+rules[i].ID)
+		}
+		seen[rules[i].ID] = true
+		if err := rules[i].validate(); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+	}
+	var stored []RegistrationRule
+	err := updateJSON(rulesFile(), &stored, func() error {
+		stored = rules
+		return nil
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(fiber.Map{"ok": true, "rules": rules})
+}
+
+// handleRegistrationRulesDryRun reports which rule a pending or previously
+// rejected registration would hit under the current rule set. Invite
+// validity is judged against the invites as they are now.
+func handleRegistrationRulesDryRun(c *fiber.Ctx) error {
+	var req struct {
+		RegistrationID string `json:"registration_id"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	reg, err := findPastRegistration(req.RegistrationID)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to load registrations")
+	}
+	if reg == nil {
+		return fiber.NewError(fiber.StatusNotFound, "registration not found")
+	}
+	rule, err := evaluateRegistrationRules(*reg, time.Now().UTC())
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to evaluate registration rules")
+	}
+	return c.JSON(fiber.Map{"registration_id": reg.ID, "rule": rule, "decision": decisionOf(rule)})
+}
+
+func findPastRegistration(id string) (*Registration, error) {
+	reg, err := store.Registrations.Get(id)
+	if err == nil {
+		return &reg, nil
+	}
+	if !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	rejected, err := loadRejected()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rejected {
+		if r.ID == id {
+			return &Registration{
+				ID:            r.ID,
+				Email:         r.Email,
+				Username:      r.Username,
+				Status:        "rejected",
+				CreatedAt:     r.CreatedAt,
+				InviteToken:   r.InviteToken,
+				SourceIP:      r.SourceIP,
+				CaptchaPassed: r.CaptchaPassed,
+			}, nil
+		}
+	}
+	return nil, nil
+}
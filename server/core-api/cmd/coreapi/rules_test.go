@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRegistrationRulesAutoModeration(t *testing.T) {
+	dataDir = t.TempDir()
+	invites := []Invite{{Token: "inv1", CreatedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}}
+	if err := writeJSON(filepath.Join(dataDir, "invites.json"), invites); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/register", handleRegistrationSubmit)
+	app.Put("/rules", handleRegistrationRulesPut)
+	app.Post("/dry-run", handleRegistrationRulesDryRun)
+
+	rules := `[
+		{"id":"invited","require_invite":true,"decision":"approve"},
+		{"id":"uni","email_domains":["uni.edu"],"decision":"approve"},
+		{"id":"blocked-net","source_cidrs":["0.0.0.0/0"],"email_domains":["spam.test"],"decision":"reject"}
+	]`
+	if status, body := send(t, app, "PUT", "/rules", "", rules); status != 200 {
+		t.Fatalf("rules rejected: %v", body)
+	}
+	if status, _ := send(t, app, "PUT", "/rules", "", `[{"id":"x","decision":"maybe"}]`); status != 400 {
+		t.Fatalf("invalid decision accepted")
+	}
+
+	if _, body := send(t, app, "POST", "/register", "", `{"email":"a@gmail.com","username":"a","invite_token":"inv1","invite_sig":"`+signInvite("inv1", "")+`"}`); body["status"] != "approved" {
+		t.Fatalf("invite holder not approved: %v", body)
+	}
+	if status, _ := send(t, app, "POST", "/register", "", `{"email":"b@gmail.com","username":"b","invite_token":"inv1","invite_sig":"`+signInvite("inv1", "")+`"}`); status != fiber.StatusForbidden {
+		t.Fatalf("used invite accepted: %d", status)
+	}
+	if _, body := send(t, app, "POST", "/register", "", `{"email":"b@gmail.com","username":"b"}`); body["status"] != "pending" {
+		t.Fatalf("uninvited sign-up should hold for review: %v", body)
+	}
+	if status, _ := send(t, app, "POST", "/register", "", `{"email":"c@spam.test","username":"c"}`); status != fiber.StatusForbidden {
+		t.Fatalf("expected auto-reject, got %d", status)
+	}
+
+	var users []User
+	if err := readJSON(filepath.Join(dataDir, "users.json"), &users); err != nil || len(users) != 1 {
+		t.Fatalf("expected one auto-approved user: %v %v", users, err)
+	}
+
+	var pending []Registration
+	_ = readJSON(filepath.Join(dataDir, "pending.json"), &pending)
+	if len(pending) != 1 {
+		t.Fatalf("expected one held registration, got %d", len(pending))
+	}
+	pending[0].Email = "b@uni.edu"
+	_ = writeJSON(filepath.Join(dataDir, "pending.json"), pending)
+	if _, body := send(t, app, "POST", "/dry-run", "", `{"registration_id":"`+pending[0].ID+`"}`); body["decision"] != "approve" {
+		t.Fatalf("dry run mismatch: %v", body)
+	}
+}
+
+func TestRuleCIDRMatchesForwardedClient(t *testing.T) {
+	dataDir = t.TempDir()
+	t.Setenv("TRUSTED_PROXIES", "0.0.0.0/32") // app.Test connects from 0.0.0.0
+	app := fiber.New(withClientIP(fiber.Config{}))
+	app.Post("/register", handleRegistrationSubmit)
+	if err := writeJSON(rulesFile(), []RegistrationRule{{ID: "bad-net", SourceCIDRs: []string{"203.0.113.0/24"}, Decision: ruleReject}}); err != nil {
+		t.Fatal(err)
+	}
+
+	register := func(email, from string) int {
+		req := httptest.NewRequest("POST", "/register", strings.NewReader(`{"email":"`+email+`","username":"x"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", from)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if code := register("a@example.org", "203.0.113.9"); code != fiber.StatusForbidden {
+		t.Fatalf("client in the CIDR: %d", code)
+	}
+	if code := register("b@example.org", "198.51.100.4"); code == fiber.StatusForbidden {
+		t.Fatalf("client outside the CIDR was rejected")
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	errJobUnknown = errors.New("unknown job")
+	errJobRunning = errors.New("job is already running")
+)
+
+// Job is a named unit of periodic work. Spec is "@every <duration>",
+// "@hourly", "@daily" or a five-field cron expression evaluated in UTC.
+// Each run is delayed by a random amount below Jitter.
+type Job struct {
+	Name   string
+	Spec   string
+	Jitter time.Duration
+	Run    func(ctx context.Context) error
+}
+
+// JobState is what the scheduler persists and reports for each job.
+type JobState struct {
+	Name         string     `json:"name"`
+	Spec         string     `json:"spec"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+}
+
+type scheduledJob struct {
+	Job
+	sched schedule
+	state JobState
+}
+
+// jobScheduler runs registered jobs on their schedules, one goroutine per
+// job. A job never overlaps with itself, whether started by its timer or
+// triggered manually.
+type jobScheduler struct {
+	mu      sync.Mutex
+	jobs    map[string]*scheduledJob
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started bool
+}
+
+var scheduler = newJobScheduler()
+
+func newJobScheduler() *jobScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobScheduler{jobs: map[string]*scheduledJob{}, ctx: ctx, cancel: cancel}
+}
+
+func schedulerStateFile() string {
+	return filepath.Join(dataDir, "scheduler_state.json")
+}
+
+func (s *jobScheduler) Add(job Job) error {
+	sched, err := parseSchedule(job.Spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", job.Name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[job.Name]; ok {
+		return fmt.Errorf("job %s registered twice", job.Name)
+	}
+	s.jobs[job.Name] = &scheduledJob{Job: job, sched: sched, state: JobState{Name: job.Name, Spec: job.Spec}}
+	return nil
+}
+
+// Start restores persisted state and launches the job loops. A job whose
+// next run fell due while the process was down runs shortly after start.
+func (s *jobScheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+	var saved []JobState
+	if err := readJSON(schedulerStateFile(), &saved); err != nil && !os.IsNotExist(err) {
+		log.Printf("scheduler: load state: %v", err)
+	}
+	for _, st := range saved {
+		if j, ok := s.jobs[st.Name]; ok {
+			j.state.LastRun, j.state.LastError, j.state.LastDuration = st.LastRun, st.LastError, st.LastDuration
+		}
+	}
+	now := time.Now().UTC()
+	for _, j := range s.jobs {
+		next := j.nextAfter(now)
+		if j.state.LastRun != nil {
+			due := j.sched.Next(*j.state.LastRun)
+			if due.Before(now) {
+				due = now
+			}
+			next = due.Add(j.jitter())
+		}
+		j.state.NextRun = &next
+		s.wg.Add(1)
+		go s.loop(j)
+	}
+	s.saveLocked()
+}
+
+// Stop cancels running jobs and waits for every loop to return.
+func (s *jobScheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *jobScheduler) loop(j *scheduledJob) {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		wait := time.Until(*j.state.NextRun)
+		s.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := s.run(j); errors.Is(err, errJobRunning) {
+			log.Printf("scheduler: %s skipped, previous run still in progress", j.Name)
+		}
+		s.mu.Lock()
+		next := j.nextAfter(time.Now().UTC())
+		j.state.NextRun = &next
+		s.saveLocked()
+		s.mu.Unlock()
+	}
+}
+
+// Trigger runs the named job now and waits for it to finish.
+func (s *jobScheduler) Trigger(name string) (JobState, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return JobState{}, errJobUnknown
+	}
+	if err := s.run(j); errors.Is(err, errJobRunning) {
+		return JobState{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return j.state, nil
+}
+
+// run executes j unless it is already running. The job's own error is
+// recorded in its state rather than returned.
+func (s *jobScheduler) run(j *scheduledJob) error {
+	s.mu.Lock()
+	if j.state.Running {
+		s.mu.Unlock()
+		return errJobRunning
+	}
+	j.state.Running = true
+	s.mu.Unlock()
+
+	start := time.Now().UTC()
+	err := safeRun(s.ctx, j.Run)
+	elapsed := time.Since(start)
+	if err != nil {
+		log.Printf("scheduler: %s failed: %v", j.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.state.Running = false
+	j.state.LastRun = &start
+	j.state.LastDuration = elapsed.Round(time.Millisecond).String()
+	j.state.LastError = ""
+	if err != nil {
+		j.state.LastError = err.Error()
+	}
+	s.saveLocked()
+	return nil
+}
+
+func safeRun(ctx context.Context, fn func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
+
+// States returns a snapshot of every job, sorted by name.
+func (s *jobScheduler) States() []JobState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.statesLocked()
+}
+
+func (s *jobScheduler) statesLocked() []JobState {
+	out := make([]JobState, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		out = append(out, j.state)
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Name < out[b].Name })
+	return out
+}
+
+func (s *jobScheduler) saveLocked() {
+	if err := writeJSON(schedulerStateFile(), s.statesLocked()); err != nil {
+		log.Printf("scheduler: save state: %v", err)
+	}
+}
+
+func (j *scheduledJob) nextAfter(t time.Time) time.Time {
+	return j.sched.Next(t).Add(j.jitter())
+}
+
+func (j *scheduledJob) jitter() time.Duration {
+	if j.Jitter <= 0 {
+		return 0
+	}
+	return rand.N(j.Jitter)
+}
+
+type schedule interface {
+	Next(after time.Time) time.Time
+}
+
+type intervalSchedule time.Duration
+
+func (d intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(d))
+}
+
+// cronSchedule holds one bitset per cron field.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case strings.HasPrefix(spec, "@every "):
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid interval %q", spec)
+		}
+		return intervalSchedule(d), nil
+	case spec == "@hourly":
+		spec = "0 * * * *"
+	case spec == "@daily":
+		spec = "0 0 * * *"
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: want five cron fields or @every", spec)
+	}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField accepts "*", "n", "a-b" and "/step" on either, and comma
+// separated lists of those.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if base, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			part, step = base, n
+		}
+		lo, hi := min, max
+		if part != "*" {
+			a, b, isRange := strings.Cut(part, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad range %q", part)
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next walks forward minute by minute; a schedule that never matches within
+// five years yields the zero time far in the future.
+func (c *cronSchedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return limit
+}
+
+// dayMatches follows cron's rule that a restricted day-of-month and
+// day-of-week match when either one does.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Admin handlers
+func handleJobsList(c *fiber.Ctx) error {
+	return c.JSON(scheduler.States())
+}
+
+func handleJobRun(c *fiber.Ctx) error {
+	state, err := scheduler.Trigger(c.Params("name"))
+	switch {
+	case errors.Is(err, errJobUnknown):
+		return fiber.NewError(fiber.StatusNotFound, "job not found")
+	case errors.Is(err, errJobRunning):
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	return c.JSON(fiber.Map{"ok": state.LastError == "", "job": state})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	cases := []struct {
+		spec, after, want string
+	}{
+		{"*/15 * * * *", "2024-03-01T10:07:30Z", "2024-03-01T10:15:00Z"},
+		{"@daily", "2024-03-01T10:07:00Z", "2024-03-02T00:00:00Z"},
+		{"30 2 * * 1", "2024-03-01T10:00:00Z", "2024-03-04T02:30:00Z"}, // next Monday
+		{"0 0 31 * *", "2024-04-01T00:00:00Z", "2024-05-31T00:00:00Z"},
+		{"0 9-17/4 * * *", "2024-03-01T13:00:00Z", "2024-03-01T17:00:00Z"},
+	}
+	for _, tc := range cases {
+		sched, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		after, _ := time.Parse(time.RFC3339, tc.after)
+		if got := sched.Next(after).Format(time.RFC3339); got != tc.want {
+			t.Errorf("%s after %s = %s, want %s", tc.spec, tc.after, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"", "* * *", "61 * * * *", "@every soon", "5-1 * * * *"} {
+		if _, err := parseSchedule(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestSchedulerTriggerAndOverlap(t *testing.T) {
+	dataDir = t.TempDir()
+	s := newJobScheduler()
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	_ = s.Add(Job{Name: "slow", Spec: "@daily", Run: func(ctx context.Context) error {
+		started <- struct{}{}
+		<-release
+		return errors.New("boom")
+	}})
+	s.Start()
+	defer s.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Trigger("slow")
+		done <- err
+	}()
+	<-started
+
+	app := fiber.New()
+	app.Get("/jobs", handleJobsList)
+	app.Post("/jobs/:name/run", handleJobRun)
+	prev := scheduler
+	scheduler = s
+	defer func() { scheduler = prev }()
+
+	resp, _ := app.Test(httptest.NewRequest("POST", "/jobs/slow/run", nil))
+	if resp.StatusCode != fiber.StatusConflict {
+		t.Fatalf("overlapping run allowed: %d", resp.StatusCode)
+	}
+	resp, _ = app.Test(httptest.NewRequest("POST", "/jobs/nope/run", nil))
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("unknown job: %d", resp.StatusCode)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("trigger: %v", err)
+	}
+
+	var saved []JobState
+	if err := readJSON(schedulerStateFile(), &saved); err != nil || len(saved) != 1 {
+		t.Fatalf("state not persisted: %v %+v", err, saved)
+	}
+	if saved[0].LastRun == nil || saved[0].LastError != "boom" || saved[0].NextRun == nil || saved[0].Running {
+		t.Fatalf("unexpected state: %+v", saved[0])
+	}
+
+	// A fresh scheduler picks up the last run from disk.
+	s2 := newJobScheduler()
+	_ = s2.Add(Job{Name: "slow", Spec: "@daily", Run: func(context.Context) error { return nil }})
+	s2.Start()
+	s2.Stop()
+	if st := s2.States(); st[0].LastRun == nil || !st[0].LastRun.Equal(*saved[0].LastRun) {
+		t.Fatalf("state not restored: %+v", st)
+	}
+}
+
+func TestReapExpiredInvites(t *testing.T) {
+	dataDir = t.TempDir()
+	now := time.Now().UTC()
+	_ = writeJSON(filepath.Join(dataDir, "invites.json"), []Invite{
+		{Token: "live", ExpiresAt: now.Add(time.Hour)},
+		{Token: "expired", ExpiresAt: now.Add(-time.Hour)},
+		{Token: "redeemed", ExpiresAt: now.Add(-time.Hour), Used: true},
+	})
+	n, err := reapExpiredInvites(now)
+	invites, _ := store.Invites.List()
+	if _, gone := store.Invites.Get("expired"); err != nil || n != 1 || len(invites) != 2 || gone != errNotFound {
+		t.Fatalf("reaped %d, left %+v (%v)", n, invites, err)
+	}
+}
+
+func TestDisableStaleVPNPeers(t *testing.T) {
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "s1", Email: "sam@example.org", Status: statusSuspended,
+		VPNConfig: &VPNConfig{PublicKey: "pub", Enabled: true}})
+	_ = store.Users.Create(User{ID: "n1", Email: "nia@example.org", Status: statusActive})
+	// An admin enables VPN before the member has set a key.
+	if code, _ := send(t, testApp(), "POST", "/api/users/n1/vpn/enable", tokenFor(t, "a1"), ""); code != 200 {
+		t.Fatalf("enable: %d", code)
+	}
+	n, err := disableStaleVPNPeers()
+	if err != nil || n != 1 {
+		t.Fatalf("disabled %d (%v)", n, err)
+	}
+	if u, _ := store.Users.Get("n1"); !u.VPNConfig.Enabled {
+		t.Fatal("job undid the admin's enable")
+	}
+	if u, _ := store.Users.Get("s1"); u.VPNConfig.Enabled {
+		t.Fatal("suspended user's peer left on")
+	}
+}
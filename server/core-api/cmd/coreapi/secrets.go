@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Secret fields (VPN private keys, TeamSpeak passwords) are encrypted with
+// AES-256-GCM under a data-encryption key (DEK). DEKs live in keys.json,
+// each wrapped by the master key from MASTER_KEY or MASTER_KEY_FILE.
+// Without a master key secrets are stored as before, in plaintext.
+//
+// A sealed value reads "enc:v1:<key id>:<base64 nonce|ciphertext>" and is
+// bound to its field and record, so it cannot be pasted onto another user.
+
+const (
+	sealedPrefix   = "enc:v1:"
+	redactedSecret = "[redacted]"
+)
+
+// secretKeys is nil when no master key is configured.
+var secretKeys *keyring
+
+type keyring struct {
+	mu     sync.Mutex
+	master []byte
+	active string
+	deks   map[string][]byte
+	file   keyFile
+}
+
+type keyFile struct {
+	Active string       `json:"active"`
+	Keys   []wrappedKey `json:"keys"`
+}
+
+type wrappedKey struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Wrapped   string    `json:"wrapped"` // the DEK sealed with the master key
+}
+
+func keysFile() string {
+	return filepath.Join(dataDir, "keys.json")
+}
+
+// masterKeyFrom reads a base64-encoded 32-byte key from the env var name or
+// from the file named by name_FILE. It returns nil when neither is set.
+func masterKeyFrom(name string) ([]byte, error) {
+	encoded := os.Getenv(name)
+	if path := os.Getenv(name + "_FILE"); encoded == "" && path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s_FILE: %w", name, err)
+		}
+		encoded = string(raw)
+	}
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes, base64-encoded (openssl rand -base64 32)", name)
+	}
+	return key, nil
+}
+
+// loadKeyring unwraps the DEKs in keys.json, creating the first one on a
+// fresh data dir. DEKs that only open with MASTER_KEY_PREVIOUS are
+// rewrapped with MASTER_KEY, which is how the master key is rotated.
+func loadKeyring() (*keyring, error) {
+	master, err := masterKeyFrom("MASTER_KEY")
+	if err != nil || master == nil {
+		return nil, err
+	}
+	previous, err := masterKeyFrom("MASTER_KEY_PREVIOUS")
+	if err != nil {
+		return nil, err
+	}
+	kr := &keyring{master: master, deks: map[string][]byte{}}
+	rewrapped := false
+	err = updateJSON(keysFile(), &kr.file, func() error {
+		for _, k := range kr.file.Keys {
+			dek, err := aeadOpen(master, k.Wrapped, dekAAD(k.ID))
+			if err != nil && previous != nil {
+				dek, err = aeadOpen(previous, k.Wrapped, dekAAD(k.ID))
+				rewrapped = true
+			}
+			if err != nil {
+				return fmt.Errorf("keys.json: key %s does not open with MASTER_KEY", k.ID)
+			}
+			kr.deks[k.ID] = dek
+		}
+		if len(kr.file.Keys) == 0 {
+			return kr.addKey()
+		}
+		kr.active = kr.file.Active
+		if !rewrapped {
+			return errUnchanged
+		}
+		for i := range kr.file.Keys {
+			wrapped, err := aeadSeal(master, kr.deks[kr.file.Keys[i].ID], dekAAD(kr.file.Keys[i].ID))
+			if err != nil {
+				return err
+			}
+			kr.file.Keys[i].Wrapped = wrapped
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := kr.deks[kr.active]; !ok {
+		return nil, fmt.Errorf("keys.json: active key %q missing", kr.active)
+	}
+	if rewrapped {
+		log.Printf("Rewrapped %d data keys with the new master key", len(kr.deks))
+	}
+	return kr, nil
+}
+
+// addKey generates a DEK, makes it active and appends it to kr.file.
+// Older keys are kept so backups stay readable.
+func (kr *keyring) addKey() error {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	id := "k" + strconv.Itoa(len(kr.file.Keys)+1)
+	wrapped, err := aeadSeal(kr.master, dek, dekAAD(id))
+	if err != nil {
+		return err
+	}
+	kr.file.Keys = append(kr.file.Keys, wrappedKey{ID: id, CreatedAt: time.Now().UTC(), Wrapped: wrapped})
+	kr.file.Active = id
+	kr.deks[id] = dek
+	kr.active = id
+	return nil
+}
+
+// rotate switches to a new DEK and saves keys.json.
+func (kr *keyring) rotate() (string, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	err := updateJSON(keysFile(), &kr.file, kr.addKey)
+	return kr.active, err
+}
+
+func (kr *keyring) seal(plain, aad string) (string, error) {
+	kr.mu.Lock()
+	id, dek := kr.active, kr.deks[kr.active]
+	kr.mu.Unlock()
+	sealed, err := aeadSeal(dek, []byte(plain), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + id + ":" + sealed, nil
+}
+
+// open decrypts a sealed value. Values without the prefix were written
+// before encryption was enabled and are returned as they are.
+func (kr *keyring) open(stored, aad string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, sealedPrefix)
+	if !ok {
+		return stored, nil
+	}
+	id, data, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", errors.New("malformed sealed value")
+	}
+	kr.mu.Lock()
+	dek := kr.deks[id]
+	kr.mu.Unlock()
+	if dek == nil {
+		return "", fmt.Errorf("unknown data key %s", id)
+	}
+	plain, err := aeadOpen(dek, data, []byte(aad))
+	return string(plain), err
+}
+
+// current reports whether stored is sealed with the active key.
+func (kr *keyring) current(stored string) bool {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	return strings.HasPrefix(stored, sealedPrefix+kr.active+":")
+}
+
+func dekAAD(id string) []byte {
+	return []byte("coreapi dek " + id)
+}
+
+func aeadSeal(key, plain, aad []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, aad)), nil
+}
+
+func aeadOpen(key []byte, sealed string, aad []byte) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// secretField points at one encrypted string inside a record.
+type secretField struct {
+	label string
+	value *string
+}
+
+func userSecrets(u *User) []secretField {
+	if u.VPNConfig == nil {
+		return nil
+	}
+	return []secretField{{"vpn.private_key", &u.VPNConfig.PrivateKey}}
+}
+
+func teamSpeakSecrets(u *TeamSpeakUser) []secretField {
+	return []secretField{{"teamspeak.password", &u.Password}}
+}
+
+// sealSecrets wraps the repositories holding secrets so they are encrypted
+// on the way into s and decrypted on the way out.
+func sealSecrets(s *Store, kr *keyring) {
+	s.Users = sealedUsers{
+		sealedRepository[User]{inner: s.Users, kr: kr, key: userID, fields: userSecrets},
+		s.Users,
+	}
+	s.TeamSpeakUsers = sealedRepository[TeamSpeakUser]{inner: s.TeamSpeakUsers, kr: kr, key: teamSpeakUserID, fields: teamSpeakSecrets}
+}
+
+type sealedRepository[T any] struct {
+	inner  Repository[T]
+	kr     *keyring
+	key    func(*T) string
+	fields func(*T) []secretField
+}
+
+// fieldState remembers a field as stored and as decrypted, so an unchanged
+// secret keeps its ciphertext instead of being re-encrypted on every write.
+type fieldState struct {
+	stored, plain, aad string
+}
+
+func (r sealedRepository[T]) aad(item *T, label string) string {
+	return label + "/" + r.key(item)
+}
+
+func (r sealedRepository[T]) open(item *T) ([]fieldState, error) {
+	var states []fieldState
+	for _, f := range r.fields(item) {
+		aad := r.aad(item, f.label)
+		plain, err := r.kr.open(*f.value, aad)
+		if err != nil {
+			return nil, fmt.Errorf("%s of %s: %w", f.label, r.key(item), err)
+		}
+		states = append(states, fieldState{stored: *f.value, plain: plain, aad: aad})
+		*f.value = plain
+	}
+	return states, nil
+}
+
+func (r sealedRepository[T]) seal(item *T, prev []fieldState) error {
+	for i, f := range r.fields(item) {
+		if *f.value == "" {
+			continue
+		}
+		aad := r.aad(item, f.label)
+		if i < len(prev) && prev[i].plain == *f.value && prev[i].aad == aad && r.kr.current(prev[i].stored) {
+			*f.value = prev[i].stored
+			continue
+		}
+		sealed, err := r.kr.seal(*f.value, aad)
+		if err != nil {
+			return err
+		}
+		*f.value = sealed
+	}
+	return nil
+}
+
+func (r sealedRepository[T]) List() ([]T, error) {
+	list, err := r.inner.List()
+	if err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if _, err := r.open(&list[i]); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (r sealedRepository[T]) Get(id string) (T, error) {
+	item, err := r.inner.Get(id)
+	if err == nil {
+		_, err = r.open(&item)
+	}
+	return item, err
+}
+
+func (r sealedRepository[T]) Create(item T) error {
+	if err := r.seal(&item, nil); err != nil {
+		return err
+	}
+	return r.inner.Create(item)
+}
+
+func (r sealedRepository[T]) Update(id string, fn func(*T) error) (T, error) {
+	item, err := r.inner.Update(id, func(stored *T) error {
+		prev, err := r.open(stored)
+		if err != nil {
+			return err
+		}
+		if err := fn(stored); err != nil {
+			return err
+		}
+		return r.seal(stored, prev)
+	})
+	if err == nil {
+		_, err = r.open(&item)
+	}
+	return item, err
+}
+
+func (r sealedRepository[T]) Delete(id string) error {
+	return r.inner.Delete(id)
+}
+
+func (r sealedRepository[T]) Mutate(fn func([]T) ([]T, error)) error {
+	return r.inner.Mutate(func(list []T) ([]T, error) {
+		prev := make(map[string][]fieldState, len(list))
+		for i := range list {
+			states, err := r.open(&list[i])
+			if err != nil {
+				return nil, err
+			}
+			prev[r.key(&list[i])] = states
+		}
+		list, err := fn(list)
+		if err != nil {
+			return nil, err
+		}
+		for i := range list {
+			if err := r.seal(&list[i], prev[r.key(&list[i])]); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	})
+}
+
+// sealedUsers keeps the backend's own lookups.
+type sealedUsers struct {
+	sealedRepository[User]
+	users UserRepository
+}
+
+func (r sealedUsers) FindByEmail(email string) (User, error) {
+	u, err := r.users.FindByEmail(email)
+	if err == nil {
+		_, err = r.open(&u)
+	}
+	return u, err
+}
+
+func (r sealedUsers) FindByUsername(username string) (User, error) {
+	u, err := r.users.FindByUsername(username)
+	if err == nil {
+		_, err = r.open(&u)
+	}
+	return u, err
+}
+
+// resealSecrets rewrites every record holding a secret, which encrypts
+// values stored before encryption was enabled and moves everything onto
+// the active key. It returns how many records were visited.
+func resealSecrets() (int, error) {
+	visited := 0
+	err := store.Users.Mutate(func(list []User) ([]User, error) {
+		visited += len(list)
+		return list, nil
+	})
+	if err != nil {
+		return visited, err
+	}
+	err = store.TeamSpeakUsers.Mutate(func(list []TeamSpeakUser) ([]TeamSpeakUser, error) {
+		visited += len(list)
+		return list, nil
+	})
+	return visited, err
+}
+
+// revealSecrets reports whether the response may include secrets belonging
+// to ownerID. Secrets are only shown on ?reveal=true, to the owner or to
+// holders of secrets.reveal; any other reveal request is refused.
+func revealSecrets(c *fiber.Ctx, ownerID string) (bool, error) {
+	if !c.QueryBool("reveal") {
+		return false, nil
+	}
+	user, err := currentUser(c)
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		return false, fiber.NewError(fiber.StatusUnauthorized, "authentication required")
+	}
+	if (ownerID == "" || user.ID != ownerID) && !hasPermission(user, permRevealSecrets) {
+		return false, fiber.NewError(fiber.StatusForbidden, "missing permission "+permRevealSecrets)
+	}
+	recordAudit(c, "secrets.reveal", firstNonEmpty(ownerID, c.Path()), "")
+	return true, nil
+}
+
+func redactUser(u *User) {
+	if u.VPNConfig != nil && u.VPNConfig.PrivateKey != "" {
+		u.VPNConfig.PrivateKey = redactedSecret
+	}
+}
+
+func redactTeamSpeakUser(u *TeamSpeakUser) {
+	if u.Password != "" {
+		u.Password = redactedSecret
+	}
+}
+
+func handleKeysList(c *fiber.Ctx) error {
+	if secretKeys == nil {
+		return c.JSON(fiber.Map{"enabled": false, "keys": []any{}})
+	}
+	secretKeys.mu.Lock()
+	defer secretKeys.mu.Unlock()
+	keys := make([]fiber.Map, 0, len(secretKeys.file.Keys))
+	for _, k := range secretKeys.file.Keys {
+		keys = append(keys, fiber.Map{"id": k.ID, "created_at": k.CreatedAt, "active": k.ID == secretKeys.active})
+	}
+	return c.JSON(fiber.Map{"enabled": true, "keys": keys})
+}
+
+// handleKeysRotate switches to a new data key and re-encrypts every secret
+// with it.
+func handleKeysRotate(c *fiber.Ctx) error {
+	if secretKeys == nil {
+		return fiber.NewError(fiber.StatusConflict, "encryption is not enabled (set MASTER_KEY)")
+	}
+	id, err := secretKeys.rotate()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	n, err := resealSecrets()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+	recordAudit(c, "keys.rotate", id, "")
+	return c.JSON(fiber.Map{"ok": true, "active": id, "records": n})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func testMasterKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+// useSealedStore loads a keyring for MASTER_KEY and swaps in a sealed JSON
+// store for the duration of the test.
+func useSealedStore(t *testing.T) *keyring {
+	t.Helper()
+	kr, err := loadKeyring()
+	if err != nil || kr == nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	prevStore, prevKeys := store, secretKeys
+	store, secretKeys = newJSONStore(), kr
+	sealSecrets(store, kr)
+	t.Cleanup(func() { store, secretKeys = prevStore, prevKeys })
+	return kr
+}
+
+func rawUsers(t *testing.T) []User {
+	t.Helper()
+	var users []User
+	if err := readJSON(filepath.Join(dataDir, "users.json"), &users); err != nil {
+		t.Fatal(err)
+	}
+	return users
+}
+
+func TestSecretsEncryptedAtRest(t *testing.T) {
+	dataDir = t.TempDir()
+	t.Setenv("MASTER_KEY", testMasterKey('a'))
+	// Written before encryption was enabled.
+	_ = writeJSON(filepath.Join(dataDir, "users.json"), []User{
+		{ID: "u1", Email: "a@example.org", VPNConfig: &VPNConfig{PrivateKey: "legacy-key"}},
+		{ID: "u2", Email: "b@example.org", VPNConfig: &VPNConfig{PrivateKey: "other-key"}},
+	})
+	kr := useSealedStore(t)
+	if _, err := resealSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dataDir, "users.json"))
+	if strings.Contains(string(raw), "legacy-key") || !strings.Contains(string(raw), sealedPrefix+"k1:") {
+		t.Fatalf("plaintext left on disk: %s", raw)
+	}
+	if u, err := store.Users.FindByEmail("a@example.org"); err != nil || u.VPNConfig.PrivateKey != "legacy-key" {
+		t.Fatalf("decrypt: %+v %v", u, err)
+	}
+
+	if err := store.TeamSpeakUsers.Create(TeamSpeakUser{ID: "t1", Username: "ts", Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ = os.ReadFile(filepath.Join(dataDir, "teamspeak_users.json"))
+	if strings.Contains(string(raw), "hunter2") {
+		t.Fatalf("TeamSpeak password on disk: %s", raw)
+	}
+
+	// Unrelated writes keep the existing ciphertext.
+	before := rawUsers(t)[0].VPNConfig.PrivateKey
+	if _, err := store.Users.Update("u1", func(u *User) error { u.Username = "ada"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if after := rawUsers(t)[0].VPNConfig.PrivateKey; after != before {
+		t.Fatal("unchanged secret was re-encrypted")
+	}
+
+	// A ciphertext moved onto another record does not open.
+	users := rawUsers(t)
+	users[1].VPNConfig.PrivateKey = users[0].VPNConfig.PrivateKey
+	_ = writeJSON(filepath.Join(dataDir, "users.json"), users)
+	if _, err := store.Users.Get("u2"); err == nil {
+		t.Fatal("swapped ciphertext decrypted")
+	}
+	users[1].VPNConfig.PrivateKey = "other-key"
+	_ = writeJSON(filepath.Join(dataDir, "users.json"), users)
+
+	// Rotation re-encrypts everything with the new key and keeps the old one.
+	if id, err := kr.rotate(); err != nil || id != "k2" {
+		t.Fatalf("rotate: %s %v", id, err)
+	}
+	if _, err := resealSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range rawUsers(t) {
+		if !strings.HasPrefix(u.VPNConfig.PrivateKey, sealedPrefix+"k2:") {
+			t.Fatalf("not re-encrypted: %s", u.VPNConfig.PrivateKey)
+		}
+	}
+	if ts, _ := store.TeamSpeakUsers.Get("t1"); ts.Password != "hunter2" {
+		t.Fatalf("after rotation: %+v", ts)
+	}
+	var kf keyFile
+	if err := readJSON(keysFile(), &kf); err != nil || kf.Active != "k2" || len(kf.Keys) != 2 {
+		t.Fatalf("keys.json: %+v %v", kf, err)
+	}
+}
+
+func TestMasterKeyRotation(t *testing.T) {
+	dataDir = t.TempDir()
+	t.Setenv("MASTER_KEY", testMasterKey('a'))
+	useSealedStore(t)
+	_ = store.TeamSpeakUsers.Create(TeamSpeakUser{ID: "t1", Password: "hunter2"})
+
+	t.Setenv("MASTER_KEY", testMasterKey('b'))
+	if _, err := loadKeyring(); err == nil {
+		t.Fatal("wrong master key accepted")
+	}
+	t.Setenv("MASTER_KEY_PREVIOUS", testMasterKey('a'))
+	if _, err := loadKeyring(); err != nil {
+		t.Fatalf("rewrap: %v", err)
+	}
+	os.Unsetenv("MASTER_KEY_PREVIOUS")
+	useSealedStore(t)
+	if ts, err := store.TeamSpeakUsers.Get("t1"); err != nil || ts.Password != "hunter2" {
+		t.Fatalf("after master key rotation: %+v %v", ts, err)
+	}
+
+	t.Setenv("MASTER_KEY", "too-short")
+	if _, err := loadKeyring(); err == nil {
+		t.Fatal("malformed master key accepted")
+	}
+}
+
+func TestSecretsRedactedInResponses(t *testing.T) {
+	dataDir = t.TempDir()
+	t.Setenv("MASTER_KEY", testMasterKey('a'))
+	useSealedStore(t)
+	admin := User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: "active"}
+	member := User{ID: "m1", Email: "m@example.org", Role: "user", Status: "active", VPNConfig: &VPNConfig{PrivateKey: "member-key"}}
+	_ = store.Users.Create(admin)
+	_ = store.Users.Create(member)
+	_ = store.TeamSpeakUsers.Create(TeamSpeakUser{ID: "t1", Password: "hunter2"})
+	adminToken, _ := generateJWT(&admin)
+	memberToken, _ := generateJWT(&member)
+
+	app := fiber.New()
+	app.Get("/users/:id", handleUserGet)
+	app.Get("/vpn/config/:user_id", handleVPNConfigGet)
+	app.Post("/vpn/config/:user_id", handleVPNConfigUpdate)
+	app.Get("/teamspeak/users", handleTeamSpeakUsersList)
+
+	get := func(path, token string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, _ := app.Test(req)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get("/teamspeak/users", ""); code != 200 || strings.Contains(body, "hunter2") || !strings.Contains(body, redactedSecret) {
+		t.Fatalf("list not redacted: %d %s", code, body)
+	}
+	if code, _ := get("/teamspeak/users?reveal=true", ""); code != fiber.StatusUnauthorized {
+		t.Fatalf("anonymous reveal: %d", code)
+	}
+	if code, _ := get("/teamspeak/users?reveal=true", memberToken); code != fiber.StatusForbidden {
+		t.Fatalf("member reveal: %d", code)
+	}
+	if code, body := get("/teamspeak/users?reveal=true", adminToken); code != 200 || !strings.Contains(body, "hunter2") {
+		t.Fatalf("admin reveal: %d %s", code, body)
+	}
+	if code, body := get("/vpn/config/m1?reveal=true", memberToken); code != 200 || !strings.Contains(body, "member-key") {
+		t.Fatalf("owner reveal: %d %s", code, body)
+	}
+	if code, body := get("/users/m1", adminToken); code != 200 || strings.Contains(body, "member-key") {
+		t.Fatalf("user not redacted: %d %s", code, body)
+	}
+
+	// Posting back a redacted config leaves the key alone.
+	req := httptest.NewRequest("POST", "/vpn/config/m1", strings.NewReader(`{"private_key":"`+redactedSecret+`","enabled":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	if resp, _ := app.Test(req); resp.StatusCode != 200 {
+		t.Fatalf("update: %d", resp.StatusCode)
+	}
+	if u, _ := store.Users.Get("m1"); u.VPNConfig.PrivateKey != "member-key" {
+		t.Fatalf("redacted placeholder stored: %q", u.VPNConfig.PrivateKey)
+	}
+	entries, _ := store.Audit.List(0)
+	raw, _ := json.Marshal(entries)
+	if !strings.Contains(string(raw), "secrets.reveal") {
+		t.Fatalf("reveal not audited: %s", raw)
+	}
+}
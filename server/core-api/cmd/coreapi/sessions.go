@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+var sessionTTL = envDuration("SESSION_TTL", 24*time.Hour)
+
+// Session backs one issued token. Deleting it logs the token out.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func createSession(userID string) (Session, error) {
+	id, err := randomToken(18)
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC()
+	s := Session{ID: id, UserID: userID, CreatedAt: now, ExpiresAt: now.Add(sessionTTL)}
+	return s, store.Sessions.Create(s)
+}
+
+// lookupSession returns the live session with id, or nil.
+func lookupSession(id string, now time.Time) (*Session, error) {
+	s, err := store.Sessions.Get(id)
+	if errors.Is(err, errNotFound) || (err == nil && !now.Before(s.ExpiresAt)) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// removeSessions deletes every session for which drop returns true.
+func removeSessions(drop func(Session) bool) (int, error) {
+	removed := 0
+	err := store.Sessions.Mutate(func(list []Session) ([]Session, error) {
+		kept := list[:0]
+		for _, s := range list {
+			if !drop(s) {
+				kept = append(kept, s)
+			}
+		}
+		removed = len(list) - len(kept)
+		if removed == 0 {
+			return nil, errUnchanged
+		}
+		return kept, nil
+	})
+	return removed, err
+}
+
+func deleteSession(id string) error {
+	if err := store.Sessions.Delete(id); err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	return nil
+}
+
+func pruneExpiredSessions() (int, error) {
+	now := time.Now()
+	return removeSessions(func(s Session) bool { return !now.Before(s.ExpiresAt) })
+}
+
+// tokenClaims splits a token issued by generateJWT into the user ID and the
+// session ID. ok is false for malformed tokens.
+func tokenClaims(token string) (userID, sessionID string, ok bool) {
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) < 4 || parts[0] == "" || parts[len(parts)-1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[len(parts)-1], true
+}
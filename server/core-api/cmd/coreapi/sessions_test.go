@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSessionLifecycle(t *testing.T) {
+	dataDir = t.TempDir()
+	user := User{ID: "u1", Email: "a@example.org", Role: "user", Status: "active"}
+	_ = writeJSON(filepath.Join(dataDir, "users.json"), []User{user})
+	token, err := generateJWT(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Get("/me", func(c *fiber.Ctx) error {
+		u, err := currentUser(c)
+		if err != nil {
+			return err
+		}
+		return c.JSON(u)
+	})
+	app.Post("/logout", handleLogout)
+	call := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := app.Test(req)
+		return resp.StatusCode
+	}
+
+	if code := call("GET", "/me"); code != 200 {
+		t.Fatalf("fresh token rejected: %d", code)
+	}
+	if code := call("POST", "/logout"); code != 200 {
+		t.Fatalf("logout: %d", code)
+	}
+	if code := call("GET", "/me"); code != fiber.StatusUnauthorized {
+		t.Fatalf("token still valid after logout: %d", code)
+	}
+
+	_ = store.Sessions.Create(Session{ID: "old", UserID: "u1", ExpiresAt: time.Now().Add(-time.Minute)})
+	if n, err := pruneExpiredSessions(); err != nil || n != 1 {
+		t.Fatalf("pruned %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spamHoneypotField is the registration form field hidden from people.
+const spamHoneypotField = "website"
+
+var (
+	spamRejectScore     = envInt("SPAM_REJECT_SCORE", 100)
+	spamQuarantineScore = envInt("SPAM_QUARANTINE_SCORE", 50)
+	spamBurstWindow     = envDuration("SPAM_BURST_WINDOW", 10*time.Minute)
+)
+
+// SpamSignalResult is one signal's contribution to a registration's score.
+type SpamSignalResult struct {
+	Signal string `json:"signal"`
+	Score  int    `json:"score"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// spamInput carries what a signal may inspect about a submission.
+type spamInput struct {
+	Registration  Registration
+	Honeypot      string
+	FormStartedAt time.Time // zero when the client did not send it
+	ReceivedAt    time.Time
+}
+
+// spamSignal is a pluggable heuristic. Score returns 0 when the signal has
+// nothing to say about the submission.
+type spamSignal interface {
+	Name() string
+	Score(in spamInput) (int, string)
+}
+
+var spamSignals = []spamSignal{
+	honeypotSignal{},
+	timingSignal{},
+	newSubnetBurstSignal(),
+}
+
+// scoreRegistration runs every signal and returns the total with the
+// non-zero contributions.
+func scoreRegistration(in spamInput) (int, []SpamSignalResult) {
+	total := 0
+	var results []SpamSignalResult
+	for _, s := range spamSignals {
+		score, detail := s.Score(in)
+		if score == 0 {
+			continue
+		}
+		total += score
+		results = append(results, SpamSignalResult{Signal: s.Name(), Score: score, Detail: detail})
+	}
+	return total, results
+}
+
+// honeypotSignal flags forms where the hidden field, invisible to people,
+// was filled in.
+type honeypotSignal struct{}
+
+func (honeypotSignal) Name() string { return "honeypot" }
+
+func (honeypotSignal) Score(in spamInput) (int, string) {
+	if strings.TrimSpace(in.Honeypot) != "" {
+		return 100, "hidden field " + spamHoneypotField + " was filled in"
+	}
+	return 0, ""
+}
+
+// timingSignal flags forms submitted faster than a person can type. A
+// missing start time scores nothing: API clients and older pages do not
+// send it.
+type timingSignal struct{}
+
+func (timingSignal) Name() string { return "timing" }
+
+func (timingSignal) Score(in spamInput) (int, string) {
+	if in.FormStartedAt.IsZero() {
+		return 0, ""
+	}
+	elapsed := in.ReceivedAt.Sub(in.FormStartedAt)
+	switch {
+	case elapsed < 0:
+		return 30, "form start time is in the future"
+	case elapsed < time.Second:
+		return 60, fmt.Sprintf("submitted %s after the form was shown", elapsed.Round(time.Millisecond))
+	case elapsed < 3*time.Second:
+		return 30, fmt.Sprintf("submitted %s after the form was shown", elapsed.Round(time.Millisecond))
+	}
+	return 0, ""
+}
+
+// subnetBurstSignal counts recent submissions from the same /24 (IPv4) or
+// /64 (IPv6) within spamBurstWindow. Loopback, private and unspecified
+// addresses are skipped: they are a proxy or the local network, not the
+// applicant, and would put every sign-up in one bucket.
+type subnetBurstSignal struct {
+	mu   sync.Mutex
+	seen map[string][]time.Time
+}
+
+func newSubnetBurstSignal() *subnetBurstSignal {
+	return &subnetBurstSignal{seen: make(map[string][]time.Time)}
+}
+
+func (*subnetBurstSignal) Name() string { return "subnet_burst" }
+
+func (s *subnetBurstSignal) Score(in spamInput) (int, string) {
+	subnet := subnetOf(in.Registration.SourceIP)
+	if subnet == "" {
+		return 0, ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := in.ReceivedAt.Add(-spamBurstWindow)
+	recent := s.seen[subnet][:0]
+	for _, t := range s.seen[subnet] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	prior := len(recent)
+	s.seen[subnet] = append(recent, in.ReceivedAt)
+	for k, times := range s.seen {
+		if len(times) > 0 && !times[len(times)-1].After(cutoff) {
+			delete(s.seen, k)
+		}
+	}
+	if prior < 2 {
+		return 0, ""
+	}
+	score := (prior - 1) * 15
+	if score > 60 {
+		score = 60
+	}
+	return score, fmt.Sprintf("%d earlier submissions from %s in the last %s", prior, subnet, spamBurstWindow)
+}
+
+func subnetOf(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSpamScoring(t *testing.T) {
+	dataDir = t.TempDir()
+	prev := spamSignals
+	spamSignals = []spamSignal{honeypotSignal{}, timingSignal{}, newSubnetBurstSignal()}
+	defer func() { spamSignals = prev }()
+
+	app := fiber.New()
+	app.Post("/register", handleRegistrationSubmit)
+	submit := func(body string) int {
+		req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	started := func(ago time.Duration) int64 {
+		return time.Now().Add(-ago).UnixMilli()
+	}
+
+	if code := submit(fmt.Sprintf(`{"email":"fast@x.org","form_started_at":%d}`, started(200*time.Millisecond))); code != 200 {
+		t.Fatalf("fast submission should be quarantined, got %d", code)
+	}
+	if code := submit(fmt.Sprintf(`{"email":"human@x.org","form_started_at":%d}`, started(time.Minute))); code != 200 {
+		t.Fatalf("human submission failed: %d", code)
+	}
+	if code := submit(`{"email":"client@x.org"}`); code != 200 {
+		t.Fatalf("submission without a start time failed: %d", code)
+	}
+
+	var pending []Registration
+	if err := readJSON(filepath.Join(dataDir, "pending.json"), &pending); err != nil || len(pending) != 3 {
+		t.Fatalf("pending: %v %v", pending, err)
+	}
+	if pending[2].SpamScore != 0 {
+		t.Fatalf("missing start time scored: %+v", pending[2])
+	}
+	if pending[0].Status != "quarantined" || pending[0].SpamScore < spamQuarantineScore || len(pending[0].SpamSignals) == 0 {
+		t.Fatalf("fast submission not quarantined: %+v", pending[0])
+	}
+	if pending[1].Status != "pending" || pending[1].SpamScore != 0 {
+		t.Fatalf("human submission scored: %+v", pending[1])
+	}
+
+	if code := submit(fmt.Sprintf(`{"email":"bot@x.org","website":"http://spam","form_started_at":%d}`, started(time.Minute))); code != fiber.StatusForbidden {
+		t.Fatalf("honeypot submission accepted: %d", code)
+	}
+	rejected, _ := loadRejected()
+	if len(rejected) != 1 || !strings.HasPrefix(rejected[0].Reason, "spam score") {
+		t.Fatalf("spam rejection not recorded: %+v", rejected)
+	}
+
+	burst := newSubnetBurstSignal()
+	now := time.Now()
+	var score int
+	for i := 0; i < 4; i++ {
+		score, _ = burst.Score(spamInput{Registration: Registration{SourceIP: fmt.Sprintf("192.0.2.%d", i+1)}, ReceivedAt: now})
+	}
+	if score != 30 {
+		t.Fatalf("expected burst score 30 for the fourth hit, got %d", score)
+	}
+	if score, _ = burst.Score(spamInput{Registration: Registration{SourceIP: "198.51.100.1"}, ReceivedAt: now}); score != 0 {
+		t.Fatalf("other subnet scored %d", score)
+	}
+
+	for i := 0; i < 4; i++ {
+		if score, _ = burst.Score(spamInput{Registration: Registration{SourceIP: "10.0.0.1"}, ReceivedAt: now}); score != 0 {
+			t.Fatalf("proxy address scored %d", score)
+		}
+	}
+}
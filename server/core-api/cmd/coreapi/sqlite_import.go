@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const metaJSONImported = "json_imported_at"
+
+// importJSONOnce copies the JSON files in DATA_DIR into a freshly created
+// SQLite store. It runs once per database: the time of the import is kept
+// in the meta table and later starts skip it. Tables that already hold
+// rows are left alone. The JSON files themselves are not touched.
+func importJSONOnce(db *sql.DB, dst *Store) error {
+	var at string
+	err := db.QueryRow(`SELECT value FROM meta WHERE key = ?`, metaJSONImported).Scan(&at)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	counts, err := importJSONStore(newJSONStore(), dst)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported JSON data into SQLite: %v", counts)
+	_, err = db.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)`, metaJSONImported, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// importJSONStore copies every record from src into the empty collections
+// of dst and reports how many records each collection received.
+func importJSONStore(src, dst *Store) (map[string]int, error) {
+	counts := map[string]int{}
+	steps := []struct {
+		name string
+		run  func() (int, error)
+	}{
+		{"users", func() (int, error) { return importCollection[User](src.Users, dst.Users) }},
+		{"registrations", func() (int, error) { return importCollection[Registration](src.Registrations, dst.Registrations) }},
+		{"invites", func() (int, error) { return importCollection[Invite](src.Invites, dst.Invites) }},
+		{"teamspeak_users", func() (int, error) { return importCollection[TeamSpeakUser](src.TeamSpeakUsers, dst.TeamSpeakUsers) }},
+		{"sessions", func() (int, error) { return importCollection[Session](src.Sessions, dst.Sessions) }},
+		{"audit", func() (int, error) { return importAudit(src.Audit, dst.Audit) }},
+	}
+	for _, step := range steps {
+		n, err := step.run()
+		if err != nil {
+			return counts, fmt.Errorf("import %s: %w", step.name, err)
+		}
+		counts[step.name] = n
+	}
+	return counts, nil
+}
+
+func importCollection[T any](src, dst Repository[T]) (int, error) {
+	items, err := src.List()
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	err = dst.Mutate(func(list []T) ([]T, error) {
+		if len(list) > 0 || len(items) == 0 {
+			return nil, errUnchanged
+		}
+		imported = len(items)
+		return items, nil
+	})
+	return imported, err
+}
+
+func importAudit(src, dst AuditRepository) (int, error) {
+	existing, err := dst.List(1)
+	if err != nil || len(existing) > 0 {
+		return 0, err
+	}
+	entries, err := src.List(0)
+	if err != nil {
+		return 0, err
+	}
+	// List is newest first; append oldest first to keep the order.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := dst.Append(entries[i]); err != nil {
+			return len(entries) - 1 - i, err
+		}
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	errNotFound = errors.New("not found")
+	errConflict = errors.New("already exists")
+)
+
+// Repository is the storage contract shared by every entity. Records are
+// keyed by a string ID (the token for invites). Values returned by a
+// repository are copies; changes only persist through Create, Update,
+// Delete or Mutate.
+type Repository[T any] interface {
+	List() ([]T, error)
+	Get(id string) (T, error)
+	Create(item T) error
+	// Update applies fn to the stored record and saves it unless fn fails.
+	Update(id string, fn func(*T) error) (T, error)
+	Delete(id string) error
+	// Mutate replaces the whole collection with fn's result as one atomic
+	// read-modify-write. It is meant for operations that must see and write
+	// several records at once. fn may return errUnchanged to skip the write.
+	Mutate(fn func([]T) ([]T, error)) error
+}
+
+type UserRepository interface {
+	Repository[User]
+	FindByEmail(email string) (User, error)
+	FindByUsername(username string) (User, error)
+}
+
+type RegistrationRepository interface {
+	Repository[Registration]
+}
+
+type InviteRepository interface {
+	Repository[Invite]
+}
+
+type TeamSpeakUserRepository interface {
+	Repository[TeamSpeakUser]
+}
+
+// CaptchaRepository holds outstanding captcha challenges.
+type CaptchaRepository interface {
+	Put(id string, entry captchaEntry) error
+	// Take removes and returns the challenge so it can only be answered once.
+	Take(id string) (captchaEntry, error)
+	DeleteExpired(now time.Time) (int, error)
+}
+
+type SessionRepository interface {
+	Repository[Session]
+}
+
+// AuditRepository is an append-only log of administrative actions.
+type AuditRepository interface {
+	Append(entry AuditEntry) error
+	// List returns up to limit entries, newest first. limit <= 0 means all.
+	List(limit int) ([]AuditEntry, error)
+	// RenameActor replaces the actor of entries made under any of names,
+	// compared case-insensitively. It is the one edit the log allows, so
+	// an erased user's entries can stay without naming them.
+	RenameActor(names []string, to string) (int, error)
+}
+
+// Store bundles the repositories handlers work against.
+type Store struct {
+	Users          UserRepository
+	Registrations  RegistrationRepository
+	Invites        InviteRepository
+	TeamSpeakUsers TeamSpeakUserRepository
+	Sessions       SessionRepository
+	Audit          AuditRepository
+	Captchas       CaptchaRepository
+
+	// close releases the backend, if it holds anything open.
+	close func() error
+	// snapshotTo and restoreFrom copy a backend that keeps its data
+	// outside the JSON files (SQLite) to and from a file for backups.
+	snapshotTo  func(path string) error
+	restoreFrom func(path string) error
+}
+
+// Close releases whatever the backend holds open.
+func (s *Store) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+var store = newJSONStore()
+
+// openStore opens the backend chosen by STORAGE_BACKEND or data.backend in
+// config.yml. JSON files are the default. Secrets are sealed when a master key is loaded.
+func openStore() (*Store, error) {
+	var s *Store
+	switch backend := storageBackend(); backend {
+	case "json":
+		s = newJSONStore()
+		cacheJSONStore(s)
+	case "sqlite":
+		var err error
+		if s, err = newSQLiteStore(sqlitePath()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+	if secretKeys != nil {
+		sealSecrets(s, secretKeys)
+	}
+	return s, nil
+}
+
+func storageBackend() string {
+	return envOr("STORAGE_BACKEND", firstNonEmpty(appConfig.Data.Backend, "json"))
+}
+
+func sqlitePath() string {
+	return envOr("SQLITE_PATH", firstNonEmpty(appConfig.Data.SQLitePath, filepath.Join(dataDir, "coreapi.db")))
+}
+
+func userID(u *User) string                   { return u.ID }
+func registrationID(r *Registration) string   { return r.ID }
+func inviteToken(i *Invite) string            { return i.Token }
+func teamSpeakUserID(u *TeamSpeakUser) string { return u.ID }
+func sessionID(s *Session) string             { return s.ID }
+
+// userRepository adds the user lookups on top of any backend's collection.
+type userRepository struct {
+	Repository[User]
+}
+
+func (r userRepository) FindByEmail(email string) (User, error) {
+	users, err := r.List()
+	if err != nil {
+		return User{}, err
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+func (r userRepository) FindByUsername(username string) (User, error) {
+	users, err := r.List()
+	if err != nil {
+		return User{}, err
+	}
+	for _, u := range users {
+		if username != "" && strings.EqualFold(u.Username, username) {
+			return u, nil
+		}
+	}
+	return User{}, errNotFound
+}
+
+// storeError maps repository errors onto HTTP errors. Fiber errors raised
+// inside Update or Mutate callbacks pass through unchanged.
+func storeError(err error, notFound string) error {
+	var fe *fiber.Error
+	switch {
+	case errors.As(err, &fe):
+		return fe
+	case errors.Is(err, errNotFound):
+		return fiber.NewError(fiber.StatusNotFound, notFound)
+	case errors.Is(err, errConflict):
+		return fiber.NewError(fiber.StatusConflict, err.Error())
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// newJSONStore keeps every entity in its own JSON file under DATA_DIR.
+// Paths are resolved on each call so DATA_DIR can change in tests.
+func newJSONStore() *Store {
+	return &Store{
+		Users:          userRepository{jsonCollection[User]{file: "users.json", key: userID}},
+		Registrations:  jsonCollection[Registration]{file: "pending.json", key: registrationID},
+		Invites:        jsonCollection[Invite]{file: "invites.json", key: inviteToken},
+		TeamSpeakUsers: jsonCollection[TeamSpeakUser]{file: "teamspeak_users.json", key: teamSpeakUserID},
+		Sessions:       jsonCollection[Session]{file: "sessions.json", key: sessionID},
+		Audit:          jsonAuditLog{},
+		Captchas:       jsonCaptchaRepository{},
+	}
+}
+
+// jsonCollection stores a slice of T as one JSON array file.
+type jsonCollection[T any] struct {
+	file string
+	key  func(*T) string
+}
+
+func (c jsonCollection[T]) path() string {
+	return filepath.Join(dataDir, c.file)
+}
+
+func (c jsonCollection[T]) List() ([]T, error) {
+	var list []T
+	if err := readJSON(c.path(), &list); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if list == nil {
+		list = []T{}
+	}
+	return list, nil
+}
+
+func (c jsonCollection[T]) Get(id string) (T, error) {
+	var zero T
+	list, err := c.List()
+	if err != nil {
+		return zero, err
+	}
+	for i := range list {
+		if c.key(&list[i]) == id {
+			return list[i], nil
+		}
+	}
+	return zero, errNotFound
+}
+
+func (c jsonCollection[T]) Create(item T) error {
+	return c.Mutate(func(list []T) ([]T, error) {
+		id := c.key(&item)
+		for i := range list {
+			if c.key(&list[i]) == id {
+				return nil, errConflict
+			}
+		}
+		return append(list, item), nil
+	})
+}
+
+func (c jsonCollection[T]) Update(id string, fn func(*T) error) (T, error) {
+	var updated T
+	err := c.Mutate(func(list []T) ([]T, error) {
+		for i := range list {
+			if c.key(&list[i]) == id {
+				if err := fn(&list[i]); err != nil {
+					return nil, err
+				}
+				updated = list[i]
+				return list, nil
+			}
+		}
+		return nil, errNotFound
+	})
+	return updated, err
+}
+
+func (c jsonCollection[T]) Delete(id string) error {
+	return c.Mutate(func(list []T) ([]T, error) {
+		for i := range list {
+			if c.key(&list[i]) == id {
+				return append(list[:i], list[i+1:]...), nil
+			}
+		}
+		return nil, errNotFound
+	})
+}
+
+// Mutate holds the file lock from read to write, so concurrent writers
+// in this or another process never lose each other's changes. fn must not
+// call back into the same collection's write methods.
+func (c jsonCollection[T]) Mutate(fn func([]T) ([]T, error)) error {
+	unlock, err := lockFile(c.path())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	list, err := c.List()
+	if err != nil {
+		return err
+	}
+	list, err = fn(list)
+	if err != nil {
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
+	}
+	if list == nil {
+		list = []T{}
+	}
+	return writeJSON(c.path(), list)
+}
+
+// jsonAuditLog appends entries to audit.json in the order they happen.
+type jsonAuditLog struct{}
+
+func (jsonAuditLog) path() string {
+	return filepath.Join(dataDir, "audit.json")
+}
+
+func (l jsonAuditLog) Append(entry AuditEntry) error {
+	var list []AuditEntry
+	return updateJSON(l.path(), &list, func() error {
+		entry.ID = 1
+		if n := len(list); n > 0 {
+			entry.ID = list[n-1].ID + 1
+		}
+		list = append(list, entry)
+		return nil
+	})
+}
+
+func (l jsonAuditLog) List(limit int) ([]AuditEntry, error) {
+	var list []AuditEntry
+	if err := readJSON(l.path(), &list); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return newestFirst(list, limit), nil
+}
+
+func (l jsonAuditLog) RenameActor(names []string, to string) (int, error) {
+	var list []AuditEntry
+	renamed := 0
+	err := updateJSON(l.path(), &list, func() error {
+		renamed = 0
+		for i := range list {
+			if actorIn(list[i].Actor, names) {
+				list[i].Actor = to
+				renamed++
+			}
+		}
+		if renamed == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	return renamed, err
+}
+
+// jsonCaptchaRepository keeps challenges in captcha_store.json, which is
+// the source of truth so any process sharing DATA_DIR can answer them. The
+// in-process captchaStore is kept in step as a mirror.
+type jsonCaptchaRepository struct{}
+
+func (jsonCaptchaRepository) update(fn func(m map[string]captchaFileEntry) error) error {
+	var m map[string]captchaFileEntry
+	return updateJSON(captchaStoreFile(), &m, func() error {
+		if m == nil {
+			m = map[string]captchaFileEntry{}
+		}
+		return fn(m)
+	})
+}
+
+func (r jsonCaptchaRepository) Put(id string, entry captchaEntry) error {
+	err := r.update(func(m map[string]captchaFileEntry) error {
+		m[id] = captchaFileEntry{
+			AnswerHash: base64.StdEncoding.EncodeToString(entry.answerHash),
+			ExpiresAt:  entry.expiresAt,
+		}
+		return nil
+	})
+	if err == nil {
+		captchaStore.Store(id, entry)
+	}
+	return err
+}
+
+func (r jsonCaptchaRepository) Take(id string) (captchaEntry, error) {
+	var entry captchaEntry
+	err := r.update(func(m map[string]captchaFileEntry) error {
+		stored, ok := m[id]
+		if !ok {
+			return errNotFound
+		}
+		hash, err := base64.StdEncoding.DecodeString(stored.AnswerHash)
+		if err != nil {
+			return err
+		}
+		entry = captchaEntry{answerHash: hash, expiresAt: stored.ExpiresAt}
+		delete(m, id)
+		return nil
+	})
+	captchaStore.Delete(id)
+	return entry, err
+}
+
+func (r jsonCaptchaRepository) DeleteExpired(now time.Time) (int, error) {
+	removed := 0
+	err := r.update(func(m map[string]captchaFileEntry) error {
+		for id, e := range m {
+			if now.After(e.ExpiresAt) {
+				delete(m, id)
+				removed++
+			}
+		}
+		return nil
+	})
+	captchaStore.Range(func(k, v any) bool {
+		if now.After(v.(captchaEntry).expiresAt) {
+			captchaStore.Delete(k)
+		}
+		return true
+	})
+	return removed, err
+}
+
+func loadCaptchaStore() error {
+	var m map[string]captchaFileEntry
+	if err := readJSON(captchaStoreFile(), &m); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	now := time.Now()
+	for k, v := range m {
+		if now.After(v.ExpiresAt) {
+			continue
+		}
+		hash, err := base64.StdEncoding.DecodeString(v.AnswerHash)
+		if err != nil {
+			continue
+		}
+		captchaStore.Store(k, captchaEntry{answerHash: hash, expiresAt: v.ExpiresAt})
+	}
+	return saveCaptchaStore()
+}
+
+func saveCaptchaStore() error {
+	m := make(map[string]captchaFileEntry)
+	captchaStore.Range(func(k, v any) bool {
+		entry := v.(captchaEntry)
+		m[k.(string)] = captchaFileEntry{
+			AnswerHash: base64.StdEncoding.EncodeToString(entry.answerHash),
+			ExpiresAt:  entry.expiresAt,
+		}
+		return true
+	})
+	unlock, err := lockFile(captchaStoreFile())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return writeJSON(captchaStoreFile(), m)
+}
+
+func captchaStoreFile() string {
+	return filepath.Join(dataDir, "captcha_store.json")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// newMemoryStore returns a Store that lives only in process memory. It is
+// used by unit tests in place of the JSON files.
+func newMemoryStore() *Store {
+	return &Store{
+		Users:          userRepository{&memoryCollection[User]{key: userID}},
+		Registrations:  &memoryCollection[Registration]{key: registrationID},
+		Invites:        &memoryCollection[Invite]{key: inviteToken},
+		TeamSpeakUsers: &memoryCollection[TeamSpeakUser]{key: teamSpeakUserID},
+		Sessions:       &memoryCollection[Session]{key: sessionID},
+		Audit:          &memoryAuditLog{},
+		Captchas:       &memoryCaptchas{entries: map[string]captchaEntry{}},
+	}
+}
+
+// memoryCollection round-trips records through JSON on the way in and out,
+// so callers see exactly the fields the file backend would persist and can
+// never alias stored values.
+type memoryCollection[T any] struct {
+	mu   sync.Mutex
+	key  func(*T) string
+	data []byte
+}
+
+func (c *memoryCollection[T]) load() ([]T, error) {
+	list := []T{}
+	if c.data == nil {
+		return list, nil
+	}
+	if err := json.Unmarshal(c.data, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (c *memoryCollection[T]) List() ([]T, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.load()
+}
+
+func (c *memoryCollection[T]) Get(id string) (T, error) {
+	var zero T
+	list, err := c.List()
+	if err != nil {
+		return zero, err
+	}
+	for i := range list {
+		if c.key(&list[i]) == id {
+			return list[i], nil
+		}
+	}
+	return zero, errNotFound
+}
+
+func (c *memoryCollection[T]) Create(item T) error {
+	return c.Mutate(func(list []T) ([]T, error) {
+		id := c.key(&item)
+		for i := range list {
+			if c.key(&list[i]) == id {
+				return nil, errConflict
+			}
+		}
+		return append(list, item), nil
+	})
+}
+
+func (c *memoryCollection[T]) Update(id string, fn func(*T) error) (T, error) {
+	var updated T
+	err := c.Mutate(func(list []T) ([]T, error) {
+		for i := range list {
+			if c.key(&list[i]) == id {
+				if err := fn(&list[i]); err != nil {
+					return nil, err
+				}
+				updated = list[i]
+				return list, nil
+			}
+		}
+		return nil, errNotFound
+	})
+	return updated, err
+}
+
+func (c *memoryCollection[T]) Delete(id string) error {
+	return c.Mutate(func(list []T) ([]T, error) {
+		for i := range list {
+			if c.key(&list[i]) == id {
+				return append(list[:i], list[i+1:]...), nil
+			}
+		}
+		return nil, errNotFound
+	})
+}
+
+func (c *memoryCollection[T]) Mutate(fn func([]T) ([]T, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list, err := c.load()
+	if err != nil {
+		return err
+	}
+	if list, err = fn(list); err != nil {
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
+	}
+	if list == nil {
+		list = []T{}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	c.data = data
+	return nil
+}
+
+type memoryCaptchas struct {
+	mu      sync.Mutex
+	entries map[string]captchaEntry
+}
+
+func (m *memoryCaptchas) Put(id string, entry captchaEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[id] = entry
+	return nil
+}
+
+func (m *memoryCaptchas) Take(id string) (captchaEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.entries[id]
+	if !ok {
+		return captchaEntry{}, errNotFound
+	}
+	delete(m.entries, id)
+	return entry, nil
+}
+
+func (m *memoryCaptchas) DeleteExpired(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for id, entry := range m.entries {
+		if now.After(entry.expiresAt) {
+			delete(m.entries, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+type memoryAuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+func (m *memoryAuditLog) Append(entry AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.ID = int64(len(m.entries)) + 1
+	m.entries = append(m.entries, entry)
+	return nil
+}
+
+func (m *memoryAuditLog) List(limit int) ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return newestFirst(m.entries, limit), nil
+}
+
+func (m *memoryAuditLog) RenameActor(names []string, to string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	renamed := 0
+	for i := range m.entries {
+		if actorIn(m.entries[i].Actor, names) {
+			m.entries[i].Actor = to
+			renamed++
+		}
+	}
+	return renamed, nil
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqlMigration is one step of the SQLite schema. Steps run in version
+// order and are recorded in schema_migrations; a released step is never
+// edited, a new one is appended instead.
+type sqlMigration struct {
+	version int
+	name    string
+	stmts   string
+}
+
+// Entities are stored as their JSON encoding in data, next to the columns
+// that need an index. seq keeps insertion order, which List preserves.
+var sqliteMigrations = []sqlMigration{
+	{1, "initial schema", `
+CREATE TABLE users (
+	seq      INTEGER PRIMARY KEY AUTOINCREMENT,
+	id       TEXT NOT NULL UNIQUE,
+	email    TEXT NOT NULL DEFAULT '',
+	username TEXT NOT NULL DEFAULT '',
+	data     TEXT NOT NULL
+);
+CREATE INDEX users_email ON users (email);
+CREATE INDEX users_username ON users (username);
+
+CREATE TABLE registrations (
+	seq      INTEGER PRIMARY KEY AUTOINCREMENT,
+	id       TEXT NOT NULL UNIQUE,
+	email    TEXT NOT NULL DEFAULT '',
+	username TEXT NOT NULL DEFAULT '',
+	data     TEXT NOT NULL
+);
+CREATE INDEX registrations_email ON registrations (email);
+CREATE INDEX registrations_username ON registrations (username);
+
+CREATE TABLE invites (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	id         TEXT NOT NULL UNIQUE,
+	created_by TEXT NOT NULL DEFAULT '',
+	data       TEXT NOT NULL
+);
+CREATE INDEX invites_created_by ON invites (created_by);
+
+CREATE TABLE teamspeak_users (
+	seq      INTEGER PRIMARY KEY AUTOINCREMENT,
+	id       TEXT NOT NULL UNIQUE,
+	username TEXT NOT NULL DEFAULT '',
+	data     TEXT NOT NULL
+);
+CREATE INDEX teamspeak_users_username ON teamspeak_users (username);
+
+CREATE TABLE sessions (
+	seq     INTEGER PRIMARY KEY AUTOINCREMENT,
+	id      TEXT NOT NULL UNIQUE,
+	user_id TEXT NOT NULL DEFAULT '',
+	data    TEXT NOT NULL
+);
+CREATE INDEX sessions_user_id ON sessions (user_id);
+
+CREATE TABLE meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+`},
+	{2, "audit log", `
+CREATE TABLE audit_log (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	at     TEXT NOT NULL,
+	actor  TEXT NOT NULL DEFAULT '',
+	action TEXT NOT NULL,
+	target TEXT NOT NULL DEFAULT '',
+	detail TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_log_target ON audit_log (target);
+`},
+}
+
+// openSQLite opens path with a busy timeout and WAL journal, so several
+// processes can share the database, and brings its schema up to date.
+func openSQLite(path string) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrateSQLite(db, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// migrateSQLite applies every migration newer than the database, each in
+// its own transaction, and returns how many ran. A database written by a
+// newer binary is refused rather than guessed at.
+func migrateSQLite(db *sql.DB, migrations []sqlMigration) (int, error) {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL,
+	applied_at TEXT NOT NULL
+)`); err != nil {
+		return 0, err
+	}
+	current, err := sqliteSchemaVersion(db)
+	if err != nil {
+		return 0, err
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return 0, fmt.Errorf("sqlite schema version %d is newer than this build supports (%d)", current, latest)
+	}
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		ran, err := applyMigration(db, m)
+		if err != nil {
+			return applied, fmt.Errorf("sqlite migration %d (%s): %w", m.version, m.name, err)
+		}
+		if ran {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// applyMigration runs m unless another process got there first.
+func applyMigration(db *sql.DB, m sqlMigration) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var done int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.version).Scan(&done); err != nil {
+		return false, err
+	}
+	if done > 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec(m.stmts); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+		m.version, m.name, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func sqliteSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// newSQLiteStore keeps every entity in the SQLite database at path.
+// Captchas are short-lived and stay in captcha_store.json.
+func newSQLiteStore(path string) (*Store, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	users := &sqlCollection[User]{db: db, lockPath: path, table: "users", key: userID,
+		columns: []string{"email", "username"},
+		values:  func(u *User) []any { return []any{strings.ToLower(u.Email), strings.ToLower(u.Username)} },
+	}
+	s := &Store{
+		Users: sqlUsers{users},
+		Registrations: &sqlCollection[Registration]{db: db, lockPath: path, table: "registrations", key: registrationID,
+			columns: []string{"email", "username"},
+			values: func(r *Registration) []any {
+				return []any{strings.ToLower(r.Email), strings.ToLower(r.Username)}
+			},
+		},
+		Invites: &sqlCollection[Invite]{db: db, lockPath: path, table: "invites", key: inviteToken,
+			columns: []string{"created_by"},
+			values:  func(i *Invite) []any { return []any{i.CreatedBy} },
+		},
+		TeamSpeakUsers: &sqlCollection[TeamSpeakUser]{db: db, lockPath: path, table: "teamspeak_users", key: teamSpeakUserID,
+			columns: []string{"username"},
+			values:  func(u *TeamSpeakUser) []any { return []any{strings.ToLower(u.Username)} },
+		},
+		Sessions: &sqlCollection[Session]{db: db, lockPath: path, table: "sessions", key: sessionID,
+			columns: []string{"user_id"},
+			values:  func(s *Session) []any { return []any{s.UserID} },
+		},
+		Audit:    sqlAuditLog{db},
+		Captchas: jsonCaptchaRepository{},
+		close:    db.Close,
+		snapshotTo: func(dst string) error {
+			_, err := db.Exec(`VACUUM INTO ?`, dst)
+			return err
+		},
+		restoreFrom: func(src string) error { return restoreSQLite(db, src) },
+	}
+	if err := importJSONOnce(db, s); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// sqlCollection stores T as one row per record. Writes hold a per-table
+// file lock from read to write, like jsonCollection, while callbacks run
+// outside any transaction so they may write to other collections.
+type sqlCollection[T any] struct {
+	db       *sql.DB
+	lockPath string
+	table    string
+	key      func(*T) string
+	// columns are the indexed columns besides id; values extracts them.
+	columns []string
+	values  func(*T) []any
+}
+
+func (c *sqlCollection[T]) lock() (func(), error) {
+	return lockFile(c.lockPath + "." + c.table)
+}
+
+func (c *sqlCollection[T]) List() ([]T, error) {
+	rows, err := c.db.Query(`SELECT data FROM ` + c.table + ` ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []T{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var item T
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.table, err)
+		}
+		list = append(list, item)
+	}
+	return list, rows.Err()
+}
+
+func (c *sqlCollection[T]) Get(id string) (T, error) {
+	return c.getWhere(`id = ?`, id)
+}
+
+// getWhere returns the first record, in insertion order, matching cond.
+func (c *sqlCollection[T]) getWhere(cond string, args ...any) (T, error) {
+	var item T
+	var data string
+	err := c.db.QueryRow(`SELECT data FROM `+c.table+` WHERE `+cond+` ORDER BY seq LIMIT 1`, args...).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return item, errNotFound
+	}
+	if err != nil {
+		return item, err
+	}
+	return item, json.Unmarshal([]byte(data), &item)
+}
+
+func (c *sqlCollection[T]) Create(item T) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.insert(c.db, &item)
+}
+
+func (c *sqlCollection[T]) Update(id string, fn func(*T) error) (T, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer unlock()
+	item, err := c.Get(id)
+	if err != nil {
+		return item, err
+	}
+	if err := fn(&item); err != nil {
+		var zero T
+		return zero, err
+	}
+	if c.key(&item) != id {
+		// The key changed: replace the row rather than orphan it.
+		tx, err := c.db.Begin()
+		if err != nil {
+			return item, err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`DELETE FROM `+c.table+` WHERE id = ?`, id); err != nil {
+			return item, err
+		}
+		if err := c.insert(tx, &item); err != nil {
+			return item, err
+		}
+		return item, tx.Commit()
+	}
+	_, err = c.update(c.db, &item)
+	return item, err
+}
+
+func (c *sqlCollection[T]) Delete(id string) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	res, err := c.db.Exec(`DELETE FROM `+c.table+` WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// Mutate diffs fn's result against what it read and writes only the rows
+// that changed, in one transaction. New records go to the end; reordering
+// existing records is not persisted.
+func (c *sqlCollection[T]) Mutate(fn func([]T) ([]T, error)) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	list, err := c.List()
+	if err != nil {
+		return err
+	}
+	before := make(map[string][]byte, len(list))
+	for i := range list {
+		data, err := json.Marshal(&list[i])
+		if err != nil {
+			return err
+		}
+		before[c.key(&list[i])] = data
+	}
+	list, err = fn(list)
+	if err != nil {
+		if errors.Is(err, errUnchanged) {
+			return nil
+		}
+		return err
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	seen := make(map[string]bool, len(list))
+	for i := range list {
+		id := c.key(&list[i])
+		if seen[id] {
+			return errConflict
+		}
+		seen[id] = true
+		old, existed := before[id]
+		if !existed {
+			if err := c.insert(tx, &list[i]); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := json.Marshal(&list[i])
+		if err != nil {
+			return err
+		}
+		if string(data) != string(old) {
+			if _, err := c.update(tx, &list[i]); err != nil {
+				return err
+			}
+		}
+	}
+	for id := range before {
+		if !seen[id] {
+			if _, err := tx.Exec(`DELETE FROM `+c.table+` WHERE id = ?`, id); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func (c *sqlCollection[T]) insert(db sqlExecer, item *T) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	cols := append([]string{"id"}, c.columns...)
+	cols = append(cols, "data")
+	args := append([]any{c.key(item)}, c.values(item)...)
+	args = append(args, string(data))
+	marks := strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")
+	_, err = db.Exec(`INSERT INTO `+c.table+` (`+strings.Join(cols, ", ")+`) VALUES (`+marks+`)`, args...)
+	if isUniqueViolation(err) {
+		return errConflict
+	}
+	return err
+}
+
+func (c *sqlCollection[T]) update(db sqlExecer, item *T) (int64, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return 0, err
+	}
+	set := make([]string, 0, len(c.columns)+1)
+	for _, col := range c.columns {
+		set = append(set, col+" = ?")
+	}
+	set = append(set, "data = ?")
+	args := append(c.values(item), string(data), c.key(item))
+	res, err := db.Exec(`UPDATE `+c.table+` SET `+strings.Join(set, ", ")+` WHERE id = ?`, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// sqlUsers answers email lookups from the users_email index.
+type sqlUsers struct {
+	*sqlCollection[User]
+}
+
+func (r sqlUsers) FindByEmail(email string) (User, error) {
+	return r.getWhere(`email = ?`, strings.ToLower(email))
+}
+
+func (r sqlUsers) FindByUsername(username string) (User, error) {
+	if username == "" {
+		return User{}, errNotFound
+	}
+	return r.getWhere(`username = ?`, strings.ToLower(username))
+}
+
+type sqlAuditLog struct {
+	db *sql.DB
+}
+
+func (l sqlAuditLog) Append(entry AuditEntry) error {
+	_, err := l.db.Exec(`INSERT INTO audit_log (at, actor, action, target, detail) VALUES (?, ?, ?, ?, ?)`,
+		entry.At.UTC().Format(time.RFC3339Nano), entry.Actor, entry.Action, entry.Target, entry.Detail)
+	return err
+}
+
+func (l sqlAuditLog) List(limit int) ([]AuditEntry, error) {
+	query := `SELECT id, at, actor, action, target, detail FROM audit_log ORDER BY id DESC`
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := l.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var at string
+		if err := rows.Scan(&e.ID, &at, &e.Actor, &e.Action, &e.Target, &e.Detail); err != nil {
+			return nil, err
+		}
+		e.At, _ = time.Parse(time.RFC3339Nano, at)
+		out = append(out, e)
+	}
+	return out, rows.Err()
+}
+
+func (l sqlAuditLog) RenameActor(names []string, to string) (int, error) {
+	renamed := 0
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		res, err := l.db.Exec(`UPDATE audit_log SET actor = ? WHERE lower(actor) = lower(?)`, to, name)
+		if err != nil {
+			return renamed, err
+		}
+		count, _ := res.RowsAffected()
+		renamed += int(count)
+	}
+	return renamed, nil
+}
+
+// sqliteRestoreTables are replaced by a restore. The audit log is kept so
+// the restore itself stays on record.
+var sqliteRestoreTables = []string{"users", "registrations", "invites", "teamspeak_users", "sessions", "meta"}
+
+// restoreSQLite replaces the live tables with those of the database file at
+// src in one transaction. Both must be at the same schema version.
+func restoreSQLite(db *sql.DB, src string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS snap`, src); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE snap`)
+	var theirs, ours int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM snap.schema_migrations`).Scan(&theirs); err != nil {
+		return err
+	}
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM main.schema_migrations`).Scan(&ours); err != nil {
+		return err
+	}
+	if theirs != ours {
+		return fmt.Errorf("snapshot database is at schema version %d, live database at %d", theirs, ours)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range sqliteRestoreTables {
+		if _, err := tx.Exec(`DELETE FROM main.` + table); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO main.` + table + ` SELECT * FROM snap.` + table); err != nil {
+			return fmt.Errorf("restore %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSQLiteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coreapi.db")
+	db, err := openSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	latest := sqliteMigrations[len(sqliteMigrations)-1].version
+	if v, err := sqliteSchemaVersion(db); err != nil || v != latest {
+		t.Fatalf("schema version %d (%v), want %d", v, err, latest)
+	}
+	if n, err := migrateSQLite(db, sqliteMigrations); err != nil || n != 0 {
+		t.Fatalf("second run applied %d (%v)", n, err)
+	}
+
+	var plan string
+	if err := db.QueryRow(`EXPLAIN QUERY PLAN SELECT data FROM users WHERE email = ?`, "a").Scan(new(int), new(int), new(int), &plan); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(plan, "users_email") {
+		t.Fatalf("email lookup does not use the index: %s", plan)
+	}
+
+	next := append(sqliteMigrations, sqlMigration{latest + 1, "extra", `CREATE TABLE extra (id TEXT);`})
+	if n, err := migrateSQLite(db, next); err != nil || n != 1 {
+		t.Fatalf("new migration applied %d (%v)", n, err)
+	}
+	if _, err := migrateSQLite(db, sqliteMigrations); err == nil {
+		t.Fatal("older build accepted a newer schema")
+	}
+
+	broken := append(next, sqlMigration{latest + 2, "broken", `CREATE TABLE extra (id TEXT);`})
+	if _, err := migrateSQLite(db, broken); err == nil {
+		t.Fatal("failing migration reported success")
+	}
+	if v, _ := sqliteSchemaVersion(db); v != latest+1 {
+		t.Fatalf("failed migration recorded: version %d", v)
+	}
+}
+
+func TestSQLiteImportsJSONOnce(t *testing.T) {
+	dataDir = t.TempDir()
+	now := time.Now().UTC()
+	_ = writeJSON(filepath.Join(dataDir, "users.json"), []User{
+		{ID: "u1", Email: "Ada@Example.org", Username: "ada", Status: "active"},
+		{ID: "u2", Email: "bob@example.org", Username: "bob", Status: "active"},
+	})
+	_ = writeJSON(filepath.Join(dataDir, "pending.json"), []Registration{{ID: "r1", Email: "c@example.org"}})
+	_ = writeJSON(filepath.Join(dataDir, "invites.json"), []Invite{{Token: "t1", CreatedBy: "u1", ExpiresAt: now.Add(time.Hour)}})
+	_ = writeJSON(filepath.Join(dataDir, "sessions.json"), []Session{{ID: "s1", UserID: "u1", ExpiresAt: now.Add(time.Hour)}})
+	_ = writeJSON(filepath.Join(dataDir, "audit.json"), []AuditEntry{{ID: 1, Action: "old"}, {ID: 2, Action: "newer"}})
+
+	path := filepath.Join(dataDir, "coreapi.db")
+	s, err := newSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ := s.Users.List()
+	if len(users) != 2 || users[0].ID != "u1" {
+		t.Fatalf("users: %+v", users)
+	}
+	if u, err := s.Users.FindByEmail("ada@example.org"); err != nil || u.ID != "u1" {
+		t.Fatalf("find by email: %+v %v", u, err)
+	}
+	if _, err := s.Invites.Get("t1"); err != nil {
+		t.Fatalf("invite: %v", err)
+	}
+	if live, err := s.Sessions.Get("s1"); err != nil || live.UserID != "u1" {
+		t.Fatalf("session: %+v %v", live, err)
+	}
+	if entries, _ := s.Audit.List(0); len(entries) != 2 || entries[0].Action != "newer" {
+		t.Fatalf("audit: %+v", entries)
+	}
+	_ = s.Users.Delete("u2")
+	s.Close()
+
+	// Reopening must not import the JSON files a second time.
+	s, err = newSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if users, _ := s.Users.List(); len(users) != 1 {
+		t.Fatalf("reimported: %+v", users)
+	}
+}
+
+func TestOpenStoreBackend(t *testing.T) {
+	dataDir = t.TempDir()
+	t.Setenv("STORAGE_BACKEND", "sqlite")
+	s, err := openStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.Users.(sqlUsers); !ok {
+		t.Fatalf("got %T", s.Users)
+	}
+	db, _ := sql.Open("sqlite", filepath.Join(dataDir, "coreapi.db"))
+	defer db.Close()
+	if v, err := sqliteSchemaVersion(db); err != nil || v == 0 {
+		t.Fatalf("database not created in DATA_DIR: %d %v", v, err)
+	}
+
+	t.Setenv("STORAGE_BACKEND", "postgres")
+	if _, err := openStore(); err == nil {
+		t.Fatal("unknown backend accepted")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestRepositoryContract runs the same checks against every backend.
+func TestRepositoryContract(t *testing.T) {
+	backends := map[string]func(t *testing.T) *Store{
+		"json":   func(*testing.T) *Store { return newJSONStore() },
+		"memory": func(*testing.T) *Store { return newMemoryStore() },
+		"cached": func(t *testing.T) *Store {
+			s := newJSONStore()
+			cacheJSONStore(s)
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+		"sqlite": func(t *testing.T) *Store {
+			s, err := newSQLiteStore(filepath.Join(dataDir, "coreapi.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			dataDir = t.TempDir()
+			s := open(t)
+
+			users, err := s.Users.List()
+			if err != nil || users == nil || len(users) != 0 {
+				t.Fatalf("empty list: %v %v", users, err)
+			}
+			u := User{ID: "u1", Email: "Ada@Example.org", Status: "active", VPNConfig: &VPNConfig{IPAddress: "10.0.0.2"}}
+			if err := s.Users.Create(u); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Users.Create(u); !errors.Is(err, errConflict) {
+				t.Fatalf("duplicate create: %v", err)
+			}
+			got, err := s.Users.FindByEmail("ada@example.org")
+			if err != nil || got.ID != "u1" {
+				t.Fatalf("find by email: %+v %v", got, err)
+			}
+			if got, err := s.Users.FindByUsername(""); !errors.Is(err, errNotFound) {
+				t.Fatalf("find by empty username: %+v %v", got, err)
+			}
+			got.VPNConfig.IPAddress = "changed"
+			if again, _ := s.Users.Get("u1"); again.VPNConfig.IPAddress != "10.0.0.2" {
+				t.Fatal("returned value aliases stored record")
+			}
+
+			updated, err := s.Users.Update("u1", func(u *User) error {
+				u.Status = "suspended"
+				return nil
+			})
+			if err != nil || updated.Status != "suspended" {
+				t.Fatalf("update: %+v %v", updated, err)
+			}
+			boom := errors.New("boom")
+			if _, err := s.Users.Update("u1", func(u *User) error {
+				u.Status = "lost"
+				return boom
+			}); !errors.Is(err, boom) {
+				t.Fatalf("update error not returned: %v", err)
+			}
+			if again, _ := s.Users.Get("u1"); again.Status != "suspended" {
+				t.Fatalf("failed update was saved: %+v", again)
+			}
+			if _, err := s.Users.Update("nope", func(*User) error { return nil }); !errors.Is(err, errNotFound) {
+				t.Fatalf("update missing: %v", err)
+			}
+
+			if err := s.Invites.Create(Invite{Token: "t1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			if inv, err := s.Invites.Get("t1"); err != nil || inv.Token != "t1" {
+				t.Fatalf("invite keyed by token: %+v %v", inv, err)
+			}
+			if err := s.Users.Delete("u1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Users.Delete("u1"); !errors.Is(err, errNotFound) {
+				t.Fatalf("double delete: %v", err)
+			}
+
+			if err := s.Captchas.Put("c1", captchaEntry{answerHash: []byte{1}, expiresAt: time.Now().Add(-time.Second)}); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := s.Captchas.DeleteExpired(time.Now()); err != nil || n != 1 {
+				t.Fatalf("expired captchas: %d %v", n, err)
+			}
+			if _, err := s.Captchas.Take("c1"); !errors.Is(err, errNotFound) {
+				t.Fatalf("captcha survived cleanup: %v", err)
+			}
+
+			for _, id := range []string{"s1", "s2", "s3"} {
+				if err := s.Sessions.Create(Session{ID: id, UserID: "u2"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = s.Sessions.Mutate(func(list []Session) ([]Session, error) {
+				return append(list[:1], list[2:]...), nil
+			})
+			if list, _ := s.Sessions.List(); err != nil || len(list) != 2 || list[0].ID != "s1" || list[1].ID != "s3" {
+				t.Fatalf("mutate sessions: %+v %v", list, err)
+			}
+
+			for _, action := range []string{"first", "second", "third"} {
+				if err := s.Audit.Append(AuditEntry{At: time.Now(), Actor: "Ada", Action: action}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			entries, err := s.Audit.List(2)
+			if err != nil || len(entries) != 2 || entries[0].Action != "third" || entries[0].ID <= entries[1].ID {
+				t.Fatalf("audit newest first: %+v %v", entries, err)
+			}
+			if n, err := s.Audit.RenameActor([]string{"ada", ""}, "erased:u1"); err != nil || n != 3 {
+				t.Fatalf("rename actor: %d %v", n, err)
+			}
+			if entries, _ := s.Audit.List(0); entries[2].Actor != "erased:u1" {
+				t.Fatalf("audit after rename: %+v", entries)
+			}
+		})
+	}
+}
+
+// TestHandlersOnMemoryStore drives the user handlers without touching disk.
+func TestHandlersOnMemoryStore(t *testing.T) {
+	prev := store
+	store = newMemoryStore()
+	defer func() { store = prev }()
+	dataDir = t.TempDir()
+	_ = store.Users.Create(User{ID: "u1", Email: "a@example.org", Username: "a", Status: "active"})
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: "active"})
+	admin := tokenFor(t, "a1")
+
+	app := fiber.New()
+	app.Get("/users", handleUsersList)
+	app.Put("/users/:id", handleUserUpdate)
+	app.Post("/users/:id/vpn/disable", handleVPNDisable)
+
+	req := httptest.NewRequest("PUT", "/users/u1", strings.NewReader(`{"username":"alice","email":"a@example.org"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+admin)
+	if resp, _ := app.Test(req); resp.StatusCode != 200 {
+		t.Fatalf("update: %d", resp.StatusCode)
+	}
+	resp, _ := app.Test(httptest.NewRequest("GET", "/users", nil))
+	var page listPage[User]
+	_ = json.NewDecoder(resp.Body).Decode(&page)
+	if page.Total != 2 || !slices.ContainsFunc(page.Items, func(u User) bool { return u.Username == "alice" }) {
+		t.Fatalf("list: %+v", page)
+	}
+	if resp, _ := app.Test(httptest.NewRequest("POST", "/users/u1/vpn/disable", nil)); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("disable without VPN config: %d", resp.StatusCode)
+	}
+	req = httptest.NewRequest("PUT", "/users/ghost", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+admin)
+	if resp, _ := app.Test(req); resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("update missing user: %d", resp.StatusCode)
+	}
+}
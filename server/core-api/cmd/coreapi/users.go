@@ -0,0 +1,158 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// minPasswordLength applies to passwords set by an admin or during setup.
+const minPasswordLength = 8
+
+// newUser is the body of POST /api/users and POST /api/setup.
+type newUser struct {
+	Email       string   `json:"email"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"` // generated and returned once when empty
+	Role        string   `json:"role"`
+	Status      string   `json:"status"`
+	Permissions []string `json:"permissions"`
+	SendWelcome bool     `json:"send_welcome"`
+}
+
+// validate normalises req and fills in the defaults.
+func (req *newUser) validate() error {
+	req.Email = strings.TrimSpace(req.Email)
+	req.Username = strings.TrimSpace(req.Username)
+	if !strings.Contains(req.Email, "@") {
+		return fiber.NewError(fiber.StatusBadRequest, "valid email required")
+	}
+	if req.Password != "" && len(req.Password) < minPasswordLength {
+		return fiber.NewError(fiber.StatusBadRequest, "password too short")
+	}
+	req.Role = firstNonEmpty(req.Role, "user")
+	if err := validRole(req.Role); err != nil {
+		return err
+	}
+	for _, p := range req.Permissions {
+		if !knownPermission(p) {
+			return fiber.NewError(fiber.StatusBadRequest, "unknown permission "+p)
+		}
+	}
+	switch req.Status {
+	case "":
+		req.Status = statusActive
+	case statusPending, statusActive, statusSuspended:
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "unknown status "+req.Status)
+	}
+	return nil
+}
+
+// checkUnique fails with 409 when user's email or username is already
+// taken in users.
+func checkUnique(users []User, user User) error {
+	for _, u := range users {
+		if strings.EqualFold(u.Email, user.Email) {
+			return fiber.NewError(fiber.StatusConflict, "email already in use")
+		}
+		if user.Username != "" && strings.EqualFold(u.Username, user.Username) {
+			return fiber.NewError(fiber.StatusConflict, "username already in use")
+		}
+	}
+	return nil
+}
+
+// createUser stores the user described by req. The email and username must
+// be unused; check may refuse based on the users already stored, in the
+// same locked update. It returns the user and the password in clear, which
+// was generated if req had none.
+func createUser(req newUser, check func([]User) error) (User, string, error) {
+	if err := req.validate(); err != nil {
+		return User{}, "", err
+	}
+	password := req.Password
+	if password == "" {
+		generated, err := randomToken(12)
+		if err != nil {
+			return User{}, "", err
+		}
+		password = generated
+	}
+	now := time.Now().UTC()
+	user := User{
+		ID:          generateID(),
+		Email:       req.Email,
+		Username:    req.Username,
+		Password:    hashPassword(password),
+		Role:        req.Role,
+		Status:      req.Status,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Permissions: req.Permissions,
+	}
+	err := store.Users.Mutate(func(users []User) ([]User, error) {
+		if err := checkUnique(users, user); err != nil {
+			return nil, err
+		}
+		// Checked again under the users lock, which a role delete holds.
+		if err := validRole(user.Role); err != nil {
+			return nil, err
+		}
+		if check != nil {
+			if err := check(users); err != nil {
+				return nil, err
+			}
+		}
+		return append(users, user), nil
+	})
+	return user, password, err
+}
+
+// notifyWelcome tells a user created by an admin that the account exists.
+// The password is never mailed; the admin hands it over.
+func notifyWelcome(user User) {
+	body := "A Safe-Spac account has been created for you. Sign in as " + firstNonEmpty(user.Username, user.Email) +
+		" with the password your administrator gives you."
+	if publicBaseURL != "" {
+		body += "\n\nSign in here: " + publicBaseURL + "/login"
+	}
+	notify(user.Email, "Your Safe-Spac account", body)
+}
+
+// hidePassword clears the password hash, which no response includes,
+// whether or not secrets are revealed.
+func hidePassword(u *User) {
+	u.Password = ""
+}
+
+// handleUserCreate is the admin-side account creation; first-run setup
+// goes through handleSetup instead.
+func handleUserCreate(c *fiber.Ctx) error {
+	if _, err := requirePermission(c, permUsersManage); err != nil {
+		return err
+	}
+	var req newUser
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid json")
+	}
+	if err := checkGrant(c, req.Role, req.Permissions); err != nil {
+		return err
+	}
+	generated := req.Password == ""
+	user, password, err := createUser(req, nil)
+	if err != nil {
+		return storeError(err, "user not found")
+	}
+	recordAudit(c, "user.create", user.ID, user.Role)
+	if req.SendWelcome {
+		notifyWelcome(user)
+	}
+	hidePassword(&user)
+	resp := fiber.Map{"ok": true, "user": user}
+	if generated {
+		resp["password"] = password
+	}
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// testApp mounts the API routes, with their guards, under /api.
+func testApp() *fiber.App {
+	app := fiber.New()
+	routes(app.Group("/api"))
+	return app
+}
+
+// send makes a JSON request to app, as the holder of token unless it is
+// empty, and returns the status code and the reply decoded as an object.
+func send(t *testing.T, app *fiber.App, method, path, token, body string) (int, map[string]any) {
+	t.Helper()
+	var out map[string]any
+	code := sendFor(t, app, method, path, token, body, &out)
+	return code, out
+}
+
+// sendFor is send for replies that are not objects: the reply is decoded
+// into out.
+func sendFor(t *testing.T, app *fiber.App, method, path, token, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = json.NewDecoder(resp.Body).Decode(out)
+	return resp.StatusCode
+}
+
+// tokenFor signs in the stored user with id.
+func tokenFor(t *testing.T, id string) string {
+	t.Helper()
+	u, err := store.Users.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := generateJWT(&u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestUserCreateAndLogin(t *testing.T) {
+	dataDir = t.TempDir()
+	rec := &recordingNotifier{}
+	notifier = rec
+	defer func() { notifier = logNotifier{} }()
+	app := testApp()
+
+	// A fresh install has no users.json; that is a failed login, not a 500.
+	if code, _ := send(t, app, "POST", "/api/auth/login", "", `{"email":"ada@example.org","password":"correct horse"}`); code != fiber.StatusUnauthorized {
+		t.Fatalf("login on empty data dir: %d", code)
+	}
+	_ = store.Users.Create(User{ID: "a1", Email: "admin@example.org", Role: "admin", Status: statusActive})
+	_ = store.Users.Create(User{ID: "u1", Email: "member@example.org", Role: "user", Status: statusActive})
+	admin := tokenFor(t, "a1")
+
+	// The handler checks the caller itself, not only the route guard.
+	bare := fiber.New()
+	bare.Post("/users", handleUserCreate)
+	for token, want := range map[string]int{"": fiber.StatusUnauthorized, tokenFor(t, "u1"): fiber.StatusForbidden} {
+		if code, _ := send(t, bare, "POST", "/users", token, `{"email":"eve@example.org","role":"admin"}`); code != want {
+			t.Fatalf("create as %q: %d, want %d", token, code, want)
+		}
+	}
+	code, out := send(t, app, "POST", "/api/users", admin, `{"email":"ada@example.org","username":"ada","password":"correct horse","send_welcome":true}`)
+	if user, _ := out["user"].(map[string]any); code != fiber.StatusCreated || user == nil || user["password"] != nil || out["password"] != nil {
+		t.Fatalf("create: %d %v", code, out)
+	}
+	if len(rec.sent) != 1 || !strings.HasPrefix(rec.sent[0], "ada@example.org|") || strings.Contains(rec.sent[0], "correct horse") {
+		t.Fatalf("welcome email: %q", rec.sent)
+	}
+
+	// The hash is persisted, so the password works, but never returned.
+	code, out = send(t, app, "POST", "/api/auth/login", "", `{"email":"ada@example.org","password":"correct horse"}`)
+	if user, _ := out["user"].(map[string]any); code != 200 || user == nil || user["password"] != nil {
+		t.Fatalf("login: %d %v", code, out)
+	}
+	if code, _ := send(t, app, "POST", "/api/auth/login", "", `{"email":"ada@example.org","password":"wrong"}`); code != fiber.StatusUnauthorized {
+		t.Fatalf("wrong password: %d", code)
+	}
+
+	for _, body := range []string{
+		`{"email":"ADA@example.org","password":"another one"}`,
+		`{"email":"bob@example.org","username":"Ada","password":"another one"}`,
+	} {
+		if code, _ := send(t, app, "POST", "/api/users", admin, body); code != fiber.StatusConflict {
+			t.Fatalf("duplicate %s: %d", body, code)
+		}
+	}
+	for _, body := range []string{`{"email":"nobody"}`, `{"email":"b@example.org","password":"short"}`, `{"email":"b@example.org","role":"root"}`} {
+		if code, _ := send(t, app, "POST", "/api/users", admin, body); code != fiber.StatusBadRequest {
+			t.Fatalf("invalid %s: %d", body, code)
+		}
+	}
+
+	// Without a password one is generated and returned once.
+	code, out = send(t, app, "POST", "/api/users", admin, `{"email":"bob@example.org","role":"admin"}`)
+	password, _ := out["password"].(string)
+	if code != fiber.StatusCreated || password == "" || len(rec.sent) != 1 {
+		t.Fatalf("generated password: %d %v", code, out)
+	}
+	if code, _ := send(t, app, "POST", "/api/auth/login", "", `{"email":"bob@example.org","password":"`+password+`"}`); code != 200 {
+		t.Fatalf("login with generated password: %d", code)
+	}
+}
+
+func TestSetupToken(t *testing.T) {
+	dataDir = t.TempDir()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	if err := bootstrapAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	m := regexp.MustCompile(`setup token: (\S+)`).FindStringSubmatch(logged.String())
+	if m == nil {
+		t.Fatalf("no setup token logged: %s", logged.String())
+	}
+	token := m[1]
+	app := testApp()
+
+	var status map[string]bool
+	sendFor(t, app, "GET", "/api/setup", "", "", &status)
+	if !status["required"] {
+		t.Fatalf("setup not required on a fresh install")
+	}
+	if code, _ := send(t, app, "POST", "/api/setup", "", `{"token":"guess","email":"root@example.org","password":"correct horse"}`); code != fiber.StatusForbidden {
+		t.Fatalf("wrong token: %d", code)
+	}
+	code, out := send(t, app, "POST", "/api/setup", "", `{"token":"`+token+`","email":"root@example.org","username":"root","password":"correct horse"}`)
+	if user, _ := out["user"].(map[string]any); code != fiber.StatusCreated || user == nil || user["role"] != "admin" {
+		t.Fatalf("setup: %d %v", code, out)
+	}
+	if code, _ := send(t, app, "POST", "/api/setup", "", `{"token":"`+token+`","email":"evil@example.org","password":"correct horse"}`); code != fiber.StatusGone {
+		t.Fatalf("token reused: %d", code)
+	}
+	if _, err := os.Stat(setupTokenFile()); !os.IsNotExist(err) {
+		t.Fatalf("token file left behind: %v", err)
+	}
+	if code, _ := send(t, app, "POST", "/api/auth/login", "", `{"email":"root@example.org","password":"correct horse"}`); code != 200 {
+		t.Fatalf("admin login: %d", code)
+	}
+
+	// With an admin in place, a restart issues no new token.
+	logged.Reset()
+	if err := bootstrapAdmin(); err != nil || strings.Contains(logged.String(), "setup token") {
+		t.Fatalf("bootstrap with an admin: %v %s", err, logged.String())
+	}
+}
+
+func TestBootstrapAdminFromEnv(t *testing.T) {
+	dataDir = t.TempDir()
+	pwFile := filepath.Join(t.TempDir(), "admin-password")
+	if err := os.WriteFile(pwFile, []byte("from a file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ADMIN_EMAIL", "ops@example.org")
+	t.Setenv("ADMIN_PASSWORD_FILE", pwFile)
+	for i := 0; i < 2; i++ {
+		if err := bootstrapAdmin(); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+	users, _ := store.Users.List()
+	if len(users) != 1 || users[0].Role != "admin" || users[0].Username != "admin" || !verifyPassword("from a file", users[0].Password) {
+		t.Fatalf("seeded admin: %+v", users)
+	}
+	if _, err := os.Stat(setupTokenFile()); !os.IsNotExist(err) {
+		t.Fatalf("setup token issued despite ADMIN_EMAIL: %v", err)
+	}
+
+	dataDir = t.TempDir()
+	t.Setenv("ADMIN_PASSWORD_FILE", "")
+	if err := bootstrapAdmin(); err == nil {
+		t.Fatal("ADMIN_EMAIL without a password accepted")
+	}
+}
@@ -5,7 +5,7 @@ interface User {
   id: string
   email: string
   username: string
-  role: 'admin' | 'user'
+  role: string // admin, user lub rola zdefiniowana przez admina
   status: 'active' | 'suspended' | 'pending'
   createdAt: string
   updatedAt: string
@@ -32,7 +32,9 @@ interface RegisterData {
   email: string
   username: string
   password: string
-  inviteToken?: string
+  invite_token?: string
+  invite_sig?: string
+  form_started_at?: number
 }
 
 const AuthContext = createContext<AuthContextType | undefined>(undefined)
@@ -55,18 +55,66 @@ export interface RegisterRequest {
   email: string
   username: string
   password: string
-  inviteToken?: string
+  invite_token?: string
+  invite_sig?: string
+  form_started_at?: number // unix ms, kiedy formularz został wyświetlony
 }
 
 export interface User {
   id: string
   email: string
   username: string
-  role: 'admin' | 'user'
-  status: 'active' | 'suspended' | 'pending'
+  role: string // admin, user lub rola zdefiniowana przez admina
+  status: 'pending' | 'active' | 'suspended' | 'deleted'
+  status_reason?: string
   created_at: string
   updated_at: string
   vpn_config?: VPNConfig
+  groups?: string[]
+  permissions?: string[]
+}
+
+export interface Permission {
+  name: string
+  description: string
+}
+
+export interface Role {
+  name: string
+  description?: string
+  permissions: string[]
+  builtin?: boolean
+  created_at?: string
+  updated_at?: string
+}
+
+// Uprawnienia użytkownika: z roli (from_role) i nadane bezpośrednio (direct)
+export interface UserPermissions {
+  user_id: string
+  role: string
+  permissions: string[]
+  from_role: string[]
+  direct: string[]
+}
+
+export interface Group {
+  id: string
+  name: string
+  description?: string
+  parent?: string
+  teamspeak_group?: string
+  vpn_subnets?: string[]
+  created_at: string
+  updated_at: string
+}
+
+// Co dają użytkownikowi jego grupy; groups obejmuje grupy nadrzędne
+export interface UserAccess {
+  user_id: string
+  direct: string[]
+  groups: string[]
+  teamspeak_groups: string[]
+  vpn_subnets: string[]
 }
 
 export interface VPNConfig {
@@ -93,6 +141,16 @@ export interface Invite {
   used: boolean
 }
 
+// Odpowiedź endpointów listujących; kolejną stronę pobiera się z ?cursor=next_cursor
+export interface Page<T> {
+  items: T[]
+  total: number
+  next_cursor?: string
+}
+
+// Parametry list: limit, cursor, sort (np. '-created_at'), q, filtry i zakresy dat
+export type ListParams = Record<string, string | number | boolean | undefined>
+
 // Funkcje API
 export const authAPI = {
   login: (data: LoginRequest) => 
@@ -112,8 +170,8 @@ export const authAPI = {
 }
 
 export const usersAPI = {
-  getUsers: () => 
-    api.get<User[]>('/api/users'),
+  getUsers: (params?: ListParams) => 
+    api.get<Page<User>>('/api/users', { params }),
   
   getUser: (id: string) => 
     api.get<User>(`/api/users/${id}`),
@@ -121,8 +179,20 @@ export const usersAPI = {
   updateUser: (id: string, data: Partial<User>) => 
     api.put<User>(`/api/users/${id}`, data),
   
-  deleteUser: (id: string) => 
-    api.delete(`/api/users/${id}`),
+  deleteUser: (id: string, reason: string) => 
+    api.delete(`/api/users/${id}`, { data: { reason } }),
+  
+  setStatus: (id: string, status: User['status'], reason: string) => 
+    api.put(`/api/users/${id}/status`, { status, reason }),
+  
+  setRole: (id: string, role: User['role'], reason: string) => 
+    api.put(`/api/users/${id}/role`, { role, reason }),
+  
+  getGroups: (id: string) => 
+    api.get<UserAccess>(`/api/users/${id}/groups`),
+  
+  getPermissions: (id: string) => 
+    api.get<UserPermissions>(`/api/users/${id}/permissions`),
   
   enableVPN: (id: string) => 
     api.post(`/api/users/${id}/vpn/enable`),
@@ -132,8 +202,8 @@ export const usersAPI = {
 }
 
 export const adminAPI = {
-  getRegistrations: () => 
-    api.get<Registration[]>('/api/admin/registrations'),
+  getRegistrations: (params?: ListParams) => 
+    api.get<Page<Registration>>('/api/admin/registrations', { params }),
   
   approveRegistration: (id: string) => 
     api.post(`/api/admin/registrations/${id}/approve`),
@@ -144,8 +214,8 @@ export const adminAPI = {
   createInvite: (email: string) => 
     api.post('/api/admin/invites', { email }),
   
-  getInvites: () => 
-    api.get<Invite[]>('/api/admin/invites'),
+  getInvites: (params?: ListParams) => 
+    api.get<Page<Invite>>('/api/admin/invites', { params }),
   
   deleteInvite: (token: string) => 
     api.delete(`/api/admin/invites/${token}`),
@@ -154,6 +224,49 @@ export const adminAPI = {
     api.post('/api/admin/authelia/restart'),
 }
 
+export const rolesAPI = {
+  getPermissions: () => 
+    api.get<Permission[]>('/api/admin/permissions'),
+  
+  getRoles: () => 
+    api.get<Role[]>('/api/admin/roles'),
+  
+  createRole: (data: Pick<Role, 'name' | 'description' | 'permissions'>) => 
+    api.post<Role>('/api/admin/roles', data),
+  
+  updateRole: (name: string, data: Pick<Role, 'description' | 'permissions'>) => 
+    api.put<Role>(`/api/admin/roles/${name}`, data),
+  
+  deleteRole: (name: string) => 
+    api.delete(`/api/admin/roles/${name}`),
+}
+
+export const groupsAPI = {
+  getGroups: (params?: ListParams) => 
+    api.get<Page<Group>>('/api/admin/groups', { params }),
+  
+  getGroup: (id: string) => 
+    api.get<{ group: Group; subgroups: string[] }>(`/api/admin/groups/${id}`),
+  
+  createGroup: (data: Partial<Group>) => 
+    api.post<Group>('/api/admin/groups', data),
+  
+  updateGroup: (id: string, data: Partial<Group>) => 
+    api.put<Group>(`/api/admin/groups/${id}`, data),
+  
+  deleteGroup: (id: string) => 
+    api.delete(`/api/admin/groups/${id}`),
+  
+  getMembers: (id: string, params?: ListParams) => 
+    api.get<Page<User>>(`/api/admin/groups/${id}/members`, { params }),
+  
+  addMember: (id: string, userId: string) => 
+    api.put<UserAccess>(`/api/admin/groups/${id}/members/${userId}`),
+  
+  removeMember: (id: string, userId: string) => 
+    api.delete<UserAccess>(`/api/admin/groups/${id}/members/${userId}`),
+}
+
 export const vpnAPI = {
   getConfig: (userId: string) => 
     api.get(`/api/vpn/config/${userId}`),
@@ -163,11 +276,14 @@ export const vpnAPI = {
   
   getStatus: () => 
     api.get('/api/vpn/status'),
+  
+  getPolicy: (userId: string) => 
+    api.get(`/api/vpn/policy/${userId}`),
 }
 
 export const teamspeakAPI = {
-  getUsers: () => 
-    api.get('/api/teamspeak/users'),
+  getUsers: (params?: ListParams) => 
+    api.get<Page<any>>('/api/teamspeak/users', { params }),
   
   createUser: (data: any) => 
     api.post('/api/teamspeak/users', data),
@@ -13,21 +13,29 @@ const Register: React.FC = () => {
     username: '',
     password: '',
     confirmPassword: '',
-    inviteToken: ''
+    inviteToken: '',
+    inviteSig: ''
   })
   const [isLoading, setIsLoading] = useState(false)
   const [errors, setErrors] = useState<{ [key: string]: string }>({})
   const [isSuccess, setIsSuccess] = useState(false)
+  // Czas wyświetlenia formularza - serwer ocenia po nim zbyt szybkie zgłoszenia
+  const [formStartedAt] = useState(() => Date.now())
   
   const { register } = useAuth()
   const navigate = useNavigate()
   const [searchParams] = useSearchParams()
   
-  // Pobierz token z URL jeśli istnieje
+  // Pobierz zaproszenie z linku (?invite=…&sig=…&email=…) jeśli istnieje
   React.useEffect(() => {
-    const token = searchParams.get('token')
+    const token = searchParams.get('invite')
     if (token) {
-      setFormData(prev => ({ ...prev, inviteToken: token }))
+      setFormData(prev => ({
+        ...prev,
+        inviteToken: token,
+        inviteSig: searchParams.get('sig') || '',
+        email: searchParams.get('email') || prev.email
+      }))
     }
   }, [searchParams])
 
@@ -77,7 +85,9 @@ const Register: React.FC = () => {
         email: formData.email,
         username: formData.username,
         password: formData.password,
-        inviteToken: formData.inviteToken
+        invite_token: formData.inviteToken,
+        invite_sig: formData.inviteSig,
+        form_started_at: formStartedAt
       })
       
       setIsSuccess(true)